@@ -2,28 +2,48 @@ package main
 
 import (
 	"flag"
-	"github.com/BurntSushi/toml"
+	"fmt"
 	"github.com/gasparian/money-transfers-api/internal/app/apiserver"
+	"io"
 	"log"
+	"os"
 )
 
 var (
 	configPath string
+	// commands holds subcommands which are run instead of the server
+	commands = map[string]func(*apiserver.Config, []string, io.Writer) error{
+		"migrate":      apiserver.Migrate,
+		"backup":       apiserver.Backup,
+		"restore":      apiserver.Restore,
+		"audit-verify": apiserver.VerifyAudit,
+		"apikey":       apiserver.APIKey,
+	}
 )
 
 func init() {
 	flag.StringVar(&configPath, "config-path", "configs/apiserver.toml", "path to config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate status|up|down|to <version> | backup <path> | restore <path> | audit-verify | apikey issue <name> <scope,...>|list|rotate <key id>|revoke <key id>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
 	flag.Parse()
 
-	config := apiserver.NewConfig()
-	_, err := toml.DecodeFile(configPath, config)
+	config, err := apiserver.LoadConfig(configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if command, ok := commands[flag.Arg(0)]; ok {
+		if err := command(config, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	s := apiserver.New(config)
 	if err := s.Start(); err != nil {
 		log.Fatal(err)
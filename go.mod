@@ -4,5 +4,9 @@ go 1.13
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/golang/protobuf v1.3.3
+	github.com/gorilla/websocket v1.4.2
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	google.golang.org/grpc v1.29.1
 )
@@ -1,69 +1,162 @@
 package apiserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/outbox"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
 	"github.com/gasparian/money-transfers-api/internal/app/store"
-	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+	"github.com/gasparian/money-transfers-api/internal/app/webhooks"
 )
 
 var (
 	idNotPresented        = errors.New("Account id not presented in request params")
 	timeRangeNotPresented = errors.New("Number of days to query transfers stats is not presented in request params")
 	limitNotPresented     = errors.New("Query limit is not presented in reqeust params")
+	invalidAmountErr      = errors.New("Transfer amount must be positive")
+	sameAccountsErr       = errors.New("Can't transfer money to the same account")
+	invalidETagErr        = errors.New("If-Match must hold a single strong entity tag of the account")
+	outboxIntervalErr     = errors.New("Outbox relay interval must be positive")
+	outboxBatchSizeErr    = errors.New("Outbox relay batch size must be positive")
 )
 
 // APIServer holds data needed to run api server
 type APIServer struct {
-	config *Config
-	logger *logger
-	router *http.ServeMux
-	store  store.Store
+	config   *Config
+	logger   *logger
+	router   *http.ServeMux
+	handler  http.Handler
+	store    store.Store
+	metrics  *serverMetrics
+	broker   *pubsub.Broker
+	webhooks *webhooks.Dispatcher
+	relay    *outbox.Relay
+	tracer   *tracing.Tracer
+	// backend is the store wrapped by the instrumented one, it's used
+	// to check the optional capabilities of the store
+	backend store.Store
+	// ready is set while the server accepts traffic
+	ready   int32
+	streams *drainer
+}
+
+type brokerSetter interface {
+	SetBroker(broker *pubsub.Broker)
 }
 
 // New creates new instance of APIServer struct
 func New(config *Config) *APIServer {
 	s := &APIServer{
-		config: config,
-		logger: NewLogger(),
-		router: http.NewServeMux(),
+		config:  config,
+		logger:  NewLogger(),
+		router:  http.NewServeMux(),
+		broker:  pubsub.NewBroker(),
+		streams: newDrainer(),
 	}
 	s.configureLogger()
+	s.configureMetrics()
 	s.configureRouter()
 	return s
 }
 
 func (s *APIServer) setStore(store store.Store) {
-	s.store = store
+	s.backend = store
+	s.store = s.instrument(store)
+	if bs, ok := store.(brokerSetter); ok {
+		bs.SetBroker(s.broker)
+	}
 }
 
-// Start runs db and api server
-func (s *APIServer) Start() error {
-	store, err := sqlstore.New(s.config.DbPath, s.config.QueryTimeout)
+func (s *APIServer) setWebhooks(store webhooks.Store) {
+	s.webhooks = webhooks.NewDispatcher(store, webhooks.Config{
+		MaxRetries:     s.config.WebhookMaxRetries,
+		InitialBackoff: time.Duration(s.config.WebhookBackoff) * time.Millisecond,
+		Timeout:        time.Duration(s.config.WebhookTimeout) * time.Second,
+		Workers:        s.config.WebhookWorkers,
+	})
+}
+
+// newOutboxRelay creates relay for the configured publisher;
+// returns nil if the publisher is not set
+func (s *APIServer) newOutboxRelay(source outbox.Source) (*outbox.Relay, error) {
+	if s.config.OutboxPublisher == "" {
+		return nil, nil
+	}
+	if s.config.OutboxInterval == 0 {
+		return nil, outboxIntervalErr
+	}
+	if s.config.OutboxBatchSize <= 0 {
+		return nil, fmt.Errorf("%w: %d", outboxBatchSizeErr, s.config.OutboxBatchSize)
+	}
+	publisher, err := outbox.NewPublisher(
+		s.config.OutboxPublisher,
+		s.config.OutboxTarget,
+		time.Duration(s.config.QueryTimeout)*time.Second,
+	)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	defer store.Close()
-	s.setStore(store)
-	s.logger.Info("Starting api server")
-	return http.ListenAndServe(s.config.BindAddr, s.router)
+	relay := outbox.NewRelay(
+		source,
+		publisher,
+		time.Duration(s.config.OutboxInterval)*time.Millisecond,
+		s.config.OutboxBatchSize,
+	)
+	relay.OnError(func(err error) {
+		s.logger.Error("Outbox relay failed", errField(err))
+	})
+	return relay, nil
 }
 
 func (s *APIServer) configureLogger() {
-	s.logger.SetLevel(s.config.LogLevel)
+	if err := s.logger.SetLevel(s.config.LogLevel); err != nil {
+		s.logger.Warn("Log level of the config is ignored", errField(err), fld("level", s.logger.Level()))
+	}
 }
 
 func (s *APIServer) configureRouter() {
 	s.router.HandleFunc("/health", s.handleHealth())
-	s.router.HandleFunc("/api/v1/accounts", s.handleAccounts())
-	s.router.HandleFunc("/api/v1/transfer-money", s.handleTransferMoney())
-	s.router.HandleFunc("/api/v1/transactions", s.handleTransactions())
+	s.router.HandleFunc("/livez", s.handleHealth())
+	s.router.HandleFunc("/readyz", s.handleReady())
+	s.router.HandleFunc("/api/v1/accounts", s.require(
+		models.ScopeAccountsRead,
+		models.ScopeAccountsWrite,
+		s.withTimeout(s.config.Timeouts.Accounts, s.handleAccounts()),
+	))
+	s.router.HandleFunc("/api/v1/accounts/", s.requireScope(models.ScopeAccountsRead, s.handleAccountEvents()))
+	s.router.HandleFunc("/api/v1/transfer-money", s.requireScope(
+		models.ScopeTransfersCreate,
+		s.withTimeout(s.config.Timeouts.Transfer, s.handleTransferMoney()),
+	))
+	s.router.HandleFunc("/api/v1/transactions", s.requireScope(
+		models.ScopeAccountsRead,
+		s.withTimeout(s.config.Timeouts.Transactions, s.handleTransactions()),
+	))
+	// NOTE: transfers submitted through the websocket require their own scope
+	s.router.HandleFunc("/api/v1/ws", s.requireScope(models.ScopeAccountsRead, s.handleWebSocket()))
+	s.router.HandleFunc("/api/v1/webhooks", s.requireScope(models.ScopeAdmin, s.handleWebhooks()))
+	s.router.HandleFunc("/api/v1/webhooks/deliveries", s.requireScope(models.ScopeAdmin, s.handleWebhookDeliveries()))
+	s.router.HandleFunc("/api/v1/webhooks/replay", s.requireScope(models.ScopeAdmin, s.handleWebhookReplay()))
+	s.router.HandleFunc("/api/v1/admin/backup", s.requireScope(models.ScopeAdmin, s.handleBackup()))
+	s.router.HandleFunc("/api/v1/admin/log-level", s.requireScope(models.ScopeAdmin, s.handleLogLevel()))
+	s.router.HandleFunc("/api/v1/admin/audit", s.requireScope(models.ScopeAdmin, s.handleAudit()))
+	s.router.HandleFunc("/api/v1/admin/api-keys", s.requireScope(models.ScopeAdmin, s.handleAPIKeys()))
+	s.router.HandleFunc("/api/v1/admin/api-keys/rotate", s.requireScope(models.ScopeAdmin, s.handleAPIKeyRotate()))
+	s.router.HandleFunc("/metrics", s.handleMetrics())
+	s.handler = s.withMetrics(s.withTracing(s.withAccessLog(s.withAuth(s.withAudit(s.router)))))
 }
 
+// handleHealth reports that the process is up and serves requests; dependencies are not checked,
+// so their outage doesn't make the orchestrator restart the server
 func (s *APIServer) handleHealth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -71,11 +164,81 @@ func (s *APIServer) handleHealth() http.HandlerFunc {
 	}
 }
 
+// timeoutContext limits the context with the endpoint timeout in ms, 0 leaves it as is
+func timeoutContext(ctx context.Context, timeout uint32) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+}
+
+// withTimeout sets deadline of the request context, so the store stops working on the request
+// once it's expired or the client has disconnected
+func (s *APIServer) withTimeout(timeout uint32, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := timeoutContext(r.Context(), timeout)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// storeErrorStatus returns status code of the failed store call
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, store.VersionConflictErr):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, store.AccountNotFoundErr):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// accountETag returns entity tag of the account version
+func accountETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatchVersion returns the account version expected by the If-Match header;
+// any version is accepted if the header is missing or `*`
+func ifMatchVersion(r *http.Request) (int64, error) {
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if etag == "" || etag == "*" {
+		return store.AnyVersion, nil
+	}
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, invalidETagErr
+	}
+	version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, invalidETagErr
+	}
+	return version, nil
+}
+
 func (s *APIServer) handleError(err error, statusCode int, w http.ResponseWriter, r *http.Request) {
-	s.logger.Error(fmt.Sprintf("Method: %s; error: %s", r.URL.Path, err.Error()))
+	s.log(r.Context()).Error("Request failed", fld("status", statusCode), errField(err))
 	w.WriteHeader(statusCode)
 }
 
+// strongReader is implemented by stores which serve reads from a replica,
+// Strong returns view which reads from the primary
+type strongReader interface {
+	Strong() store.Store
+}
+
+// reader returns store for the read request: replica reads could lag behind,
+// so `consistency=strong` query param routes the read to the primary to see own writes
+func (s *APIServer) reader(r *http.Request) store.Store {
+	if r.URL.Query().Get("consistency") == "strong" {
+		if sr, ok := s.backend.(strongReader); ok {
+			return s.instrument(sr.Strong())
+		}
+	}
+	return s.store
+}
+
 func parseIntQueryParams(r *http.Request, paramNames ...string) (map[string]int64, error) {
 	params := r.URL.Query()
 	m := make(map[string]int64)
@@ -101,11 +264,16 @@ func (s *APIServer) handleAccounts() http.HandlerFunc {
 				s.handleError(err, http.StatusBadRequest, w, r)
 				return
 			}
-			accModel, err := s.store.InsertAccount(acc.Balance)
+			accModel, err := s.store.InsertAccount(r.Context(), acc.Balance)
 			if err != nil {
-				s.handleError(err, http.StatusInternalServerError, w, r)
+				s.handleError(err, storeErrorStatus(err), w, r)
 				return
 			}
+			annotate(r.Context(), fld("account_id", accModel.AccountID))
+			s.emit(webhooks.AccountCreated, AccountJsonView{
+				AccountID: accModel.AccountID,
+				Balance:   accModel.Balance,
+			})
 			w.WriteHeader(http.StatusOK)
 			json.NewEncoder(w).Encode(AccountIDJsonView{ID: accModel.AccountID})
 		case "DELETE":
@@ -114,11 +282,18 @@ func (s *APIServer) handleAccounts() http.HandlerFunc {
 				s.handleError(err, http.StatusBadRequest, w, r)
 				return
 			}
-			err = s.store.DeleteAccount(valMap["account_id"])
+			annotate(r.Context(), fld("account_id", valMap["account_id"]))
+			version, err := ifMatchVersion(r)
 			if err != nil {
-				s.handleError(err, http.StatusInternalServerError, w, r)
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			err = s.store.DeleteAccount(r.Context(), valMap["account_id"], version)
+			if err != nil {
+				s.handleError(err, storeErrorStatus(err), w, r)
 				return
 			}
+			s.emit(webhooks.AccountDeleted, AccountIDJsonView{ID: valMap["account_id"]})
 			w.WriteHeader(http.StatusNoContent)
 		case "GET":
 			w.Header().Set("Content-type", "application/json")
@@ -127,15 +302,18 @@ func (s *APIServer) handleAccounts() http.HandlerFunc {
 				s.handleError(err, http.StatusBadRequest, w, r)
 				return
 			}
-			accModel, err := s.store.GetAccount(valMap["account_id"])
+			annotate(r.Context(), fld("account_id", valMap["account_id"]))
+			accModel, err := s.reader(r).GetAccount(r.Context(), valMap["account_id"])
 			if err != nil {
-				s.handleError(err, http.StatusInternalServerError, w, r)
+				s.handleError(err, storeErrorStatus(err), w, r)
 				return
 			}
+			w.Header().Set("ETag", accountETag(accModel.Version))
 			w.WriteHeader(http.StatusOK)
 			json.NewEncoder(w).Encode(AccountJsonView{
 				AccountID: accModel.AccountID,
 				Balance:   accModel.Balance,
+				Version:   accModel.Version,
 			})
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -144,6 +322,47 @@ func (s *APIServer) handleAccounts() http.HandlerFunc {
 	}
 }
 
+// validateTransfer checks transfer request before passing it to the store
+func validateTransfer(tr TransactionJsonView) error {
+	if tr.Amount <= 0 {
+		return invalidAmountErr
+	}
+	if tr.FromAccountID == tr.ToAccountID {
+		return sameAccountsErr
+	}
+	return nil
+}
+
+// checkTransfer validates transfer request, rejected one is recorded in the audit log
+func (s *APIServer) checkTransfer(ctx context.Context, tr TransactionJsonView) error {
+	err := validateTransfer(tr)
+	if err != nil {
+		s.auditRejectedTransfer(ctx, tr, err)
+	}
+	return err
+}
+
+// transferMoney performs validated transfer and notifies webhooks about the outcome
+func (s *APIServer) transferMoney(ctx context.Context, tr TransactionJsonView) error {
+	err := s.store.TransferMoney(
+		ctx,
+		tr.ToAccountID,
+		tr.FromAccountID,
+		tr.Amount,
+	)
+	s.metrics.observeTransfer(tr.Amount, err)
+	if err != nil {
+		s.emit(webhooks.TransferFailed, TransferFailedJsonView{
+			TransactionJsonView: tr,
+			Error:               err.Error(),
+		})
+		s.auditRejectedTransfer(ctx, tr, err)
+		return err
+	}
+	s.emit(webhooks.TransferCompleted, tr)
+	return nil
+}
+
 func (s *APIServer) handleTransferMoney() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -152,14 +371,19 @@ func (s *APIServer) handleTransferMoney() http.HandlerFunc {
 			err := json.NewDecoder(r.Body).Decode(&tr)
 			if err != nil {
 				s.handleError(err, http.StatusBadRequest, w, r)
+				return
 			}
-			err = s.store.TransferMoney(
-				tr.ToAccountID,
-				tr.FromAccountID,
-				tr.Amount,
+			annotate(r.Context(),
+				fld("from_account_id", tr.FromAccountID),
+				fld("to_account_id", tr.ToAccountID),
+				fld("amount", tr.Amount),
 			)
-			if err != nil {
-				s.handleError(err, http.StatusInternalServerError, w, r)
+			if err := s.checkTransfer(r.Context(), tr); err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			if err := s.transferMoney(r.Context(), tr); err != nil {
+				s.handleError(err, storeErrorStatus(err), w, r)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -180,14 +404,16 @@ func (s *APIServer) handleTransactions() http.HandlerFunc {
 				s.handleError(err, http.StatusBadRequest, w, r)
 				return
 			}
+			annotate(r.Context(), fld("account_id", valMap["account_id"]))
 
-			transactions, err := s.store.GetTransactionsHistory(
+			transactions, err := s.reader(r).GetTransactionsHistory(
+				r.Context(),
 				valMap["account_id"],
 				valMap["n_last_days"],
 				valMap["limit"],
 			)
 			if err != nil {
-				s.handleError(err, http.StatusInternalServerError, w, r)
+				s.handleError(err, storeErrorStatus(err), w, r)
 				return
 			}
 			transactionsJson := make([]TransactionJsonView, len(transactions))
@@ -1,15 +1,32 @@
 package apiserver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gasparian/money-transfers-api/internal/app/grpcapi"
+	"github.com/gasparian/money-transfers-api/internal/app/models"
 	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -27,16 +44,19 @@ func addQueryParams(req *http.Request, params map[string]string) {
 }
 
 func TestAPIServer(t *testing.T) {
+	ctx := context.Background()
 	dbPath := "/tmp/tets.db"
 	store, err := sqlstore.New(dbPath, 10)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer store.Close()
+	defer os.RemoveAll(dbPath + ".lock")
 	defer os.RemoveAll(dbPath)
 
 	s := New(NewConfig())
 	s.setStore(store)
+	s.setWebhooks(store)
 
 	t.Run("Health", func(t *testing.T) {
 		rec := httptest.NewRecorder()
@@ -47,6 +67,415 @@ func TestAPIServer(t *testing.T) {
 		}
 	})
 
+	t.Run("Readiness", func(t *testing.T) {
+		readiness := func() (int, ReadinessJsonView) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+			s.handleReady().ServeHTTP(rec, req)
+			res := ReadinessJsonView{}
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			return rec.Code, res
+		}
+		if code, res := readiness(); code != http.StatusServiceUnavailable || res.Checks["server"].Status != checkFail {
+			t.Errorf("expected server not to be ready before the start, got %v: %+v", code, res)
+		}
+
+		s.setReady(true)
+		defer s.setReady(false)
+		code, res := readiness()
+		if code != http.StatusOK || res.Status != checkOk {
+			t.Errorf("expected server to be ready, got %v: %+v", code, res)
+		}
+		for _, name := range []string{"server", "store", "migrations", "disk", "webhooks"} {
+			if res.Checks[name].Status != checkOk {
+				t.Errorf("expected %s check to pass, got %+v", name, res.Checks[name])
+			}
+		}
+
+		minFreeDisk := s.config.Probes.MinFreeDiskMB
+		s.config.Probes.MinFreeDiskMB = 1 << 40
+		code, res = readiness()
+		s.config.Probes.MinFreeDiskMB = minFreeDisk
+		if code != http.StatusServiceUnavailable || res.Checks["disk"].Status != checkFail {
+			t.Errorf("expected low disk space to fail readiness, got %v: %+v", code, res)
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		accFrom, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed := s.metrics.transfers.Value(transferCompleted)
+		for _, amount := range []int64{30, 1000} {
+			b, _ := json.Marshal(TransactionJsonView{FromAccountID: accFrom.AccountID, ToAccountID: accTo.AccountID, Amount: amount})
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/transfer-money", bytes.NewBuffer(b))
+			s.handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		if s.metrics.transfers.Value(transferCompleted) != completed+1 || s.metrics.transferAmount.Value(transferFailed) < 1000 {
+			t.Error("expected transfers to be counted by outcome")
+		}
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts/100500/events", nil)
+		s.handler.ServeHTTP(rec, req)
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+		s.handler.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		for _, series := range []string{
+			`http_requests_total{route="/api/v1/transfer-money",method="POST",code="204"}`,
+			`http_requests_total{route="/api/v1/accounts/",method="GET",code="404"}`,
+			`http_request_duration_seconds_count{route="/api/v1/transfer-money",method="POST",code="204"}`,
+			`store_call_duration_seconds_count{method="TransferMoney",outcome="error"}`,
+			`db_pool_open_connections{pool="write"}`,
+			`go_goroutines`,
+		} {
+			if !strings.Contains(body, "\n"+series+" ") {
+				t.Errorf("expected %s in the metrics", series)
+			}
+		}
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		s.tracer = tracing.NewTracer(tracing.NewWriterExporter(&buf, "api"), tracing.Options{SampleRatio: 1})
+		defer func() { s.tracer = nil }()
+
+		traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+		addQueryParams(req, map[string]string{"account_id": fmt.Sprint(acc.AccountID)})
+		req.Header.Set(tracing.TraceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %v, got %v", http.StatusOK, rec.Code)
+		}
+		s.tracer.Shutdown()
+
+		type span struct {
+			TraceID      string                 `json:"trace_id"`
+			SpanID       string                 `json:"span_id"`
+			ParentSpanID string                 `json:"parent_span_id"`
+			Name         string                 `json:"name"`
+			Attributes   map[string]interface{} `json:"attributes"`
+		}
+		spans := make(map[string]span)
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var sp span
+			if err := dec.Decode(&sp); err != nil {
+				t.Fatal(err)
+			}
+			if sp.TraceID != traceID {
+				t.Errorf("expected span %s to continue the trace of the caller", sp.Name)
+			}
+			spans[sp.Name] = sp
+		}
+		server, storeCall, query := spans["GET /api/v1/accounts"], spans["store.GetAccount"], spans["SELECT"]
+		if server.ParentSpanID != "00f067aa0ba902b7" || server.Attributes["http.status_code"] != float64(http.StatusOK) {
+			t.Errorf("unexpected server span: %+v", server)
+		}
+		if storeCall.ParentSpanID == "" || storeCall.ParentSpanID != server.SpanID {
+			t.Errorf("expected store call to be the child of the request, got %+v", storeCall)
+		}
+		if query.ParentSpanID == "" || query.ParentSpanID != storeCall.SpanID || query.Attributes["db.system"] != "sqlite" {
+			t.Errorf("expected sql statement to be the child of the store call, got %+v", query)
+		}
+	})
+
+	t.Run("Logging", func(t *testing.T) {
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		serverLogger := s.logger
+		s.logger = newLogger(&buf)
+		defer func() { s.logger = serverLogger }()
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+		addQueryParams(req, map[string]string{"account_id": fmt.Sprint(acc.AccountID)})
+		req.Header.Set(requestIDHeader, "req-1")
+		s.handler.ServeHTTP(rec, req)
+		if rec.Header().Get(requestIDHeader) != "req-1" {
+			t.Errorf("expected request id to be echoed, got %q", rec.Header().Get(requestIDHeader))
+		}
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodPost, "/api/v1/transfer-money", strings.NewReader(`{"from_account_id":1,"to_account_id":1,"amount":10}`))
+		req.Header.Set(requestIDHeader, "bad id\n")
+		s.handler.ServeHTTP(rec, req)
+		generated := rec.Header().Get(requestIDHeader)
+		if generated == "" || generated == "bad id\n" {
+			t.Errorf("expected invalid request id to be replaced, got %q", generated)
+		}
+
+		var entries []map[string]interface{}
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			entry := make(map[string]interface{})
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("expected access logs of both requests and the error, got %v", entries)
+		}
+		access := entries[0]
+		if access["msg"] != "Request served" || access["request_id"] != "req-1" || access["route"] != "/api/v1/accounts" ||
+			access["account_id"] != float64(acc.AccountID) || access["status"] != float64(http.StatusOK) || access["latency_ms"] == nil {
+			t.Errorf("unexpected access log entry: %v", access)
+		}
+		failed := entries[1]
+		if failed["level"] != "error" || failed["request_id"] != generated || failed["error"] != sameAccountsErr.Error() ||
+			failed["from_account_id"] != float64(1) {
+			t.Errorf("unexpected error entry: %v", failed)
+		}
+		if entries[2]["status"] != float64(http.StatusBadRequest) {
+			t.Errorf("unexpected access log entry: %v", entries[2])
+		}
+
+		setLevel := func(level string) int {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPut, "/api/v1/admin/log-level", strings.NewReader(`{"level":"`+level+`"}`))
+			s.handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		if code := setLevel("error"); code != http.StatusOK || s.logger.Level() != "error" {
+			t.Errorf("expected level to be changed, got %v and %s", code, s.logger.Level())
+		}
+		if code := setLevel("verbose"); code != http.StatusBadRequest || s.logger.Level() != "error" {
+			t.Errorf("expected unknown level to be rejected, got %v and %s", code, s.logger.Level())
+		}
+		buf.Reset()
+		req, _ = http.NewRequest(http.MethodGet, "/api/v1/admin/log-level", nil)
+		rec = httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), `"level":"error"`) || buf.Len() != 0 {
+			t.Errorf("expected only errors to be logged, got %q", buf.String())
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/accounts", strings.NewReader(`{"balance":500}`))
+		req.Header.Set(requestIDHeader, "audit-1")
+		req.RemoteAddr = "10.0.0.1:4321"
+		s.handler.ServeHTTP(rec, req)
+		var acc AccountJsonView
+		if err := json.NewDecoder(rec.Body).Decode(&acc); err != nil {
+			t.Fatal(err)
+		}
+
+		auditLog := func(params map[string]string) (int, []AuditEntryJsonView) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/admin/audit", nil)
+			addQueryParams(req, params)
+			s.handler.ServeHTTP(rec, req)
+			var entries []AuditEntryJsonView
+			if rec.Code == http.StatusOK {
+				if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return rec.Code, entries
+		}
+		code, entries := auditLog(map[string]string{"resource": fmt.Sprintf("account:%d", acc.AccountID)})
+		if code != http.StatusOK || len(entries) != 1 {
+			t.Fatalf("expected the single entry of the created account, got %v: %+v", code, entries)
+		}
+		created := entries[0]
+		if created.Action != models.AuditAccountCreated || created.Actor != anonymousActor || created.SourceIP != "10.0.0.1" ||
+			created.RequestID != "audit-1" || !strings.Contains(string(created.After), `"balance":500`) {
+			t.Errorf("unexpected audit entry: %+v", created)
+		}
+		if _, entries := auditLog(map[string]string{"action": models.AuditLogLevelChanged}); len(entries) == 0 {
+			t.Error("expected the change of the log level to be recorded")
+		}
+
+		other, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range []string{
+			fmt.Sprintf(`{"from_account_id": %d, "to_account_id": %d, "amount": 100}`, acc.AccountID, acc.AccountID),
+			fmt.Sprintf(`{"from_account_id": %d, "to_account_id": %d, "amount": 100000}`, acc.AccountID, other.AccountID),
+		} {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/transfer-money", strings.NewReader(body))
+			s.handler.ServeHTTP(rec, req)
+			if rec.Code < 400 {
+				t.Fatalf("expected transfer %v to fail, got %v", body, rec.Code)
+			}
+		}
+		_, entries = auditLog(map[string]string{
+			"action":   models.AuditTransferRejected,
+			"resource": fmt.Sprintf("account:%d", acc.AccountID),
+		})
+		if len(entries) != 2 || !strings.Contains(string(entries[0].After), sameAccountsErr.Error()) {
+			t.Errorf("expected both rejected transfers to be recorded, got %+v", entries)
+		}
+		if code, _ := auditLog(map[string]string{"after_id": "last"}); code != http.StatusBadRequest {
+			t.Errorf("expected %v for the invalid id, got %v", http.StatusBadRequest, code)
+		}
+
+		var out bytes.Buffer
+		config := NewConfig()
+		config.SQLite.DbPath = dbPath
+		if err := VerifyAudit(config, nil, &out); err != nil || !strings.Contains(out.String(), "intact") {
+			t.Errorf("expected audit log to be intact, got %q: %v", out.String(), err)
+		}
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		s.config.Auth.Enabled = true
+		defer func() { s.config.Auth.Enabled = false }()
+
+		_, adminKey, err := issueAPIKey(ctx, store, "admin", []string{models.ScopeAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		call := func(method, target, key, body string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, target, strings.NewReader(body))
+			if key != "" {
+				req.Header.Set(authorizationHeader, bearerPrefix+key)
+			}
+			s.handler.ServeHTTP(rec, req)
+			return rec
+		}
+		account := fmt.Sprintf("/api/v1/accounts?account_id=%d", acc.AccountID)
+
+		if rec := call(http.MethodGet, "/health", "", ""); rec.Code != http.StatusOK {
+			t.Errorf("expected probes to stay open, got %v", rec.Code)
+		}
+		if rec := call(http.MethodGet, account, "", ""); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("expected %v without the key, got %v", http.StatusUnauthorized, rec.Code)
+		}
+		if rec := call(http.MethodGet, account, adminKey+"0", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected %v for the wrong secret, got %v", http.StatusUnauthorized, rec.Code)
+		}
+		if rec := call(http.MethodPost, "/api/v1/admin/api-keys", adminKey, `{"name":"bad","scopes":["root"]}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected unknown scope to be rejected, got %v", rec.Code)
+		}
+
+		issue := func() APIKeyJsonView {
+			rec := call(http.MethodPost, "/api/v1/admin/api-keys", adminKey, `{"name":"reader","scopes":["accounts:read","accounts:read"]}`)
+			var view APIKeyJsonView
+			if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusCreated || view.Key == "" || len(view.Scopes) != 1 {
+				t.Fatalf("expected the key to be issued, got %v: %+v", rec.Code, view)
+			}
+			return view
+		}
+		reader := issue()
+		if rec := call(http.MethodGet, account, reader.Key, ""); rec.Code != http.StatusOK {
+			t.Errorf("expected reader to get the account, got %v", rec.Code)
+		}
+		if rec := call(http.MethodDelete, account, reader.Key, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("expected reader not to delete the account, got %v", rec.Code)
+		}
+		if rec := call(http.MethodGet, "/api/v1/admin/api-keys", reader.Key, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("expected reader not to manage keys, got %v", rec.Code)
+		}
+		rec := call(http.MethodGet, "/api/v1/admin/api-keys", adminKey, "")
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"key":`) || !strings.Contains(rec.Body.String(), reader.KeyID) {
+			t.Errorf("expected keys to be listed without secrets, got %v: %s", rec.Code, rec.Body.String())
+		}
+
+		rec = call(http.MethodPost, "/api/v1/admin/api-keys/rotate?key_id="+reader.KeyID, adminKey, "")
+		var rotated APIKeyJsonView
+		json.NewDecoder(rec.Body).Decode(&rotated)
+		if rec.Code != http.StatusOK || rotated.Key == "" || rotated.KeyID != reader.KeyID {
+			t.Fatalf("expected the key to be rotated, got %v: %+v", rec.Code, rotated)
+		}
+		if rec := call(http.MethodGet, account, reader.Key, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected the old secret to stop working, got %v", rec.Code)
+		}
+		if rec := call(http.MethodGet, account, rotated.Key, ""); rec.Code != http.StatusOK {
+			t.Errorf("expected the new secret to work, got %v", rec.Code)
+		}
+		if rec := call(http.MethodDelete, "/api/v1/admin/api-keys?key_id="+reader.KeyID, adminKey, ""); rec.Code != http.StatusNoContent {
+			t.Errorf("expected the key to be revoked, got %v", rec.Code)
+		}
+		if rec := call(http.MethodGet, account, rotated.Key, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected the revoked key to be rejected, got %v", rec.Code)
+		}
+		if rec := call(http.MethodDelete, "/api/v1/admin/api-keys?key_id="+reader.KeyID, adminKey, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("expected %v for the revoked key, got %v", http.StatusNotFound, rec.Code)
+		}
+
+		entries, err := store.GetAuditLog(ctx, sqlstore.AuditFilter{Resource: "apikey:" + reader.KeyID, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		adminID, _, _ := parseAPIKey(adminKey)
+		if len(entries) != 3 || entries[0].Actor != adminID {
+			t.Errorf("expected key changes to be recorded on behalf of the admin key, got %+v", entries)
+		}
+
+		transferKey, _, err := issueAPIKey(ctx, store, "ws", []string{models.ScopeAccountsRead, models.ScopeTransfersCreate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := contextWithAPIKey(ctx, transferKey)
+		if err := s.reauthorize(session, models.ScopeTransfersCreate); err != nil {
+			t.Errorf("expected the session key to be authorized, got %v", err)
+		}
+		if err := store.RevokeAPIKey(ctx, transferKey.KeyID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.reauthorize(session, models.ScopeTransfersCreate); !errors.Is(err, invalidAPIKeyErr) {
+			t.Errorf("expected the key revoked during the session to be rejected, got %v", err)
+		}
+
+		if _, err := s.authorizeGRPC(ctx, "/transfers.v1.Transfers/TransferMoney"); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected %v without the key, got %v", codes.Unauthenticated, err)
+		}
+		reader = issue()
+		md := metadata.Pairs("authorization", bearerPrefix+reader.Key)
+		if _, err := s.authorizeGRPC(metadata.NewIncomingContext(ctx, md), "/transfers.v1.Transfers/TransferMoney"); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected %v without the scope, got %v", codes.PermissionDenied, err)
+		}
+		if _, err := s.authorizeGRPC(metadata.NewIncomingContext(ctx, md), "/transfers.v1.Accounts/GetAccount"); err != nil {
+			t.Errorf("expected reader to get the account over gRPC, got %v", err)
+		}
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+		addQueryParams(req, map[string]string{"account_id": fmt.Sprint(acc.AccountID)})
+		expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+		defer cancel()
+		s.withTimeout(1000, s.handleAccounts()).ServeHTTP(rec, req.WithContext(expired))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected %v for the expired request, got %v", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+
 	t.Run("CreateAccount", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		initBalance := AccountJsonView{Balance: 10000}
@@ -70,7 +499,7 @@ func TestAPIServer(t *testing.T) {
 
 	t.Run("DeleteAccount", func(t *testing.T) {
 		rec := httptest.NewRecorder()
-		acc, err := store.InsertAccount(10000)
+		acc, err := store.InsertAccount(ctx, 10000)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -82,16 +511,26 @@ func TestAPIServer(t *testing.T) {
 		if rec.Code > 204 {
 			t.Error(badStatusCodeErr)
 		}
-		_, err = store.GetAccount(acc.AccountID)
+		_, err = store.GetAccount(ctx, acc.AccountID)
 		if err == nil {
 			t.Error(accountNotDeletedErr)
 		}
+
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+		addQueryParams(req, map[string]string{
+			"account_id": fmt.Sprintf("%v", acc.AccountID),
+		})
+		s.handleAccounts().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected %v for the removed account, got %v", http.StatusNotFound, rec.Code)
+		}
 	})
 
 	t.Run("GetAccount", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		var initBalance int64 = 10000
-		acc, err := store.InsertAccount(initBalance)
+		acc, err := store.InsertAccount(ctx, initBalance)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -111,15 +550,77 @@ func TestAPIServer(t *testing.T) {
 		}
 	})
 
+	t.Run("IfMatch", func(t *testing.T) {
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := map[string]string{
+			"account_id": fmt.Sprintf("%v", acc.AccountID),
+		}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+		addQueryParams(req, params)
+		s.handleAccounts().ServeHTTP(rec, req)
+		etag := rec.Header().Get("ETag")
+		if etag != `"1"` {
+			t.Fatalf("expected ETag of the first version, got %q", etag)
+		}
+		if err := store.TransferMoney(ctx, other.AccountID, acc.AccountID, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		for ifMatch, code := range map[string]int{
+			etag:    http.StatusPreconditionFailed,
+			`W/"2"`: http.StatusBadRequest,
+			"2":     http.StatusBadRequest,
+			`"two"`: http.StatusBadRequest,
+		} {
+			rec = httptest.NewRecorder()
+			req, _ = http.NewRequest(http.MethodDelete, "/api/v1/accounts", nil)
+			req.Header.Set("If-Match", ifMatch)
+			addQueryParams(req, params)
+			s.handleAccounts().ServeHTTP(rec, req)
+			if rec.Code != code {
+				t.Errorf("expected %v for If-Match %v, got %v", code, ifMatch, rec.Code)
+			}
+		}
+		if _, err := store.GetAccount(ctx, acc.AccountID); err != nil {
+			t.Fatalf("expected account to survive stale If-Match: %v", err)
+		}
+
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodDelete, "/api/v1/accounts", nil)
+		req.Header.Set("If-Match", `"2"`)
+		addQueryParams(req, params)
+		s.handleAccounts().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("expected deletion with the current version, got %v", rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodDelete, "/api/v1/accounts", nil)
+		req.Header.Set("If-Match", `"2"`)
+		addQueryParams(req, params)
+		s.handleAccounts().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected %v for the removed account, got %v", http.StatusNotFound, rec.Code)
+		}
+	})
+
 	t.Run("Transfer", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		var accFromInitBalance int64 = 10000
-		accFrom, err := store.InsertAccount(accFromInitBalance)
+		accFrom, err := store.InsertAccount(ctx, accFromInitBalance)
 		if err != nil {
 			t.Fatal(err)
 		}
 		var accToInitBalance int64 = 0
-		accTo, err := store.InsertAccount(accToInitBalance)
+		accTo, err := store.InsertAccount(ctx, accToInitBalance)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -137,8 +638,8 @@ func TestAPIServer(t *testing.T) {
 		if rec.Code > 204 {
 			t.Error(badStatusCodeErr)
 		}
-		accFromNew, _ := store.GetAccount(accFrom.AccountID)
-		accToNew, _ := store.GetAccount(accTo.AccountID)
+		accFromNew, _ := store.GetAccount(ctx, accFrom.AccountID)
+		accToNew, _ := store.GetAccount(ctx, accTo.AccountID)
 		if accFromNew.Balance >= accFromInitBalance &&
 			accToNew.Balance <= accToInitBalance &&
 			accFromNew.Balance >= accToNew.Balance {
@@ -149,12 +650,12 @@ func TestAPIServer(t *testing.T) {
 	t.Run("GetTransactions", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		var accFromInitBalance int64 = 10000
-		accFrom, err := store.InsertAccount(accFromInitBalance)
+		accFrom, err := store.InsertAccount(ctx, accFromInitBalance)
 		if err != nil {
 			t.Fatal(err)
 		}
 		var accToInitBalance int64 = 0
-		accTo, err := store.InsertAccount(accToInitBalance)
+		accTo, err := store.InsertAccount(ctx, accToInitBalance)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -162,6 +663,7 @@ func TestAPIServer(t *testing.T) {
 		nTransfers := 5
 		for i := 0; i < nTransfers; i++ {
 			store.TransferMoney(
+				ctx,
 				accTo.AccountID,
 				accFrom.AccountID,
 				transferMoneyAmount,
@@ -191,4 +693,618 @@ func TestAPIServer(t *testing.T) {
 			t.Error(wrongAnswerErr)
 		}
 	})
+	t.Run("RegisterWebhook", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b, err := json.Marshal(WebhookJsonView{URL: "http://localhost:9000/hook"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewBuffer(b))
+		s.handleWebhooks().ServeHTTP(rec, req)
+		if rec.Code > 204 {
+			t.Error(badStatusCodeErr)
+		}
+		hook := WebhookJsonView{}
+		if err := json.NewDecoder(rec.Body).Decode(&hook); err != nil {
+			t.Error(err)
+		}
+		if hook.WebhookID == 0 || len(hook.Secret) == 0 {
+			t.Error(wrongAnswerErr)
+		}
+
+		rec = httptest.NewRecorder()
+		b, _ = json.Marshal(WebhookJsonView{URL: "not-a-url"})
+		req, _ = http.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewBuffer(b))
+		s.handleWebhooks().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Error(badStatusCodeErr)
+		}
+
+		for _, code := range []int{http.StatusNoContent, http.StatusNotFound} {
+			rec = httptest.NewRecorder()
+			req, _ = http.NewRequest(http.MethodDelete, "/api/v1/webhooks", nil)
+			addQueryParams(req, map[string]string{"webhook_id": fmt.Sprintf("%v", hook.WebhookID)})
+			s.handleWebhooks().ServeHTTP(rec, req)
+			if rec.Code != code {
+				t.Errorf("expected %v, got %v", code, rec.Code)
+			}
+		}
+	})
+	t.Run("Backup", func(t *testing.T) {
+		backupDir, err := ioutil.TempDir("", "backups")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(backupDir)
+		s.config.BackupDir = backupDir
+
+		rec := httptest.NewRecorder()
+		b, _ := json.Marshal(BackupJsonView{Name: "test.db"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/admin/backup", bytes.NewBuffer(b))
+		s.handleBackup().ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatal(badStatusCodeErr)
+		}
+		backup := BackupJsonView{}
+		if err := json.NewDecoder(rec.Body).Decode(&backup); err != nil {
+			t.Fatal(err)
+		}
+		if backup.Path != filepath.Join(backupDir, "test.db") || backup.SchemaVersion != sqlstore.LatestSchemaVersion() {
+			t.Error(wrongAnswerErr)
+		}
+
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodPost, "/api/v1/admin/backup", http.NoBody)
+		s.handleBackup().ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Error(badStatusCodeErr)
+		}
+
+		for _, name := range []string{"../escape.db", "test.db"} {
+			rec = httptest.NewRecorder()
+			b, _ = json.Marshal(BackupJsonView{Name: name})
+			req, _ = http.NewRequest(http.MethodPost, "/api/v1/admin/backup", bytes.NewBuffer(b))
+			s.handleBackup().ServeHTTP(rec, req)
+			if rec.Code < 400 {
+				t.Error(badStatusCodeErr)
+			}
+		}
+	})
+	t.Run("AccountEvents", func(t *testing.T) {
+		srv := httptest.NewServer(s.router)
+		defer srv.Close()
+
+		accFrom, err := store.InsertAccount(ctx, 10000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(fmt.Sprintf("%s/api/v1/accounts/%v/events", srv.URL, accTo.AccountID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(badStatusCodeErr)
+		}
+		reader := bufio.NewReader(resp.Body)
+		readEvent := func() AccountEventJsonView {
+			event := AccountEventJsonView{}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(line, "data: ") {
+					if err := json.Unmarshal([]byte(line[len("data: "):]), &event); err != nil {
+						t.Fatal(err)
+					}
+					return event
+				}
+			}
+		}
+		if event := readEvent(); event.Balance != 0 || event.AccountID != accTo.AccountID {
+			t.Error(wrongAnswerErr)
+		}
+
+		if err := store.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 300); err != nil {
+			t.Fatal(err)
+		}
+		event := readEvent()
+		if event.Transaction == nil || event.Transaction.Amount != 300 {
+			t.Error(wrongAnswerErr)
+		}
+		if event := readEvent(); event.Balance != 300 {
+			t.Error(wrongAnswerErr)
+		}
+
+		resp, err = http.Get(fmt.Sprintf("%s/api/v1/accounts/%v/events", srv.URL, 100500))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error(badStatusCodeErr)
+		}
+	})
+	t.Run("WebSocket", func(t *testing.T) {
+		srv := httptest.NewServer(s.router)
+		defer srv.Close()
+
+		accFrom, err := store.InsertAccount(ctx, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		err = conn.WriteJSON(WSRequestJsonView{
+			Type:       "subscribe",
+			ID:         "sub-1",
+			AccountIDs: []int64{accTo.AccountID},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := WSResponseJsonView{}
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "ack" || msg.ID != "sub-1" {
+			t.Fatal(wrongAnswerErr)
+		}
+
+		err = conn.WriteJSON(WSRequestJsonView{
+			Type: "transfer",
+			ID:   "tr-1",
+			Transfer: &TransactionJsonView{
+				FromAccountID: accFrom.AccountID,
+				ToAccountID:   accTo.AccountID,
+				Amount:        400,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotAck, gotResult, gotEvent bool
+		for !(gotAck && gotResult && gotEvent) {
+			msg := WSResponseJsonView{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			switch msg.Type {
+			case "ack":
+				gotAck = msg.ID == "tr-1"
+			case "result":
+				gotResult = msg.ID == "tr-1" && msg.Status == "completed"
+			case "event":
+				if msg.Event.Type == "balance.changed" && msg.Event.Balance == 400 {
+					gotEvent = true
+				}
+			}
+		}
+
+		err = conn.WriteJSON(WSRequestJsonView{
+			Type: "transfer",
+			ID:   "tr-2",
+			Transfer: &TransactionJsonView{
+				FromAccountID: accFrom.AccountID,
+				ToAccountID:   accTo.AccountID,
+				Amount:        -1,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg = WSResponseJsonView{}
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "error" || msg.ID != "tr-2" {
+			t.Error(wrongAnswerErr)
+		}
+	})
+	t.Run("GRPC", func(t *testing.T) {
+		lis := bufconn.Listen(1024 * 1024)
+		srv := s.newGRPCServer()
+		go srv.Serve(lis)
+		defer srv.Stop()
+
+		conn, err := grpc.Dial(
+			"bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.Dial()
+			}),
+			grpc.WithInsecure(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ctx := context.Background()
+		accounts := grpcapi.NewAccountsClient(conn)
+		transfers := grpcapi.NewTransfersClient(conn)
+		history := grpcapi.NewTransactionsClient(conn)
+
+		accFrom, err := accounts.CreateAccount(ctx, &grpcapi.CreateAccountRequest{Balance: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := accounts.CreateAccount(ctx, &grpcapi.CreateAccountRequest{Balance: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err = transfers.TransferMoney(ctx, &grpcapi.TransferRequest{
+				FromAccountId: accFrom.AccountId,
+				ToAccountId:   accTo.AccountId,
+				Amount:        100,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = transfers.TransferMoney(ctx, &grpcapi.TransferRequest{
+			FromAccountId: accFrom.AccountId,
+			ToAccountId:   accFrom.AccountId,
+			Amount:        100,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Error(wrongAnswerErr)
+		}
+
+		acc, err := accounts.GetAccount(ctx, &grpcapi.AccountID{AccountId: accTo.AccountId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc.Balance != 300 || acc.CreatedAt == nil {
+			t.Error(wrongAnswerErr)
+		}
+
+		stream, err := history.GetTransactionsHistory(ctx, &grpcapi.TransactionsHistoryRequest{
+			AccountId: accTo.AccountId,
+			NLastDays: 1,
+			Limit:     10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for {
+			tr, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tr.Amount != 100 || tr.ToAccountId != accTo.AccountId {
+				t.Error(wrongAnswerErr)
+			}
+			n++
+		}
+		if n != 3 {
+			t.Error(wrongAnswerErr)
+		}
+
+		if _, err := accounts.DeleteAccount(ctx, &grpcapi.AccountID{AccountId: accTo.AccountId}); err != nil {
+			t.Error(err)
+		}
+		if _, err := accounts.GetAccount(ctx, &grpcapi.AccountID{AccountId: accTo.AccountId}); status.Code(err) != codes.NotFound {
+			t.Errorf("expected %v for the removed account, got %v", codes.NotFound, err)
+		}
+		if _, err := accounts.DeleteAccount(ctx, &grpcapi.AccountID{AccountId: accTo.AccountId}); status.Code(err) != codes.NotFound {
+			t.Errorf("expected %v for the removed account, got %v", codes.NotFound, err)
+		}
+	})
+}
+
+func TestOpenStore(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Memory", func(t *testing.T) {
+		config := NewConfig()
+		config.StoreDriver = "memory"
+		store, err := openStore(config, NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		s := New(config)
+		s.setStore(store)
+		rec := httptest.NewRecorder()
+		b, _ := json.Marshal(AccountJsonView{Balance: 100})
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/accounts", bytes.NewBuffer(b))
+		s.handleAccounts().ServeHTTP(rec, req)
+		if rec.Code > 204 {
+			t.Error(badStatusCodeErr)
+		}
+		accId := AccountIDJsonView{}
+		if err := json.NewDecoder(rec.Body).Decode(&accId); err != nil {
+			t.Fatal(err)
+		}
+		acc, err := store.GetAccount(ctx, accId.ID)
+		if err != nil || acc.Balance != 100 {
+			t.Error(wrongAnswerErr)
+		}
+	})
+
+	t.Run("EventSourced", func(t *testing.T) {
+		config := NewConfig()
+		config.StoreDriver = "eventsourced"
+		store, err := openStore(config, NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil || acc.Balance != 100 {
+			t.Error(wrongAnswerErr)
+		}
+	})
+
+	t.Run("Sharded", func(t *testing.T) {
+		config := NewConfig()
+		config.StoreDriver = "sharded"
+		config.Sharded.CoordinatorPath = "/tmp/tets_coordinator.db"
+		config.Sharded.Shards = []string{"/tmp/tets_shard_0.db", "/tmp/tets_shard_1.db"}
+		defer os.RemoveAll(config.Sharded.CoordinatorPath)
+		for _, path := range config.Sharded.Shards {
+			defer os.RemoveAll(path + ".lock")
+			defer os.RemoveAll(path)
+		}
+		store, err := openStore(config, NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		acc1, _ := store.InsertAccount(ctx, 100)
+		acc2, _ := store.InsertAccount(ctx, 0)
+		if err := store.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 100); err != nil {
+			t.Fatal(err)
+		}
+		acc, err := store.GetAccount(ctx, acc2.AccountID)
+		if err != nil || acc.Balance != 100 {
+			t.Error(wrongAnswerErr)
+		}
+	})
+
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		config := NewConfig()
+		config.SQLite.DbPath = "/tmp/tets_ryw.db"
+		config.SQLite.ReplicaPath = "/tmp/tets_ryw_replica.db"
+		// NOTE: replica never catches up during the test
+		config.SQLite.ReplicaInterval = 60000
+		defer os.RemoveAll(config.SQLite.DbPath + ".lock")
+		defer os.RemoveAll(config.SQLite.DbPath)
+		defer os.RemoveAll(config.SQLite.ReplicaPath)
+		store, err := openStore(config, NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		s := New(config)
+		s.setStore(store)
+		acc, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, consistency := range []string{"", "strong"} {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/v1/accounts", nil)
+			addQueryParams(req, map[string]string{
+				"account_id":  fmt.Sprint(acc.AccountID),
+				"consistency": consistency,
+			})
+			s.handleAccounts().ServeHTTP(rec, req)
+			if consistency == "strong" && rec.Code != http.StatusOK {
+				t.Error(badStatusCodeErr)
+			}
+			if consistency == "" && rec.Code == http.StatusOK {
+				t.Error("expected replica not to have the account yet")
+			}
+		}
+	})
+
+	t.Run("UnknownDriver", func(t *testing.T) {
+		config := NewConfig()
+		config.StoreDriver = "mongo"
+		if _, err := openStore(config, NewLogger()); !errors.Is(err, unknownStoreDriverErr) {
+			t.Error(wrongAnswerErr)
+		}
+	})
+
+	t.Run("ConfigFile", func(t *testing.T) {
+		config, err := LoadConfig("../../../configs/apiserver.toml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.StoreDriver != "sqlite" || config.SQLite.DbPath == "" || config.Postgres.DSN == "" {
+			t.Error(wrongAnswerErr)
+		}
+		if len(config.deprecatedKeys()) != 0 {
+			t.Errorf("expected shipped config not to use deprecated keys, got %v", config.deprecatedKeys())
+		}
+		if config.Auth.Enabled != NewConfig().Auth.Enabled {
+			t.Error("expected shipped config to keep the default of auth")
+		}
+	})
+
+	t.Run("LegacyConfigKeys", func(t *testing.T) {
+		load := func(content string) (*Config, error) {
+			f, err := ioutil.TempFile("", "apiserver*.toml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(content)
+			f.Close()
+			return LoadConfig(f.Name())
+		}
+		config, err := load("db_path = \"/tmp/legacy.db\"\npostgres_dsn = \"postgres://legacy\"\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.SQLite.DbPath != "/tmp/legacy.db" || config.Postgres.DSN != "postgres://legacy" || len(config.deprecatedKeys()) != 2 {
+			t.Errorf("expected legacy keys to be applied, got %+v", config)
+		}
+		if _, err := load("db_path = \"/tmp/a.db\"\n[sqlite]\ndb_path = \"/tmp/b.db\"\n"); !errors.Is(err, legacyKeyConflictErr) {
+			t.Errorf("expected conflicting keys to be rejected, got %v", err)
+		}
+		if _, err := load("[memory]\nsnapshot_interval = 300\n"); !errors.Is(err, unknownConfigKeysErr) || !strings.Contains(err.Error(), "memory.snapshot_interval") {
+			t.Errorf("expected unknown key to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestCLIAudit(t *testing.T) {
+	dbPath := "/tmp/tets_cli.db"
+	backupPath := "/tmp/tets_cli_backup.db"
+	defer os.RemoveAll(dbPath + ".lock")
+	defer os.RemoveAll(dbPath)
+	defer os.RemoveAll(backupPath)
+
+	s, err := sqlstore.New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	config := NewConfig()
+	config.SQLite.DbPath = dbPath
+
+	auditLog := func(action string) []models.AuditEntry {
+		s, err := sqlstore.Open(dbPath, 10, sqlstore.DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		entries, err := s.GetAuditLog(context.Background(), sqlstore.AuditFilter{Action: action, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	var out bytes.Buffer
+	if err := Migrate(config, []string{"down"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(config, []string{"up"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	entries := auditLog(models.AuditSchemaMigrated)
+	if len(entries) != 2 || entries[1].Actor != cliActor || !strings.Contains(string(entries[1].After), fmt.Sprintf(`"schema_version":%d`, sqlstore.LatestSchemaVersion())) {
+		t.Errorf("expected both migrations to be recorded, got %+v", entries)
+	}
+	if err := Migrate(config, []string{"to", "0"}, &out); err == nil {
+		t.Error("expected the audit log with entries not to be dropped")
+	}
+
+	if err := Backup(config, []string{backupPath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(config, []string{backupPath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	entries = auditLog(models.AuditDBRestored)
+	if len(entries) != 1 || entries[0].Resource != "db:"+dbPath || !strings.Contains(string(entries[0].After), backupPath) {
+		t.Errorf("expected the restore to be recorded, got %+v", entries)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Run("StopOrder", func(t *testing.T) {
+		var stopped []string
+		lc := newLifecycle(NewLogger())
+		for _, name := range []string{"store", "workers", "server"} {
+			name := name
+			lc.add(name, func() { stopped = append(stopped, name) })
+		}
+		lc.stop()
+		if strings.Join(stopped, ",") != "server,workers,store" {
+			t.Errorf("expected components to be stopped in the reverse order, got %v", stopped)
+		}
+	})
+
+	t.Run("GracefulShutdown", func(t *testing.T) {
+		config := NewConfig()
+		config.StoreDriver = "memory"
+		config.GRPCBindAddr = ""
+		config.Server.DrainDelay = 300
+		config.Server.ShutdownTimeout = 5000
+		s := New(config)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := "http://" + lis.Addr().String()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		served := make(chan error, 1)
+		go func() {
+			served <- s.serve(ctx, lis)
+		}()
+
+		readyStatus := func() int {
+			resp, err := http.Get(url + "/readyz")
+			if err != nil {
+				return 0
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		for i := 0; readyStatus() != http.StatusOK; i++ {
+			if i == 100 {
+				t.Fatal("server is not ready")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		resp, err := http.Post(url+"/api/v1/accounts", "application/json", strings.NewReader(`{"balance":100}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		accId := AccountIDJsonView{}
+		json.NewDecoder(resp.Body).Decode(&accId)
+		resp.Body.Close()
+		events, err := http.Get(fmt.Sprintf("%s/api/v1/accounts/%v/events", url, accId.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer events.Body.Close()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/api/v1/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		if code := readyStatus(); code != http.StatusServiceUnavailable {
+			t.Errorf("expected server not to be ready during the drain, got %v", code)
+		}
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server is not drained")
+		}
+		if _, err := ioutil.ReadAll(events.Body); err != nil {
+			t.Errorf("expected event stream to be finished, got %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("expected websocket session to be closed, got %v", err)
+		}
+		if readyStatus() != 0 {
+			t.Error("expected listener to be closed")
+		}
+	})
 }
@@ -0,0 +1,227 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// anonymousActor is recorded while requests are not authenticated, otherwise it's the id of the api key
+const anonymousActor = "anonymous"
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var (
+	auditNotSupportedErr = errors.New("Audit log is supported only by the sqlite store")
+	auditNotRecordedErr  = errors.New("Change is applied, but its audit entry is not recorded")
+)
+
+// auditor is implemented by stores which keep the audit log; the store records its own changes
+// within their transactions, other changes are appended by the server
+type auditor interface {
+	AppendAudit(ctx context.Context, action, resource string, before, after interface{}) error
+	GetAuditLog(ctx context.Context, filter sqlstore.AuditFilter) ([]models.AuditEntry, error)
+	VerifyAuditLog(ctx context.Context) (sqlstore.AuditVerification, error)
+}
+
+// withAuditInfo attaches info to the context if the store keeps the audit log
+func (s *APIServer) withAuditInfo(ctx context.Context, info store.AuditInfo) context.Context {
+	if _, ok := s.backend.(auditor); !ok {
+		return ctx
+	}
+	return store.WithAuditInfo(ctx, info)
+}
+
+// auditInfo describes who makes the request
+func auditInfo(ctx context.Context, remoteAddr string) store.AuditInfo {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	actor := anonymousActor
+	if key, ok := apiKeyFrom(ctx); ok {
+		actor = key.KeyID
+	}
+	return store.AuditInfo{
+		Actor:     actor,
+		SourceIP:  host,
+		RequestID: requestIDFrom(ctx),
+	}
+}
+
+// withAudit attaches info of the request to its context, so changes made by handlers are recorded
+func (s *APIServer) withAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := s.withAuditInfo(r.Context(), auditInfo(r.Context(), r.RemoteAddr))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// auditInterceptor attaches info of the gRPC call to its context
+func (s *APIServer) auditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	return handler(s.withAuditInfo(ctx, auditInfo(ctx, addr)), req)
+}
+
+// audit records change made outside of the store; the change is already applied,
+// so the failure is only logged
+func (s *APIServer) audit(ctx context.Context, action, resource string, before, after interface{}) {
+	a, ok := s.backend.(auditor)
+	if !ok {
+		return
+	}
+	if _, ok := store.AuditInfoFrom(ctx); !ok {
+		return
+	}
+	if err := a.AppendAudit(ctx, action, resource, before, after); err != nil {
+		s.log(ctx).Error("Audit entry is not recorded", fld("action", action), fld("resource", resource), errField(err))
+	}
+}
+
+// auditRejectedTransfer records transfer which isn't made; the transfer could fail since
+// its context is done, so the entry is appended with the fresh one
+func (s *APIServer) auditRejectedTransfer(ctx context.Context, tr TransactionJsonView, cause error) {
+	a, ok := s.backend.(auditor)
+	if !ok {
+		return
+	}
+	info, ok := store.AuditInfoFrom(ctx)
+	if !ok {
+		return
+	}
+	resource := accountResource(tr.FromAccountID)
+	err := a.AppendAudit(
+		store.WithAuditInfo(context.Background(), info),
+		models.AuditTransferRejected,
+		resource,
+		nil,
+		TransferFailedJsonView{TransactionJsonView: tr, Error: cause.Error()},
+	)
+	if err != nil {
+		s.log(ctx).Error("Audit entry is not recorded", fld("action", models.AuditTransferRejected), fld("resource", resource), errField(err))
+	}
+}
+
+// auditCLI records change made by the cli subcommand, which is already applied
+func auditCLI(s *sqlstore.Store, action, resource string, before, after interface{}) error {
+	ctx := store.WithAuditInfo(context.Background(), store.AuditInfo{Actor: cliActor})
+	if err := s.AppendAudit(ctx, action, resource, before, after); err != nil {
+		return fmt.Errorf("%w: %v", auditNotRecordedErr, err)
+	}
+	return nil
+}
+
+func accountResource(accId int64) string {
+	return "account:" + strconv.FormatInt(accId, 10)
+}
+
+func auditFilter(r *http.Request) (sqlstore.AuditFilter, error) {
+	params := r.URL.Query()
+	filter := sqlstore.AuditFilter{
+		Actor:    params.Get("actor"),
+		Action:   params.Get("action"),
+		Resource: params.Get("resource"),
+		Limit:    defaultAuditLimit,
+	}
+	var err error
+	if v := params.Get("after_id"); v != "" {
+		if filter.AfterID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, err
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, err
+		}
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+	return filter, nil
+}
+
+// handleAudit returns entries of the audit log, oldest first; the log is paged with `after_id`
+// and filtered with `actor`, `action` and `resource` query params
+func (s *APIServer) handleAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			a, ok := s.backend.(auditor)
+			if !ok {
+				s.handleError(auditNotSupportedErr, http.StatusNotImplemented, w, r)
+				return
+			}
+			filter, err := auditFilter(r)
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			entries, err := a.GetAuditLog(r.Context(), filter)
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			views := make([]AuditEntryJsonView, len(entries))
+			for i, e := range entries {
+				views[i] = AuditEntryJsonView{
+					AuditID:   e.AuditID,
+					CreatedAt: e.CreatedAt,
+					Actor:     e.Actor,
+					SourceIP:  e.SourceIP,
+					RequestID: e.RequestID,
+					Action:    e.Action,
+					Resource:  e.Resource,
+					Before:    e.Before,
+					After:     e.After,
+					PrevHash:  e.PrevHash,
+					Hash:      e.Hash,
+				}
+			}
+			w.Header().Set("Content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(views)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
+
+// VerifyAudit runs `audit-verify` subcommand: checks the hash chain of the whole audit log
+// and prints the last hash, so it could be recorded and compared by the next run
+func VerifyAudit(config *Config, args []string, out io.Writer) error {
+	if config.StoreDriver != "sqlite" {
+		return auditNotSupportedErr
+	}
+	s, err := sqlstore.Open(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	res, err := s.VerifyAuditLog(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "audit log is intact: %d entries, last id: %d, last hash: %s\n", res.Entries, res.LastID, res.LastHash)
+	return nil
+}
@@ -0,0 +1,511 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Api key is passed as `Authorization: Bearer <key>`, the key is `mt_<key id>.<secret>`;
+// key id is public and used to look the key up, only sha-256 of the secret is stored
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+	apiKeyIDPrefix      = "mt_"
+)
+
+// cliActor is recorded in the audit log for changes made by the cli subcommands
+const cliActor = "cli"
+
+var (
+	authNotSupportedErr  = errors.New("API keys are supported only by the sqlite store")
+	authRequiredErr      = errors.New("API key is required")
+	invalidAPIKeyErr     = errors.New("API key is invalid or revoked")
+	insufficientScopeErr = errors.New("API key doesn't have the scope required by the endpoint")
+	unknownScopeErr      = errors.New("Unknown scope, expected one of: accounts:read, accounts:write, transfers:create, admin")
+	scopesRequiredErr    = errors.New("At least one scope is required")
+	unknownAPIKeyCmdErr  = errors.New("Unknown apikey command, expected one of: issue <name> <scope,...>, list, rotate <key id>, revoke <key id>")
+)
+
+var knownScopes = map[string]bool{
+	models.ScopeAccountsRead:    true,
+	models.ScopeAccountsWrite:   true,
+	models.ScopeTransfersCreate: true,
+	models.ScopeAdmin:           true,
+}
+
+// grpcScopes holds scopes required by the gRPC methods; unknown methods require admin
+var grpcScopes = map[string]string{
+	"/transfers.v1.Accounts/CreateAccount":              models.ScopeAccountsWrite,
+	"/transfers.v1.Accounts/GetAccount":                 models.ScopeAccountsRead,
+	"/transfers.v1.Accounts/DeleteAccount":              models.ScopeAccountsWrite,
+	"/transfers.v1.Transfers/TransferMoney":             models.ScopeTransfersCreate,
+	"/transfers.v1.Transactions/GetTransactionsHistory": models.ScopeAccountsRead,
+}
+
+// keyStore is implemented by stores which keep the api keys
+type keyStore interface {
+	InsertAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error)
+	GetAPIKey(ctx context.Context, keyId string) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	RotateAPIKey(ctx context.Context, keyId, secretHash string) (models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyId string) error
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSecret() (string, error) {
+	return randomHex(32)
+}
+
+func formatAPIKey(keyId, secret string) string {
+	return keyId + "." + secret
+}
+
+func parseAPIKey(key string) (keyId, secret string, ok bool) {
+	i := strings.IndexByte(key, '.')
+	if i < 0 || !strings.HasPrefix(key, apiKeyIDPrefix) {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// normalizeScopes sorts scopes and drops duplicates, unknown scope is rejected
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, scopesRequiredErr
+	}
+	set := make(map[string]bool, len(scopes))
+	res := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !knownScopes[scope] {
+			return nil, fmt.Errorf("%w: %q", unknownScopeErr, scope)
+		}
+		if !set[scope] {
+			set[scope] = true
+			res = append(res, scope)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// hasScope reports whether the key grants the scope, admin grants all of them
+func hasScope(key models.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope || s == models.ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// issueAPIKey generates the key and stores it, the returned key is the only copy of the secret
+func issueAPIKey(ctx context.Context, ks keyStore, name string, scopes []string) (models.APIKey, string, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	key, err := ks.InsertAPIKey(ctx, models.APIKey{
+		KeyID:      apiKeyIDPrefix + id,
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: hashSecret(secret),
+	})
+	if err != nil {
+		return key, "", err
+	}
+	return key, formatAPIKey(key.KeyID, secret), nil
+}
+
+// rotateAPIKey replaces the secret of the key, the returned key is the only copy of the new secret
+func rotateAPIKey(ctx context.Context, ks keyStore, keyId string) (models.APIKey, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	key, err := ks.RotateAPIKey(ctx, keyId, hashSecret(secret))
+	if err != nil {
+		return key, "", err
+	}
+	return key, formatAPIKey(key.KeyID, secret), nil
+}
+
+// authenticate returns the active key matching the passed one
+func (s *APIServer) authenticate(ctx context.Context, apiKey string) (models.APIKey, error) {
+	ks, ok := s.backend.(keyStore)
+	if !ok {
+		return models.APIKey{}, authNotSupportedErr
+	}
+	keyId, secret, ok := parseAPIKey(apiKey)
+	if !ok {
+		return models.APIKey{}, invalidAPIKeyErr
+	}
+	key, err := ks.GetAPIKey(ctx, keyId)
+	if errors.Is(err, store.APIKeyNotFoundErr) {
+		return key, invalidAPIKeyErr
+	}
+	if err != nil {
+		return key, err
+	}
+	if key.RevokedAt != nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 {
+		return key, invalidAPIKeyErr
+	}
+	return key, nil
+}
+
+type apiKeyKey struct{}
+
+func contextWithAPIKey(ctx context.Context, key models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey{}, key)
+}
+
+// apiKeyFrom returns the key the request is authenticated with
+func apiKeyFrom(ctx context.Context) (models.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey{}).(models.APIKey)
+	return key, ok
+}
+
+// authorized reports whether the request may use the scope; everything is allowed while auth is disabled
+func (s *APIServer) authorized(ctx context.Context, scope string) bool {
+	if !s.config.Auth.Enabled {
+		return true
+	}
+	key, ok := apiKeyFrom(ctx)
+	return ok && hasScope(key, scope)
+}
+
+// reauthorize checks the key of the long-lived session against the key store, so the key
+// revoked or rotated after the session has been opened stops granting the scope
+func (s *APIServer) reauthorize(ctx context.Context, scope string) error {
+	if !s.config.Auth.Enabled {
+		return nil
+	}
+	key, ok := apiKeyFrom(ctx)
+	if !ok {
+		return authRequiredErr
+	}
+	ks, ok := s.backend.(keyStore)
+	if !ok {
+		return authNotSupportedErr
+	}
+	current, err := ks.GetAPIKey(ctx, key.KeyID)
+	if errors.Is(err, store.APIKeyNotFoundErr) {
+		return invalidAPIKeyErr
+	}
+	if err != nil {
+		return err
+	}
+	if current.RevokedAt != nil || current.SecretHash != key.SecretHash {
+		return invalidAPIKeyErr
+	}
+	if !hasScope(current, scope) {
+		return insufficientScopeErr
+	}
+	return nil
+}
+
+func (s *APIServer) unauthorized(err error, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="money-transfers-api"`)
+	s.handleError(err, http.StatusUnauthorized, w, r)
+}
+
+// withAuth authenticates the request holding the api key; requests without the key
+// are passed through, so the endpoints which require it reject them
+func (s *APIServer) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(authorizationHeader)
+		if !s.config.Auth.Enabled || header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(header, bearerPrefix) {
+			s.unauthorized(invalidAPIKeyErr, w, r)
+			return
+		}
+		key, err := s.authenticate(r.Context(), strings.TrimSpace(header[len(bearerPrefix):]))
+		if errors.Is(err, invalidAPIKeyErr) {
+			s.unauthorized(err, w, r)
+			return
+		}
+		if err != nil {
+			s.handleError(err, storeErrorStatus(err), w, r)
+			return
+		}
+		annotate(r.Context(), fld("key_id", key.KeyID))
+		next.ServeHTTP(w, r.WithContext(contextWithAPIKey(r.Context(), key)))
+	})
+}
+
+// require rejects requests whose key doesn't have the scope: read scope is checked
+// for GET requests and write scope for the rest of them
+func (s *APIServer) require(read, write string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := write
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = read
+		}
+		if s.authorized(r.Context(), scope) {
+			next(w, r)
+			return
+		}
+		if _, ok := apiKeyFrom(r.Context()); !ok {
+			s.unauthorized(authRequiredErr, w, r)
+			return
+		}
+		s.handleError(fmt.Errorf("%w: %s", insufficientScopeErr, scope), http.StatusForbidden, w, r)
+	}
+}
+
+// requireScope rejects requests whose key doesn't have the scope, whatever the method is
+func (s *APIServer) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return s.require(scope, scope, next)
+}
+
+// authorizeGRPC authenticates the call with the key from the `authorization` metadata
+// and checks the scope of the method
+func (s *APIServer) authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	if !s.config.Auth.Enabled {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(strings.ToLower(authorizationHeader))
+	if len(values) == 0 {
+		return ctx, status.Error(codes.Unauthenticated, authRequiredErr.Error())
+	}
+	if !strings.HasPrefix(values[0], bearerPrefix) {
+		return ctx, status.Error(codes.Unauthenticated, invalidAPIKeyErr.Error())
+	}
+	key, err := s.authenticate(ctx, strings.TrimSpace(values[0][len(bearerPrefix):]))
+	if errors.Is(err, invalidAPIKeyErr) {
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return ctx, status.Error(codes.Unavailable, err.Error())
+	}
+	scope, ok := grpcScopes[method]
+	if !ok {
+		scope = models.ScopeAdmin
+	}
+	if !hasScope(key, scope) {
+		return ctx, status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %s", insufficientScopeErr, scope))
+	}
+	return contextWithAPIKey(ctx, key), nil
+}
+
+// unaryInterceptor authorizes the gRPC call and attaches its audit info
+func (s *APIServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authorizeGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return s.auditInterceptor(ctx, req, info, handler)
+}
+
+// streamInterceptor authorizes the streaming gRPC call, streams only read the store
+func (s *APIServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := s.authorizeGRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func apiKeyView(key models.APIKey) APIKeyJsonView {
+	return APIKeyJsonView{
+		KeyID:     key.KeyID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		RotatedAt: key.RotatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+func (s *APIServer) apiKeys(w http.ResponseWriter, r *http.Request) (keyStore, bool) {
+	ks, ok := s.backend.(keyStore)
+	if !ok {
+		s.handleError(authNotSupportedErr, http.StatusNotImplemented, w, r)
+	}
+	return ks, ok
+}
+
+func apiKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.APIKeyNotFoundErr):
+		return http.StatusNotFound
+	case errors.Is(err, unknownScopeErr) || errors.Is(err, scopesRequiredErr):
+		return http.StatusBadRequest
+	}
+	return storeErrorStatus(err)
+}
+
+// handleAPIKeys issues, lists and revokes api keys; the key itself is returned only once, when it's issued
+func (s *APIServer) handleAPIKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ks, ok := s.apiKeys(w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case "POST":
+			var req APIKeyJsonView
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			key, apiKey, err := issueAPIKey(r.Context(), ks, req.Name, req.Scopes)
+			if err != nil {
+				s.handleError(err, apiKeyErrorStatus(err), w, r)
+				return
+			}
+			annotate(r.Context(), fld("issued_key_id", key.KeyID))
+			view := apiKeyView(key)
+			view.Key = apiKey
+			w.Header().Set("Content-type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(view)
+		case "GET":
+			keys, err := ks.ListAPIKeys(r.Context())
+			if err != nil {
+				s.handleError(err, storeErrorStatus(err), w, r)
+				return
+			}
+			views := make([]APIKeyJsonView, len(keys))
+			for i, key := range keys {
+				views[i] = apiKeyView(key)
+			}
+			w.Header().Set("Content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(views)
+		case "DELETE":
+			keyId := r.URL.Query().Get("key_id")
+			annotate(r.Context(), fld("revoked_key_id", keyId))
+			if err := ks.RevokeAPIKey(r.Context(), keyId); err != nil {
+				s.handleError(err, apiKeyErrorStatus(err), w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
+
+// handleAPIKeyRotate replaces the secret of the key, its id and scopes are kept
+func (s *APIServer) handleAPIKeyRotate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ks, ok := s.apiKeys(w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case "POST":
+			keyId := r.URL.Query().Get("key_id")
+			annotate(r.Context(), fld("rotated_key_id", keyId))
+			key, apiKey, err := rotateAPIKey(r.Context(), ks, keyId)
+			if err != nil {
+				s.handleError(err, apiKeyErrorStatus(err), w, r)
+				return
+			}
+			view := apiKeyView(key)
+			view.Key = apiKey
+			w.Header().Set("Content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(view)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
+
+// APIKey runs `apikey` subcommand against the configured sqlite store: `issue <name> <scope,...>`
+// prints the new key, so the first admin key is issued this way; `list` prints the keys,
+// `rotate <key id>` prints the new key and `revoke <key id>` disables the key
+func APIKey(config *Config, args []string, out io.Writer) error {
+	if config.StoreDriver != "sqlite" {
+		return authNotSupportedErr
+	}
+	if len(args) == 0 {
+		return unknownAPIKeyCmdErr
+	}
+	// NOTE: pending migrations are applied, so the first key is issued before the server is ever started
+	s, err := sqlstore.NewWithOptions(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := store.WithAuditInfo(context.Background(), store.AuditInfo{Actor: cliActor})
+	switch {
+	case args[0] == "issue" && len(args) == 3:
+		key, apiKey, err := issueAPIKey(ctx, s, args[1], strings.Split(args[2], ","))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %s issued with scopes %s:\n%s\n", key.KeyID, strings.Join(key.Scopes, ","), apiKey)
+	case args[0] == "list" && len(args) == 1:
+		keys, err := s.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			state := "active"
+			if key.RevokedAt != nil {
+				state = "revoked"
+			}
+			fmt.Fprintf(out, "%s  %-8s %-20s %s\n", key.KeyID, state, key.Name, strings.Join(key.Scopes, ","))
+		}
+	case args[0] == "rotate" && len(args) == 2:
+		key, apiKey, err := rotateAPIKey(ctx, s, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %s rotated:\n%s\n", key.KeyID, apiKey)
+	case args[0] == "revoke" && len(args) == 2:
+		if err := s.RevokeAPIKey(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %s revoked\n", args[1])
+	default:
+		return unknownAPIKeyCmdErr
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+var (
+	backupNotSupportedErr = errors.New("Backups are supported only by the sqlite store")
+	invalidBackupNameErr  = errors.New("Backup name must be a plain file name")
+	backupPathRequiredErr = errors.New("Backup path is required")
+)
+
+// backuper is implemented by stores which can write online backup
+type backuper interface {
+	Backup(path string) error
+}
+
+// backupPath resolves backup name inside the configured backup dir;
+// name is generated from the current time if it's empty
+func (s *APIServer) backupPath(name string) (string, error) {
+	if name == "" {
+		name = fmt.Sprintf("backup-%s.db", time.Now().UTC().Format("20060102T150405.000"))
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", invalidBackupNameErr
+	}
+	return filepath.Join(s.config.BackupDir, name), nil
+}
+
+func (s *APIServer) handleBackup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			b, ok := s.backend.(backuper)
+			if !ok {
+				s.handleError(backupNotSupportedErr, http.StatusNotImplemented, w, r)
+				return
+			}
+			var req BackupJsonView
+			// NOTE: empty body means the default backup name
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			path, err := s.backupPath(req.Name)
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			if err := b.Backup(path); err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			version, err := sqlstore.ValidateBackup(path)
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			view := BackupJsonView{
+				Name:          filepath.Base(path),
+				Path:          path,
+				CreatedAt:     time.Now(),
+				SchemaVersion: version,
+			}
+			s.audit(r.Context(), models.AuditBackupCreated, "backup:"+view.Name, nil, view)
+			w.Header().Set("Content-type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(view)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Backup runs `backup <path>` subcommand: writes online backup of the configured sqlite db,
+// so it can be run while the server is up
+func Backup(config *Config, args []string, out io.Writer) error {
+	if config.StoreDriver != "sqlite" {
+		return backupNotSupportedErr
+	}
+	if len(args) == 0 {
+		return backupPathRequiredErr
+	}
+	s, err := sqlstore.Open(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Backup(args[0]); err != nil {
+		return err
+	}
+	version, err := sqlstore.ValidateBackup(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "backup written to %s, schema version: %d\n", args[0], version)
+	return nil
+}
+
+// Restore runs `restore <path>` subcommand: validates the backup and swaps it in place of the configured db;
+// the server must be stopped
+func Restore(config *Config, args []string, out io.Writer) error {
+	if config.StoreDriver != "sqlite" {
+		return backupNotSupportedErr
+	}
+	if len(args) == 0 {
+		return backupPathRequiredErr
+	}
+	version, err := sqlstore.Restore(config.SQLite.DbPath, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s restored from %s, schema version: %d\n", config.SQLite.DbPath, args[0], version)
+	// NOTE: the entry goes to the audit log of the restored db, the log of the replaced one is gone with it
+	if version < sqlstore.AuditSchemaVersion {
+		return nil
+	}
+	view := BackupJsonView{Name: filepath.Base(args[0]), Path: args[0], SchemaVersion: version}
+	if info, err := os.Stat(args[0]); err == nil {
+		view.CreatedAt = info.ModTime()
+	}
+	s, err := sqlstore.Open(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	if err != nil {
+		return fmt.Errorf("%w: %v", auditNotRecordedErr, err)
+	}
+	defer s.Close()
+	return auditCLI(s, models.AuditDBRestored, "db:"+config.SQLite.DbPath, nil, view)
+}
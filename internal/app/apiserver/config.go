@@ -1,19 +1,248 @@
 package apiserver
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	unknownConfigKeysErr = errors.New("Unknown config keys")
+	legacyKeyConflictErr = errors.New("Deprecated config key conflicts with its replacement")
+)
+
 // Config holds needed data to run db and api server
 type Config struct {
-	BindAddr     string `toml:"bind_addr"`
-	LogLevel     string `toml:"log_level"`
+	BindAddr          string `toml:"bind_addr"`
+	GRPCBindAddr      string `toml:"grpc_bind_addr"`
+	LogLevel          string `toml:"log_level"`
+	StoreDriver       string `toml:"store_driver"`
+	QueryTimeout      uint32 `toml:"query_timeout"`
+	WebhookMaxRetries uint32 `toml:"webhook_max_retries"`
+	WebhookBackoff    uint32 `toml:"webhook_backoff_ms"`
+	WebhookTimeout    uint32 `toml:"webhook_timeout"`
+	WebhookWorkers    int    `toml:"webhook_workers"`
+	OutboxPublisher   string `toml:"outbox_publisher"`
+	OutboxTarget      string `toml:"outbox_target"`
+	OutboxInterval    uint32 `toml:"outbox_interval_ms"`
+	OutboxBatchSize   int64  `toml:"outbox_batch_size"`
+	BackupDir         string `toml:"backup_dir"`
+
+	// LegacyDbPath is the deprecated top-level key, `db_path` of the `[sqlite]` section replaces it
+	LegacyDbPath string `toml:"db_path"`
+	// LegacyPostgresDSN is the deprecated top-level key, `dsn` of the `[postgres]` section replaces it
+	LegacyPostgresDSN string `toml:"postgres_dsn"`
+
+	Server   ServerConfig   `toml:"server"`
+	Timeouts TimeoutsConfig `toml:"timeouts"`
+	Probes   ProbesConfig   `toml:"probes"`
+	Tracing  TracingConfig  `toml:"tracing"`
+	Auth     AuthConfig     `toml:"auth"`
+
+	SQLite       SQLiteConfig       `toml:"sqlite"`
+	Postgres     PostgresConfig     `toml:"postgres"`
+	Memory       MemoryConfig       `toml:"memory"`
+	EventSourced EventSourcedConfig `toml:"eventsourced"`
+	Sharded      ShardedConfig      `toml:"sharded"`
+}
+
+// ServerConfig holds timeouts of the http server in ms, 0 disables the timeout;
+// read and write timeouts bound the whole request, so they also cut account event streams
+type ServerConfig struct {
+	ReadHeaderTimeout uint32 `toml:"read_header_timeout_ms"`
+	ReadTimeout       uint32 `toml:"read_timeout_ms"`
+	WriteTimeout      uint32 `toml:"write_timeout_ms"`
+	IdleTimeout       uint32 `toml:"idle_timeout_ms"`
+	// DrainDelay is the time the server keeps serving after it's reported not ready on shutdown
+	DrainDelay      uint32 `toml:"drain_delay_ms"`
+	ShutdownTimeout uint32 `toml:"shutdown_timeout_ms"`
+}
+
+// TimeoutsConfig holds deadlines of the api endpoints in ms; the store call is cancelled
+// once the deadline is exceeded or the client has gone, 0 disables the deadline
+type TimeoutsConfig struct {
+	Accounts     uint32 `toml:"accounts_ms"`
+	Transfer     uint32 `toml:"transfer_ms"`
+	Transactions uint32 `toml:"transactions_ms"`
+}
+
+// ProbesConfig holds thresholds of the readiness checks
+type ProbesConfig struct {
+	// Timeout bounds every single check in ms
+	Timeout       uint32 `toml:"timeout_ms"`
+	MinFreeDiskMB uint64 `toml:"min_free_disk_mb"`
+	// MaxReplicaLag is the number of changes the replica may lag behind, 0 disables the limit
+	MaxReplicaLag int64 `toml:"max_replica_lag"`
+}
+
+// TracingConfig holds settings of the span export; Exporter is one of `stdout`, `file`
+// or `otlp` and Endpoint holds the file path or the collector url respectively
+type TracingConfig struct {
+	Exporter    string `toml:"exporter"`
+	Endpoint    string `toml:"endpoint"`
+	ServiceName string `toml:"service_name"`
+	// SampleRatio is the share of the recorded traces started by the server,
+	// traces of the incoming requests follow the sampling decision of the caller
+	SampleRatio   float64 `toml:"sample_ratio"`
+	BatchSize     int     `toml:"batch_size"`
+	FlushInterval uint32  `toml:"flush_interval_ms"`
+}
+
+// AuthConfig enables api keys: every endpoint but the probes and metrics then requires the key
+// having the scope of the endpoint; keys are kept only by the `sqlite` store, it's disabled by default
+type AuthConfig struct {
+	Enabled bool `toml:"enabled"`
+}
+
+// SQLiteConfig holds settings of the `sqlite` store driver
+type SQLiteConfig struct {
 	DbPath       string `toml:"db_path"`
-	QueryTimeout uint32 `toml:"query_timeout"`
+	JournalMode  string `toml:"journal_mode"`
+	Synchronous  string `toml:"synchronous"`
+	BusyTimeout  uint32 `toml:"busy_timeout_ms"`
+	ForeignKeys  bool   `toml:"foreign_keys"`
+	ReadPoolSize int    `toml:"read_pool_size"`
+	// ReplicaPath enables the replica which serves account and history reads
+	ReplicaPath     string `toml:"replica_path"`
+	ReplicaInterval uint32 `toml:"replica_interval_ms"`
+}
+
+// PostgresConfig holds settings of the `postgres` store driver
+type PostgresConfig struct {
+	DSN string `toml:"dsn"`
+}
+
+// MemoryConfig holds settings of the `memory` store driver;
+// state is kept only in memory unless DataDir is set
+type MemoryConfig struct {
+	DataDir          string `toml:"data_dir"`
+	Fsync            string `toml:"fsync"`
+	FsyncInterval    uint32 `toml:"fsync_interval_ms"`
+	SnapshotInterval uint32 `toml:"snapshot_interval_ms"`
+}
+
+// EventSourcedConfig holds settings of the `eventsourced` store driver;
+// event log is kept only in memory unless DataDir is set
+type EventSourcedConfig struct {
+	DataDir       string `toml:"data_dir"`
+	SnapshotEvery int64  `toml:"snapshot_every"`
+}
+
+// ShardedConfig holds settings of the `sharded` store driver; shards are sqlite dbs,
+// tuned by the `sqlite` section, and their number must not change once accounts are created
+type ShardedConfig struct {
+	CoordinatorPath string   `toml:"coordinator_path"`
+	Shards          []string `toml:"shards"`
 }
 
 // NewConfig instantiates the new configuration object
 func NewConfig() *Config {
 	return &Config{
-		BindAddr:     ":8010",
-		LogLevel:     "debug",
-		DbPath:       "/tmp/sqlite.db",
-		QueryTimeout: 10,
+		BindAddr:          ":8010",
+		GRPCBindAddr:      ":8011",
+		LogLevel:          "debug",
+		StoreDriver:       "sqlite",
+		QueryTimeout:      10,
+		WebhookMaxRetries: 5,
+		WebhookBackoff:    500,
+		WebhookTimeout:    10,
+		WebhookWorkers:    4,
+		OutboxInterval:    1000,
+		OutboxBatchSize:   100,
+		BackupDir:         "/tmp/backups",
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5000,
+			IdleTimeout:       120000,
+			ShutdownTimeout:   30000,
+		},
+		Timeouts: TimeoutsConfig{
+			Accounts:     5000,
+			Transfer:     10000,
+			Transactions: 30000,
+		},
+		Probes: ProbesConfig{
+			Timeout:       1000,
+			MinFreeDiskMB: 100,
+			MaxReplicaLag: 1000,
+		},
+		Tracing: TracingConfig{
+			ServiceName:   "money-transfers-api",
+			SampleRatio:   1,
+			BatchSize:     512,
+			FlushInterval: 5000,
+		},
+		SQLite: SQLiteConfig{
+			DbPath:          "/tmp/sqlite.db",
+			JournalMode:     "WAL",
+			Synchronous:     "NORMAL",
+			BusyTimeout:     5000,
+			ForeignKeys:     true,
+			ReadPoolSize:    4,
+			ReplicaInterval: 100,
+		},
+		Memory: MemoryConfig{
+			Fsync:            "always",
+			FsyncInterval:    100,
+			SnapshotInterval: 300000,
+		},
+		EventSourced: EventSourcedConfig{
+			SnapshotEvery: 1000,
+		},
+		Sharded: ShardedConfig{
+			CoordinatorPath: "/tmp/coordinator.db",
+			Shards:          []string{"/tmp/shard-0.db", "/tmp/shard-1.db"},
+		},
+	}
+}
+
+// LoadConfig reads the config file over the defaults; unknown keys are rejected,
+// since toml skips them and a misspelled or renamed key would silently fall back to the default
+func LoadConfig(path string) (*Config, error) {
+	config := NewConfig()
+	md, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("%w: %s", unknownConfigKeysErr, strings.Join(keys, ", "))
+	}
+	if err := config.applyLegacyKeys(md); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyLegacyKeys moves values of the deprecated keys into the sections which replace them
+func (c *Config) applyLegacyKeys(md toml.MetaData) error {
+	if md.IsDefined("db_path") {
+		if md.IsDefined("sqlite", "db_path") && c.SQLite.DbPath != c.LegacyDbPath {
+			return fmt.Errorf("%w: db_path and sqlite.db_path", legacyKeyConflictErr)
+		}
+		c.SQLite.DbPath = c.LegacyDbPath
+	}
+	if md.IsDefined("postgres_dsn") {
+		if md.IsDefined("postgres", "dsn") && c.Postgres.DSN != c.LegacyPostgresDSN {
+			return fmt.Errorf("%w: postgres_dsn and postgres.dsn", legacyKeyConflictErr)
+		}
+		c.Postgres.DSN = c.LegacyPostgresDSN
+	}
+	return nil
+}
+
+// deprecatedKeys returns the deprecated keys set in the config along with their replacements
+func (c *Config) deprecatedKeys() map[string]string {
+	keys := make(map[string]string)
+	if c.LegacyDbPath != "" {
+		keys["db_path"] = "sqlite.db_path"
+	}
+	if c.LegacyPostgresDSN != "" {
+		keys["postgres_dsn"] = "postgres.dsn"
 	}
+	return keys
 }
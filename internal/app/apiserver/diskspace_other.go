@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package apiserver
+
+// freeDiskSpace is not supported on the platform, so the disk check is skipped
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, diskSpaceUnsupportedErr
+}
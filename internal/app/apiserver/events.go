@@ -0,0 +1,128 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+)
+
+const sseHeartbeatInterval = 15 * time.Second
+
+var (
+	streamingNotSupportedErr = errors.New("Streaming is not supported by the connection")
+)
+
+// parseAccountEventsPath extracts account id from `/api/v1/accounts/{id}/events`
+func parseAccountEventsPath(path string) (int64, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/accounts/"), "/")
+	if len(parts) != 2 || parts[1] != "events" {
+		return 0, false
+	}
+	accId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return accId, true
+}
+
+func accountEventView(event pubsub.Event) AccountEventJsonView {
+	view := AccountEventJsonView{
+		Type:      event.Type,
+		AccountID: event.AccountID,
+		Balance:   event.Balance,
+	}
+	if event.Transaction != nil {
+		view.Transaction = &TransactionJsonView{
+			Timestamp:     event.Transaction.Timestamp,
+			FromAccountID: event.Transaction.FromAccountID,
+			ToAccountID:   event.Transaction.ToAccountID,
+			Amount:        event.Transaction.Amount,
+		}
+	}
+	return view
+}
+
+func writeSSE(w http.ResponseWriter, eventType string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, b)
+	return err
+}
+
+// handleAccountEvents streams account activity as server-sent events;
+// current balance is sent first, then every committed change of the account
+func (s *APIServer) handleAccountEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accId, ok := parseAccountEventsPath(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		annotate(r.Context(), fld("account_id", accId))
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.handleError(streamingNotSupportedErr, http.StatusInternalServerError, w, r)
+			return
+		}
+		// NOTE: subscribe before reading the balance, so no change is missed in between
+		sub := s.broker.Subscribe(accId)
+		defer sub.Unsubscribe()
+		accModel, err := s.store.GetAccount(r.Context(), accId)
+		if err != nil {
+			s.handleError(err, http.StatusNotFound, w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		err = writeSSE(w, pubsub.BalanceChanged, AccountEventJsonView{
+			Type:      pubsub.BalanceChanged,
+			AccountID: accModel.AccountID,
+			Balance:   accModel.Balance,
+		})
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-s.streams.done():
+				// NOTE: http server waits for the handler on shutdown, so the stream ends on drain
+				return
+			case <-heartbeat.C:
+				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+					return
+				}
+			case event := <-sub.C:
+				if err := writeSSE(w, event.Type, accountEventView(event)); err != nil {
+					return
+				}
+				if event.Type == pubsub.AccountClosed {
+					flusher.Flush()
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
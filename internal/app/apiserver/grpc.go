@@ -0,0 +1,163 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/gasparian/money-transfers-api/internal/app/grpcapi"
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/webhooks"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer exposes store operations over gRPC, reusing validation
+// and events emission of the REST handlers
+type grpcServer struct {
+	s *APIServer
+}
+
+func (s *APIServer) newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	)
+	g := &grpcServer{s: s}
+	grpcapi.RegisterAccountsServer(srv, g)
+	grpcapi.RegisterTransfersServer(srv, g)
+	grpcapi.RegisterTransactionsServer(srv, g)
+	return srv
+}
+
+// startGRPC serves gRPC api on the separate port; returns nil if it's disabled
+func (s *APIServer) startGRPC() (*grpc.Server, error) {
+	if s.config.GRPCBindAddr == "" {
+		return nil, nil
+	}
+	lis, err := net.Listen("tcp", s.config.GRPCBindAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := s.newGRPCServer()
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			s.logger.Error("gRPC server failed", errField(err))
+		}
+	}()
+	s.logger.Info("Starting gRPC server")
+	return srv, nil
+}
+
+// internalError returns status of the failed store call, the same way storeErrorStatus does for REST;
+// errors caused by the request itself are logged as warnings
+func (g *grpcServer) internalError(method string, err error) error {
+	log := g.s.logger.Error
+	code := codes.Internal
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, store.AccountNotFoundErr):
+		code = codes.NotFound
+		log = g.s.logger.Warn
+	case errors.Is(err, store.VersionConflictErr):
+		code = codes.FailedPrecondition
+		log = g.s.logger.Warn
+	}
+	log("gRPC call failed", fld("method", method), errField(err))
+	return status.Error(code, err.Error())
+}
+
+func accountMessage(acc models.Account) (*grpcapi.Account, error) {
+	createdAt, err := ptypes.TimestampProto(acc.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcapi.Account{
+		AccountId: acc.AccountID,
+		Balance:   acc.Balance,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func (g *grpcServer) CreateAccount(ctx context.Context, req *grpcapi.CreateAccountRequest) (*grpcapi.Account, error) {
+	ctx, cancel := timeoutContext(ctx, g.s.config.Timeouts.Accounts)
+	defer cancel()
+	acc, err := g.s.store.InsertAccount(ctx, req.Balance)
+	if err != nil {
+		return nil, g.internalError("CreateAccount", err)
+	}
+	g.s.emit(webhooks.AccountCreated, AccountJsonView{
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
+	return accountMessage(acc)
+}
+
+func (g *grpcServer) GetAccount(ctx context.Context, req *grpcapi.AccountID) (*grpcapi.Account, error) {
+	ctx, cancel := timeoutContext(ctx, g.s.config.Timeouts.Accounts)
+	defer cancel()
+	acc, err := g.s.store.GetAccount(ctx, req.AccountId)
+	if err != nil {
+		return nil, g.internalError("GetAccount", err)
+	}
+	return accountMessage(acc)
+}
+
+func (g *grpcServer) DeleteAccount(ctx context.Context, req *grpcapi.AccountID) (*grpcapi.Empty, error) {
+	ctx, cancel := timeoutContext(ctx, g.s.config.Timeouts.Accounts)
+	defer cancel()
+	if err := g.s.store.DeleteAccount(ctx, req.AccountId, store.AnyVersion); err != nil {
+		return nil, g.internalError("DeleteAccount", err)
+	}
+	g.s.emit(webhooks.AccountDeleted, AccountIDJsonView{ID: req.AccountId})
+	return &grpcapi.Empty{}, nil
+}
+
+func (g *grpcServer) TransferMoney(ctx context.Context, req *grpcapi.TransferRequest) (*grpcapi.Empty, error) {
+	tr := TransactionJsonView{
+		FromAccountID: req.FromAccountId,
+		ToAccountID:   req.ToAccountId,
+		Amount:        req.Amount,
+	}
+	if err := g.s.checkTransfer(ctx, tr); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx, cancel := timeoutContext(ctx, g.s.config.Timeouts.Transfer)
+	defer cancel()
+	if err := g.s.transferMoney(ctx, tr); err != nil {
+		return nil, g.internalError("TransferMoney", err)
+	}
+	return &grpcapi.Empty{}, nil
+}
+
+func (g *grpcServer) GetTransactionsHistory(req *grpcapi.TransactionsHistoryRequest, stream grpcapi.Transactions_GetTransactionsHistoryServer) error {
+	ctx, cancel := timeoutContext(stream.Context(), g.s.config.Timeouts.Transactions)
+	defer cancel()
+	transactions, err := g.s.store.GetTransactionsHistory(ctx, req.AccountId, req.NLastDays, req.Limit)
+	if err != nil {
+		return g.internalError("GetTransactionsHistory", err)
+	}
+	for _, tr := range transactions {
+		ts, err := ptypes.TimestampProto(tr.Timestamp)
+		if err != nil {
+			return g.internalError("GetTransactionsHistory", err)
+		}
+		err = stream.Send(&grpcapi.Transaction{
+			TransactionId: tr.TransactionID,
+			Timestamp:     ts,
+			FromAccountId: tr.FromAccountID,
+			ToAccountId:   tr.ToAccountID,
+			Amount:        tr.Amount,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
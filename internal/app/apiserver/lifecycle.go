@@ -0,0 +1,283 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/outbox"
+	"github.com/gasparian/money-transfers-api/internal/app/webhooks"
+	"google.golang.org/grpc"
+)
+
+var (
+	drainTimeoutErr = errors.New("Connections are not drained within the shutdown timeout")
+)
+
+// component is a started part of the server with the function which stops it
+type component struct {
+	name string
+	stop func()
+}
+
+// lifecycle stops started components in the reverse order of their start,
+// so every component outlives the ones which depend on it
+type lifecycle struct {
+	logger     *logger
+	components []component
+}
+
+func newLifecycle(logger *logger) *lifecycle {
+	return &lifecycle{logger: logger}
+}
+
+// add registers component which must be stopped on shutdown
+func (l *lifecycle) add(name string, stop func()) {
+	l.components = append(l.components, component{name: name, stop: stop})
+}
+
+// stop stops the registered components, the last added is stopped first
+func (l *lifecycle) stop() {
+	for i := len(l.components) - 1; i >= 0; i-- {
+		l.logger.Info("Stopping component", fld("component", l.components[i].name))
+		l.components[i].stop()
+	}
+	l.components = nil
+}
+
+// drainer tracks long-lived connections which the http server can't drain by itself:
+// hijacked websocket connections and never-ending event streams
+type drainer struct {
+	mx       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	quit     chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{quit: make(chan struct{})}
+}
+
+// acquire registers the connection; returns false once the drain has started
+func (d *drainer) acquire() bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.draining {
+		return false
+	}
+	d.wg.Add(1)
+	return true
+}
+
+func (d *drainer) release() {
+	d.wg.Done()
+}
+
+// done is closed when the drain starts and the connections must be finished
+func (d *drainer) done() <-chan struct{} {
+	return d.quit
+}
+
+// drain signals the connections to finish and waits for them until ctx is done
+func (d *drainer) drain(ctx context.Context) error {
+	d.mx.Lock()
+	if !d.draining {
+		d.draining = true
+		close(d.quit)
+	}
+	d.mx.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *APIServer) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *APIServer) isReady() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// Start runs db and api server until SIGINT or SIGTERM is received, then drains it;
+// the second signal terminates the process right away
+func (s *APIServer) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			s.logger.Info("Shutting down", fld("signal", sig.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.Run(ctx)
+}
+
+// Run runs db and api server until ctx is done, then drains it
+func (s *APIServer) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.config.BindAddr)
+	if err != nil {
+		return err
+	}
+	return s.serve(ctx, lis)
+}
+
+// serve starts the store, background workers and servers; once ctx is done
+// in-flight requests are drained before the workers are stopped and the store is closed
+func (s *APIServer) serve(ctx context.Context, lis net.Listener) error {
+	lc := newLifecycle(s.logger)
+	defer lc.stop()
+
+	// NOTE: tracer is stopped last, so spans of the shutdown are exported too
+	tracer, err := s.newTracer()
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	if tracer != nil {
+		s.tracer = tracer
+		lc.add("tracer", tracer.Shutdown)
+	}
+	store, err := openStore(s.config, s.logger)
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	lc.add("store", store.Close)
+	s.setStore(store)
+	// NOTE: server doesn't start open if the keys can't be checked
+	if _, ok := store.(keyStore); s.config.Auth.Enabled && !ok {
+		lis.Close()
+		return authNotSupportedErr
+	}
+	if !s.config.Auth.Enabled {
+		s.logger.Warn("Authentication is disabled, every endpoint is open")
+	}
+	for key, replacement := range s.config.deprecatedKeys() {
+		s.logger.Warn("Config key is deprecated", fld("key", key), fld("replacement", replacement))
+	}
+	// NOTE: webhooks and outbox are enabled only if the store can persist them
+	if whStore, ok := store.(webhooks.Store); ok {
+		s.setWebhooks(whStore)
+		lc.add("webhooks dispatcher", s.webhooks.Stop)
+		if err := s.webhooks.Start(); err != nil {
+			lis.Close()
+			return err
+		}
+	}
+	if source, ok := store.(outbox.Source); ok {
+		relay, err := s.newOutboxRelay(source)
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		if relay != nil {
+			s.relay = relay
+			relay.Start()
+			lc.add("outbox relay", relay.Stop)
+		}
+	}
+	grpcSrv, err := s.startGRPC()
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	if grpcSrv != nil {
+		lc.add("gRPC server", func() { s.stopGRPC(grpcSrv) })
+	}
+
+	srv := s.newHTTPServer()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(lis)
+	}()
+	s.setReady(true)
+	s.logger.Info("Starting api server")
+
+	select {
+	case err := <-errs:
+		s.drain(srv)
+		return err
+	case <-ctx.Done():
+	}
+	return s.drain(srv)
+}
+
+func (s *APIServer) newHTTPServer() *http.Server {
+	return &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: time.Duration(s.config.Server.ReadHeaderTimeout) * time.Millisecond,
+		ReadTimeout:       time.Duration(s.config.Server.ReadTimeout) * time.Millisecond,
+		WriteTimeout:      time.Duration(s.config.Server.WriteTimeout) * time.Millisecond,
+		IdleTimeout:       time.Duration(s.config.Server.IdleTimeout) * time.Millisecond,
+	}
+}
+
+// drain flips readiness and keeps serving for the drain delay, so load balancers stop routing
+// new requests first; then it stops accepting connections and waits for in-flight requests,
+// event streams and websocket sessions to finish. Connections left after the shutdown timeout are closed
+func (s *APIServer) drain(srv *http.Server) error {
+	s.setReady(false)
+	s.logger.Info("Draining api server")
+	time.Sleep(time.Duration(s.config.Server.DrainDelay) * time.Millisecond)
+
+	ctx, cancel := timeoutContext(context.Background(), s.config.Server.ShutdownTimeout)
+	defer cancel()
+	streamsDrained := make(chan error, 1)
+	go func() {
+		streamsDrained <- s.streams.drain(ctx)
+	}()
+	err := srv.Shutdown(ctx)
+	if streamsErr := <-streamsDrained; err == nil {
+		err = streamsErr
+	}
+	if err != nil {
+		srv.Close()
+		return fmt.Errorf("%w: %s", drainTimeoutErr, err.Error())
+	}
+	return nil
+}
+
+// stopGRPC waits for in-flight RPCs, and cancels them once the shutdown timeout is exceeded
+func (s *APIServer) stopGRPC(srv *grpc.Server) {
+	ctx, cancel := timeoutContext(context.Background(), s.config.Server.ShutdownTimeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.logger.Warn("gRPC server is stopped forcibly", errField(drainTimeoutErr))
+		srv.Stop()
+	}
+}
@@ -1,8 +1,25 @@
 package apiserver
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
 )
 
 const (
@@ -13,62 +30,287 @@ const (
 )
 
 var (
-	levels = map[string]int{
-		"error":   0,
-		"warning": 1,
-		"info":    2,
-		"debug":   3,
+	levels = map[string]int32{
+		"error":   errorLevel,
+		"warning": warnLevel,
+		"info":    infoLevel,
+		"debug":   debugLevel,
 	}
+	levelNames = []string{"error", "warning", "info", "debug"}
+
+	unknownLogLevelErr = errors.New("Unknown log level, expected one of: error, warning, info, debug")
 )
 
+// field is the key-value pair of the log entry
+type field struct {
+	key   string
+	value interface{}
+}
+
+func fld(key string, value interface{}) field {
+	return field{key: key, value: value}
+}
+
+// errField holds error message, since errors are not marshalled to json by themselves
+func errField(err error) field {
+	return fld("error", err.Error())
+}
+
+// syncWriter serializes writes of the log entries, so lines are never interleaved
+type syncWriter struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) write(b []byte) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.w.Write(b)
+}
+
+// logger writes entries as json lines: time, level, message, caller and then the fields;
+// child loggers made by With share the level and the output with the parent
 type logger struct {
-	level int
-	warn  *log.Logger
-	info  *log.Logger
-	err   *log.Logger
-	debug *log.Logger
+	level  *int32
+	out    *syncWriter
+	fields []field
 }
 
-// NewLogger holds stdlib loggers for every needed logging level
+// NewLogger creates logger which writes to stdout at the info level
 func NewLogger() *logger {
-	return &logger{
-		level: levels["info"],
-		err:   log.New(os.Stderr, "[ Error ] ", log.LstdFlags|log.Lshortfile),
-		warn:  log.New(os.Stdout, "[ Warn ] ", log.LstdFlags|log.Lshortfile),
-		info:  log.New(os.Stdout, "[ Info ] ", log.LstdFlags|log.Lshortfile),
-		debug: log.New(os.Stderr, "[ Debug ] ", log.LstdFlags|log.Lshortfile),
+	return newLogger(os.Stdout)
+}
+
+func newLogger(w io.Writer) *logger {
+	level := int32(infoLevel)
+	return &logger{level: &level, out: &syncWriter{w: w}}
+}
+
+// SetLevel sets needed logging level; the level is kept as is if the name is unknown
+func (l *logger) SetLevel(level string) error {
+	v, ok := levels[level]
+	if !ok {
+		return fmt.Errorf("%w: %q", unknownLogLevelErr, level)
 	}
+	atomic.StoreInt32(l.level, v)
+	return nil
 }
 
-// SetLevel sets needed logging level
-func (l *logger) SetLevel(level string) {
-	l.level = levels[level]
+// Level returns name of the current logging level
+func (l *logger) Level() string {
+	return levelNames[atomic.LoadInt32(l.level)]
 }
 
-// Error writes out message based on current logging level
-func (l *logger) Error(msg string) {
-	if l.level >= errorLevel {
-		l.err.Println(msg)
+// With returns logger which adds the fields to every entry
+func (l *logger) With(fields ...field) *logger {
+	child := *l
+	child.fields = make([]field, 0, len(l.fields)+len(fields))
+	child.fields = append(append(child.fields, l.fields...), fields...)
+	return &child
+}
+
+func (l *logger) enabled(level int32) bool {
+	return atomic.LoadInt32(l.level) >= level
+}
+
+func (l *logger) write(level int32, msg string, fields []field) {
+	if !l.enabled(level) {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, levelNames[level])
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	// NOTE: skip write and the level method to get the line which logs
+	if _, file, line, ok := runtime.Caller(2); ok {
+		buf.WriteString(`,"caller":`)
+		writeJSON(&buf, filepath.Base(file)+":"+strconv.Itoa(line))
+	}
+	for _, fields := range [][]field{l.fields, fields} {
+		for _, f := range fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.key)
+			buf.WriteByte(':')
+			writeJSON(&buf, f.value)
+		}
 	}
+	buf.WriteString("}\n")
+	l.out.write(buf.Bytes())
 }
 
-// Warn ...
-func (l *logger) Warn(msg string) {
-	if l.level >= warnLevel {
-		l.warn.Println(msg)
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
 	}
+	buf.Write(b)
+}
+
+// Error writes out message based on current logging level
+func (l *logger) Error(msg string, fields ...field) {
+	l.write(errorLevel, msg, fields)
+}
+
+// Warn ...
+func (l *logger) Warn(msg string, fields ...field) {
+	l.write(warnLevel, msg, fields)
 }
 
 // Info ...
-func (l *logger) Info(msg string) {
-	if l.level >= infoLevel {
-		l.info.Println(msg)
-	}
+func (l *logger) Info(msg string, fields ...field) {
+	l.write(infoLevel, msg, fields)
 }
 
 // Debug ...
-func (l *logger) Debug(msg string) {
-	if l.level >= debugLevel {
-		l.debug.Println(msg)
+func (l *logger) Debug(msg string, fields ...field) {
+	l.write(debugLevel, msg, fields)
+}
+
+// requestLog is the logger of the request carried in its context; handlers add fields
+// to it, so they appear both in the later entries and in the access log
+type requestLog struct {
+	mx        sync.Mutex
+	logger    *logger
+	requestID string
+}
+
+type requestLogKey struct{}
+
+func contextWithRequestLog(ctx context.Context, l *logger, requestID string) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{logger: l, requestID: requestID})
+}
+
+// requestIDFrom returns id of the request, empty outside of the request
+func requestIDFrom(ctx context.Context) string {
+	rl, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return ""
+	}
+	return rl.requestID
+}
+
+// annotate adds fields to the logger of the request, if there is one
+func annotate(ctx context.Context, fields ...field) {
+	rl, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	rl.logger = rl.logger.With(fields...)
+}
+
+// log returns logger of the request, the server one is used outside of the request
+func (s *APIServer) log(ctx context.Context) *logger {
+	rl, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return s.logger
+	}
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	return rl.logger
+}
+
+// requestIDHeader holds id of the request, it's generated unless the client has passed a valid one
+const requestIDHeader = "X-Request-ID"
+
+// quietRoutes are polled by the orchestrator and the scraper, so they're logged at the debug level
+var quietRoutes = map[string]bool{
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// validRequestID accepts ids of up to 128 letters, digits and `-_.:`, so the id can't break the log line
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withAccessLog puts the logger of the request into its context and writes the access log entry
+// once the request is served; event streams and websockets are logged when they're closed
+func (s *APIServer) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		route := s.route(r)
+		fields := []field{fld("request_id", requestID), fld("method", r.Method), fld("route", route)}
+		if sc := tracing.FromContext(r.Context()).SpanContext(); sc.IsValid() {
+			fields = append(fields, fld("trace_id", sc.TraceID.String()))
+		}
+		ctx := contextWithRequestLog(r.Context(), s.logger.With(fields...), requestID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := []field{
+			fld("path", r.URL.Path),
+			fld("status", status),
+			fld("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			fld("bytes", rec.bytes),
+			fld("remote_addr", r.RemoteAddr),
+		}
+		if quietRoutes[route] {
+			s.log(ctx).Debug("Request served", entry...)
+		} else {
+			s.log(ctx).Info("Request served", entry...)
+		}
+	})
+}
+
+// handleLogLevel returns or changes the logging level at runtime
+func (s *APIServer) handleLogLevel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var req LogLevelJsonView
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			previous := s.logger.Level()
+			if err := s.logger.SetLevel(req.Level); err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			s.log(r.Context()).Warn("Log level changed", fld("from", previous), fld("to", req.Level))
+			s.audit(r.Context(), models.AuditLogLevelChanged, "config:log_level",
+				LogLevelJsonView{Level: previous}, LogLevelJsonView{Level: req.Level})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(LogLevelJsonView{Level: s.logger.Level()})
 	}
 }
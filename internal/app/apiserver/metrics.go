@@ -0,0 +1,281 @@
+package apiserver
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/metrics"
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+)
+
+// Outcomes of the transfers and the store calls
+const (
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+	transferCancelled = "cancelled"
+	storeCallOk       = "ok"
+	storeCallError    = "error"
+)
+
+var (
+	hijackNotSupportedErr = errors.New("Connection doesn't support hijacking")
+)
+
+// knownMethods limits values of the method label, since the method is set by the client
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// serverMetrics holds metrics of the api server exposed on `/metrics`
+type serverMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	transfers       *metrics.CounterVec
+	transferAmount  *metrics.CounterVec
+	storeDuration   *metrics.HistogramVec
+}
+
+type poolStater interface {
+	PoolStats() map[string]sql.DBStats
+}
+
+func (s *APIServer) configureMetrics() {
+	r := metrics.NewRegistry()
+	s.metrics = &serverMetrics{
+		registry: r,
+		requests: r.NewCounter(
+			"http_requests_total",
+			"Number of the handled http requests.",
+			"route", "method", "code",
+		),
+		requestDuration: r.NewHistogram(
+			"http_request_duration_seconds",
+			"Latency of the http requests; event streams and websockets are observed once closed.",
+			metrics.DefaultBuckets,
+			"route", "method", "code",
+		),
+		transfers: r.NewCounter(
+			"transfers_total",
+			"Number of the money transfers by outcome.",
+			"outcome",
+		),
+		transferAmount: r.NewCounter(
+			"transfer_amount_total",
+			"Sum of the transferred amounts by outcome, in minor units.",
+			"outcome",
+		),
+		storeDuration: r.NewHistogram(
+			"store_call_duration_seconds",
+			"Latency of the store calls by method and outcome.",
+			metrics.DefaultBuckets,
+			"method", "outcome",
+		),
+	}
+	r.RegisterFunc(s.poolMetrics)
+	r.RegisterRuntime()
+}
+
+// poolMetrics returns stats of the db connection pools, if the store has any
+func (s *APIServer) poolMetrics() []metrics.Family {
+	ps, ok := s.backend.(poolStater)
+	if !ok {
+		return nil
+	}
+	stats := ps.PoolStats()
+	pools := make([]string, 0, len(stats))
+	for pool := range stats {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	family := func(name, help, metricType string, value func(st sql.DBStats) float64) metrics.Family {
+		f := metrics.Family{Name: name, Help: help, Type: metricType, Labels: []string{"pool"}}
+		for _, pool := range pools {
+			f.Samples = append(f.Samples, metrics.Sample{LabelValues: []string{pool}, Value: value(stats[pool])})
+		}
+		return f
+	}
+	return []metrics.Family{
+		family("db_pool_max_open_connections", "Maximum number of open connections to the db.", metrics.GaugeType,
+			func(st sql.DBStats) float64 { return float64(st.MaxOpenConnections) }),
+		family("db_pool_open_connections", "Number of established connections, both in use and idle.", metrics.GaugeType,
+			func(st sql.DBStats) float64 { return float64(st.OpenConnections) }),
+		family("db_pool_in_use_connections", "Number of connections currently in use.", metrics.GaugeType,
+			func(st sql.DBStats) float64 { return float64(st.InUse) }),
+		family("db_pool_idle_connections", "Number of idle connections.", metrics.GaugeType,
+			func(st sql.DBStats) float64 { return float64(st.Idle) }),
+		family("db_pool_wait_count_total", "Total number of connections waited for.", metrics.CounterType,
+			func(st sql.DBStats) float64 { return float64(st.WaitCount) }),
+		family("db_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", metrics.CounterType,
+			func(st sql.DBStats) float64 { return st.WaitDuration.Seconds() }),
+		family("db_pool_max_idle_closed_total", "Total number of connections closed due to the idle limit.", metrics.CounterType,
+			func(st sql.DBStats) float64 { return float64(st.MaxIdleClosed) }),
+		family("db_pool_max_lifetime_closed_total", "Total number of connections closed due to the lifetime limit.", metrics.CounterType,
+			func(st sql.DBStats) float64 { return float64(st.MaxLifetimeClosed) }),
+	}
+}
+
+// observeTransfer counts the transfer and its amount by outcome
+func (m *serverMetrics) observeTransfer(amount int64, err error) {
+	outcome := transferCompleted
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		outcome = transferCancelled
+	case err != nil:
+		outcome = transferFailed
+	}
+	m.transfers.Inc(outcome)
+	m.transferAmount.Add(float64(amount), outcome)
+}
+
+// statusRecorder captures status code and size of the response; it keeps Flusher and Hijacker
+// of the wrapped writer, which event streams and websockets rely on
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, hijackNotSupportedErr
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// withMetrics counts requests and observes their latency by the route pattern,
+// so the number of series doesn't depend on ids passed in the path
+func (s *APIServer) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := s.route(r)
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+		s.metrics.requests.Inc(route, method, code)
+		s.metrics.requestDuration.Observe(time.Since(start).Seconds(), route, method, code)
+	})
+}
+
+func (s *APIServer) handleMetrics() http.HandlerFunc {
+	return s.metrics.registry.Handler().ServeHTTP
+}
+
+// instrumentedStore observes latency and outcome of every call of the wrapped store
+// and records the call as a span of the request trace
+type instrumentedStore struct {
+	store   store.Store
+	metrics *serverMetrics
+}
+
+func (s *APIServer) instrument(st store.Store) store.Store {
+	return &instrumentedStore{store: st, metrics: s.metrics}
+}
+
+// start starts the span of the call; the returned function ends it and observes the call
+func (i *instrumentedStore) start(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "store."+method)
+	return ctx, func(err error) {
+		outcome := storeCallOk
+		if err != nil {
+			outcome = storeCallError
+		}
+		span.SetError(err)
+		span.End()
+		i.metrics.storeDuration.Observe(time.Since(start).Seconds(), method, outcome)
+	}
+}
+
+func (i *instrumentedStore) Ping(ctx context.Context) error {
+	ctx, done := i.start(ctx, "Ping")
+	err := i.store.Ping(ctx)
+	done(err)
+	return err
+}
+
+func (i *instrumentedStore) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	ctx, done := i.start(ctx, "InsertAccount")
+	acc, err := i.store.InsertAccount(ctx, balance)
+	done(err)
+	return acc, err
+}
+
+func (i *instrumentedStore) DeleteAccount(ctx context.Context, accountId, version int64) error {
+	ctx, done := i.start(ctx, "DeleteAccount")
+	err := i.store.DeleteAccount(ctx, accountId, version)
+	done(err)
+	return err
+}
+
+func (i *instrumentedStore) GetAccount(ctx context.Context, accountId int64) (models.Account, error) {
+	ctx, done := i.start(ctx, "GetAccount")
+	acc, err := i.store.GetAccount(ctx, accountId)
+	done(err)
+	return acc, err
+}
+
+func (i *instrumentedStore) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	ctx, done := i.start(ctx, "TransferMoney")
+	err := i.store.TransferMoney(ctx, accountToId, accountFromId, amount)
+	done(err)
+	return err
+}
+
+func (i *instrumentedStore) GetTransactionsHistory(ctx context.Context, accountId, nLastDays, limit int64) ([]models.Transaction, error) {
+	ctx, done := i.start(ctx, "GetTransactionsHistory")
+	tr, err := i.store.GetTransactionsHistory(ctx, accountId, nLastDays, limit)
+	done(err)
+	return tr, err
+}
@@ -0,0 +1,86 @@
+package apiserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+var (
+	migrationsNotSupportedErr = errors.New("Migrations are supported only by the sqlite store")
+	unknownMigrateCommandErr  = errors.New("Unknown migrate command, expected one of: status, up, down, to <version>")
+)
+
+// Migrate runs `migrate` subcommand against the configured store:
+// `status` lists migrations, `up` applies all pending ones,
+// `down` reverts the last one and `to <version>` moves schema to the exact version
+func Migrate(config *Config, args []string, out io.Writer) error {
+	if config.StoreDriver != "sqlite" {
+		return migrationsNotSupportedErr
+	}
+	if len(args) == 0 {
+		return unknownMigrateCommandErr
+	}
+	s, err := sqlstore.Open(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	target := version
+	switch args[0] {
+	case "status":
+		statuses, err := s.MigrationsStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "schema version: %d (latest known: %d)\n", version, sqlstore.LatestSchemaVersion())
+		for _, m := range statuses {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(out, "%4d  %-8s %s\n", m.Version, state, m.Description)
+		}
+		return nil
+	case "up":
+		target = sqlstore.LatestSchemaVersion()
+	case "down":
+		if version > 0 {
+			target = version - 1
+		}
+	case "to":
+		if len(args) < 2 {
+			return unknownMigrateCommandErr
+		}
+		target, err = strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+	default:
+		return unknownMigrateCommandErr
+	}
+	if err := s.Migrate(target); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version: %d -> %d\n", version, target)
+	// NOTE: the audit log is dropped along with the schema below its version, it's empty then
+	if target == version || target < sqlstore.AuditSchemaVersion {
+		return nil
+	}
+	return auditCLI(
+		s,
+		models.AuditSchemaMigrated,
+		"schema",
+		SchemaVersionJsonView{SchemaVersion: version},
+		SchemaVersionJsonView{SchemaVersion: target},
+	)
+}
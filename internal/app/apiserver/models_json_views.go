@@ -1,6 +1,7 @@
 package apiserver
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -8,6 +9,20 @@ import (
 type AccountJsonView struct {
 	AccountID int64 `json:"account_id"`
 	Balance   int64 `json:"balance"`
+	Version   int64 `json:"version,omitempty"`
+}
+
+// ReadinessJsonView holds outcome of the readiness checks by their names
+type ReadinessJsonView struct {
+	Status string                   `json:"status"`
+	Checks map[string]CheckJsonView `json:"checks"`
+}
+
+// CheckJsonView holds outcome of a single readiness check
+type CheckJsonView struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 // AccountIDJsonView ...
@@ -22,3 +37,100 @@ type TransactionJsonView struct {
 	ToAccountID   int64     `json:"to_account_id"`
 	Amount        int64     `json:"amount"`
 }
+
+// TransferFailedJsonView holds rejected transfer along with the reason
+type TransferFailedJsonView struct {
+	TransactionJsonView
+	Error string `json:"error"`
+}
+
+// WebhookJsonView holds registered webhook
+type WebhookJsonView struct {
+	WebhookID int64     `json:"webhook_id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// WebhookDeliveryJsonView holds state of the event delivery
+type WebhookDeliveryJsonView struct {
+	DeliveryID int64           `json:"delivery_id"`
+	WebhookID  int64           `json:"webhook_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	EventType  string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status"`
+	Attempts   int64           `json:"attempts"`
+	LastError  string          `json:"last_error"`
+}
+
+// AccountEventJsonView holds single change of the account state
+type AccountEventJsonView struct {
+	Type        string               `json:"type"`
+	AccountID   int64                `json:"account_id"`
+	Balance     int64                `json:"balance"`
+	Transaction *TransactionJsonView `json:"transaction,omitempty"`
+}
+
+// WSRequestJsonView holds message sent by the websocket client
+type WSRequestJsonView struct {
+	Type       string               `json:"type"`
+	ID         string               `json:"id"`
+	AccountIDs []int64              `json:"account_ids,omitempty"`
+	Transfer   *TransactionJsonView `json:"transfer,omitempty"`
+}
+
+// WSResponseJsonView holds message sent to the websocket client
+type WSResponseJsonView struct {
+	Type   string                `json:"type"`
+	ID     string                `json:"id,omitempty"`
+	Status string                `json:"status,omitempty"`
+	Error  string                `json:"error,omitempty"`
+	Event  *AccountEventJsonView `json:"event,omitempty"`
+}
+
+// BackupJsonView describes backup request and the written file
+type BackupJsonView struct {
+	Name          string    `json:"name,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	CreatedAt     time.Time `json:"created_at,omitempty"`
+	SchemaVersion int       `json:"schema_version,omitempty"`
+}
+
+// SchemaVersionJsonView holds version of the db schema
+type SchemaVersionJsonView struct {
+	SchemaVersion int `json:"schema_version"`
+}
+
+// LogLevelJsonView holds logging level: error, warning, info or debug
+type LogLevelJsonView struct {
+	Level string `json:"level"`
+}
+
+// APIKeyJsonView describes the api key; Key holds the key itself and it's returned
+// only once, when the key is issued or rotated
+type APIKeyJsonView struct {
+	KeyID     string     `json:"key_id,omitempty"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AuditEntryJsonView is the entry of the audit log, before and after hold the state of the resource
+type AuditEntryJsonView struct {
+	AuditID   int64           `json:"audit_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Actor     string          `json:"actor"`
+	SourceIP  string          `json:"source_ip"`
+	RequestID string          `json:"request_id"`
+	Action    string          `json:"action"`
+	Resource  string          `json:"resource"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
@@ -0,0 +1,229 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+// Statuses of the readiness checks
+const (
+	checkOk = "ok"
+	// checkDegraded is reported when only non-critical checks have failed
+	checkDegraded = "degraded"
+	checkFail     = "fail"
+)
+
+var (
+	notReadyErr             = errors.New("Server is starting or shutting down")
+	storeNotOpenedErr       = errors.New("Store is not opened")
+	schemaOutdatedErr       = errors.New("Schema version differs from the one of the build")
+	lowDiskSpaceErr         = errors.New("Free disk space is below the threshold")
+	replicaLagErr           = errors.New("Replica lags behind the primary more than allowed")
+	diskSpaceUnsupportedErr = errors.New("Free disk space can't be checked on the platform")
+)
+
+// readinessCheck is a single check of the readiness probe; failure of the critical check
+// makes the server not ready, others only degrade it, so an outage of the outbox target
+// or of the webhook receivers doesn't take the whole api out of the load balancer
+type readinessCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) (details interface{}, err error)
+}
+
+type schemaVersioner interface {
+	SchemaVersion() (int, error)
+}
+
+type replicaLagger interface {
+	ReplicaLag() (int64, error)
+}
+
+// dataDirs returns directories where the configured store keeps its files
+func dataDirs(config *Config) []string {
+	var paths []string
+	switch config.StoreDriver {
+	case "sqlite":
+		paths = append(paths, filepath.Dir(config.SQLite.DbPath))
+		if config.SQLite.ReplicaPath != "" {
+			paths = append(paths, filepath.Dir(config.SQLite.ReplicaPath))
+		}
+	case "memory":
+		if config.Memory.DataDir != "" {
+			paths = append(paths, config.Memory.DataDir)
+		}
+	case "eventsourced":
+		if config.EventSourced.DataDir != "" {
+			paths = append(paths, config.EventSourced.DataDir)
+		}
+	case "sharded":
+		paths = append(paths, filepath.Dir(config.Sharded.CoordinatorPath))
+		for _, shard := range config.Sharded.Shards {
+			paths = append(paths, filepath.Dir(shard))
+		}
+	}
+	seen := make(map[string]bool)
+	dirs := paths[:0]
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			dirs = append(dirs, path)
+		}
+	}
+	return dirs
+}
+
+// readinessChecks returns checks of the server state, the store and the background workers
+func (s *APIServer) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{{
+		name:     "server",
+		critical: true,
+		check: func(ctx context.Context) (interface{}, error) {
+			if !s.isReady() {
+				return nil, notReadyErr
+			}
+			return nil, nil
+		},
+	}}
+	if s.store == nil {
+		return append(checks, readinessCheck{
+			name:     "store",
+			critical: true,
+			check: func(ctx context.Context) (interface{}, error) {
+				return nil, storeNotOpenedErr
+			},
+		})
+	}
+	checks = append(checks, readinessCheck{
+		name:     "store",
+		critical: true,
+		check: func(ctx context.Context) (interface{}, error) {
+			return nil, s.store.Ping(ctx)
+		},
+	})
+	if sv, ok := s.backend.(schemaVersioner); ok {
+		checks = append(checks, readinessCheck{
+			name:     "migrations",
+			critical: true,
+			check: func(ctx context.Context) (interface{}, error) {
+				version, err := sv.SchemaVersion()
+				if err != nil {
+					return nil, err
+				}
+				details := map[string]int{"version": version, "latest": sqlstore.LatestSchemaVersion()}
+				if version != sqlstore.LatestSchemaVersion() {
+					return details, schemaOutdatedErr
+				}
+				return details, nil
+			},
+		})
+	}
+	if dirs := dataDirs(s.config); len(dirs) > 0 {
+		if _, err := freeDiskSpace(dirs[0]); !errors.Is(err, diskSpaceUnsupportedErr) {
+			checks = append(checks, readinessCheck{
+				name:     "disk",
+				critical: true,
+				check: func(ctx context.Context) (interface{}, error) {
+					return s.checkDiskSpace(dirs)
+				},
+			})
+		}
+	}
+	if rl, ok := s.backend.(replicaLagger); ok && s.config.SQLite.ReplicaPath != "" {
+		checks = append(checks, readinessCheck{
+			name: "replica",
+			check: func(ctx context.Context) (interface{}, error) {
+				lag, err := rl.ReplicaLag()
+				details := map[string]int64{"lag": lag}
+				if err != nil {
+					return details, err
+				}
+				if s.config.Probes.MaxReplicaLag > 0 && lag > s.config.Probes.MaxReplicaLag {
+					return details, replicaLagErr
+				}
+				return details, nil
+			},
+		})
+	}
+	if s.relay != nil {
+		checks = append(checks, readinessCheck{
+			name: "outbox_relay",
+			check: func(ctx context.Context) (interface{}, error) {
+				return nil, s.relay.Health()
+			},
+		})
+	}
+	if s.webhooks != nil {
+		checks = append(checks, readinessCheck{
+			name: "webhooks",
+			check: func(ctx context.Context) (interface{}, error) {
+				return nil, s.webhooks.Health()
+			},
+		})
+	}
+	return checks
+}
+
+// checkDiskSpace returns free bytes per data directory; fails if any of them is below the threshold
+func (s *APIServer) checkDiskSpace(dirs []string) (interface{}, error) {
+	details := make(map[string]uint64, len(dirs))
+	var res error
+	for _, dir := range dirs {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			return details, fmt.Errorf("%s: %w", dir, err)
+		}
+		details[dir] = free
+		if free < s.config.Probes.MinFreeDiskMB<<20 && res == nil {
+			res = fmt.Errorf("%w: %s", lowDiskSpaceErr, dir)
+		}
+	}
+	return details, res
+}
+
+// readiness runs the checks, every one of them is bound to the probe timeout
+func (s *APIServer) readiness(ctx context.Context) ReadinessJsonView {
+	res := ReadinessJsonView{
+		Status: checkOk,
+		Checks: make(map[string]CheckJsonView),
+	}
+	for _, c := range s.readinessChecks() {
+		checkCtx, cancel := timeoutContext(ctx, s.config.Probes.Timeout)
+		details, err := c.check(checkCtx)
+		cancel()
+		view := CheckJsonView{Status: checkOk, Details: details}
+		if err != nil {
+			view.Status = checkFail
+			view.Error = err.Error()
+			switch {
+			case c.critical:
+				res.Status = checkFail
+			case res.Status == checkOk:
+				res.Status = checkDegraded
+			}
+		}
+		res.Checks[c.name] = view
+	}
+	return res
+}
+
+// handleReady reports whether the server accepts traffic along with the outcome of every check:
+// it's not ready until the store is opened, during the drain and while any critical check fails
+func (s *APIServer) handleReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := s.readiness(r.Context())
+		w.Header().Set("Content-type", "application/json")
+		if res.Status == checkFail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,105 @@
+package apiserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/store/eventstore"
+	"github.com/gasparian/money-transfers-api/internal/app/store/kvstore"
+	"github.com/gasparian/money-transfers-api/internal/app/store/pgstore"
+	"github.com/gasparian/money-transfers-api/internal/app/store/shardstore"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+var (
+	unknownStoreDriverErr = errors.New("Unknown store driver")
+)
+
+type closableStore interface {
+	store.Store
+	Close()
+}
+
+// storeOpener opens the store; errors of its background work are reported to logger
+type storeOpener func(config *Config, logger *logger) (closableStore, error)
+
+// storeDrivers holds constructors of the stores by the `store_driver` config value;
+// new backend needs an entry here and its own config section
+var storeDrivers = map[string]storeOpener{
+	"sqlite": func(config *Config, logger *logger) (closableStore, error) {
+		return sqlstore.NewWithOptions(config.SQLite.DbPath, config.QueryTimeout, sqliteOptions(config))
+	},
+	"postgres": func(config *Config, logger *logger) (closableStore, error) {
+		return pgstore.New(config.Postgres.DSN, config.QueryTimeout)
+	},
+	"memory": func(config *Config, logger *logger) (closableStore, error) {
+		if config.Memory.DataDir == "" {
+			return kvstore.New(), nil
+		}
+		return kvstore.Open(kvstore.Options{
+			Dir:              config.Memory.DataDir,
+			Fsync:            config.Memory.Fsync,
+			FsyncInterval:    time.Duration(config.Memory.FsyncInterval) * time.Millisecond,
+			SnapshotInterval: time.Duration(config.Memory.SnapshotInterval) * time.Millisecond,
+			OnError: func(err error) {
+				logger.Error("Memory store persistence failed", errField(err))
+			},
+		})
+	},
+	"eventsourced": func(config *Config, logger *logger) (closableStore, error) {
+		if config.EventSourced.DataDir == "" {
+			return eventstore.New(), nil
+		}
+		return eventstore.OpenWithOptions(config.EventSourced.DataDir, eventstore.Options{
+			SnapshotEvery: config.EventSourced.SnapshotEvery,
+			OnError: func(err error) {
+				logger.Error("Event store snapshot failed", errField(err))
+			},
+		})
+	},
+	"sharded": func(config *Config, logger *logger) (closableStore, error) {
+		s, err := shardstore.Open(config.Sharded.CoordinatorPath, config.Sharded.Shards, config.QueryTimeout, sqliteOptions(config))
+		if err != nil {
+			return nil, err
+		}
+		s.OnError(func(err error) {
+			logger.Error("Recovery of the cross-shard transfer failed", errField(err))
+		})
+		return s, nil
+	},
+}
+
+func sqliteOptions(config *Config) sqlstore.Options {
+	return sqlstore.Options{
+		JournalMode:     config.SQLite.JournalMode,
+		Synchronous:     config.SQLite.Synchronous,
+		BusyTimeout:     config.SQLite.BusyTimeout,
+		ForeignKeys:     config.SQLite.ForeignKeys,
+		ReadPoolSize:    config.SQLite.ReadPoolSize,
+		ReplicaPath:     config.SQLite.ReplicaPath,
+		ReplicaInterval: time.Duration(config.SQLite.ReplicaInterval) * time.Millisecond,
+	}
+}
+
+// openStore opens store selected by the `store_driver` config key
+func openStore(config *Config, logger *logger) (closableStore, error) {
+	open, ok := storeDrivers[config.StoreDriver]
+	if !ok {
+		drivers := make([]string, 0, len(storeDrivers))
+		for name := range storeDrivers {
+			drivers = append(drivers, name)
+		}
+		sort.Strings(drivers)
+		return nil, fmt.Errorf(
+			"%w: %q, expected one of: %s",
+			unknownStoreDriverErr,
+			config.StoreDriver,
+			strings.Join(drivers, ", "),
+		)
+	}
+	return open(config, logger)
+}
@@ -0,0 +1,77 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+)
+
+// newTracer creates tracer for the configured exporter; returns nil if tracing is disabled
+func (s *APIServer) newTracer() (*tracing.Tracer, error) {
+	if s.config.Tracing.Exporter == "" {
+		return nil, nil
+	}
+	exporter, err := tracing.NewExporter(
+		s.config.Tracing.Exporter,
+		s.config.Tracing.Endpoint,
+		s.config.Tracing.ServiceName,
+		time.Duration(s.config.QueryTimeout)*time.Second,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tracer := tracing.NewTracer(exporter, tracing.Options{
+		SampleRatio:   s.config.Tracing.SampleRatio,
+		BatchSize:     s.config.Tracing.BatchSize,
+		FlushInterval: time.Duration(s.config.Tracing.FlushInterval) * time.Millisecond,
+	})
+	tracer.OnError(func(err error) {
+		s.logger.Error("Trace export failed", errField(err))
+	})
+	return tracer, nil
+}
+
+// route returns the pattern of the router which serves the request, `other` if there is none
+func (s *APIServer) route(r *http.Request) string {
+	_, route := s.router.Handler(r)
+	if route == "" {
+		return "other"
+	}
+	return route
+}
+
+// withTracing starts the server span of the request, continuing the trace of the caller
+// passed in the traceparent header; store calls made by the handler become its children
+func (s *APIServer) withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// NOTE: malformed header is ignored and the new trace is started
+		remote, _ := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader))
+		route := s.route(r)
+		ctx, span := s.tracer.StartRoot(r.Context(), r.Method+" "+route, tracing.SpanKindServer, remote)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+	})
+}
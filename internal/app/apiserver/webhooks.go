@@ -0,0 +1,202 @@
+package apiserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/webhooks"
+)
+
+var (
+	webhooksDisabledErr  = errors.New("Webhooks are not supported by the current store")
+	invalidWebhookURLErr = errors.New("Webhook url must be an absolute http(s) url")
+)
+
+// emit passes event to the webhooks dispatcher if it's enabled
+func (s *APIServer) emit(eventType string, data interface{}) {
+	if s.webhooks == nil {
+		return
+	}
+	if err := s.webhooks.Emit(eventType, data); err != nil {
+		s.logger.Error("Webhook event is not emitted", fld("event", eventType), errField(err))
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func webhookView(hook models.Webhook) WebhookJsonView {
+	return WebhookJsonView{
+		WebhookID: hook.WebhookID,
+		CreatedAt: hook.CreatedAt,
+		URL:       hook.URL,
+	}
+}
+
+func webhookResource(webhookId int64) string {
+	return "webhook:" + strconv.FormatInt(webhookId, 10)
+}
+
+func (s *APIServer) handleWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.webhooks == nil {
+			s.handleError(webhooksDisabledErr, http.StatusNotImplemented, w, r)
+			return
+		}
+		registry := s.webhooks.Store()
+		switch r.Method {
+		case "POST":
+			w.Header().Set("Content-type", "application/json")
+			var hook WebhookJsonView
+			err := json.NewDecoder(r.Body).Decode(&hook)
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			u, err := url.Parse(hook.URL)
+			if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+				s.handleError(invalidWebhookURLErr, http.StatusBadRequest, w, r)
+				return
+			}
+			if hook.Secret == "" {
+				hook.Secret, err = newWebhookSecret()
+				if err != nil {
+					s.handleError(err, http.StatusInternalServerError, w, r)
+					return
+				}
+			}
+			hookModel, err := registry.InsertWebhook(hook.URL, hook.Secret)
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			s.audit(r.Context(), models.AuditWebhookCreated, webhookResource(hookModel.WebhookID), nil, webhookView(hookModel))
+			// NOTE: secret is only shown once, right after the registration
+			view := webhookView(hookModel)
+			view.Secret = hookModel.Secret
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(view)
+		case "GET":
+			w.Header().Set("Content-type", "application/json")
+			hooks, err := registry.ListWebhooks()
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			hooksJson := make([]WebhookJsonView, len(hooks))
+			for i, hook := range hooks {
+				hooksJson[i] = webhookView(hook)
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(hooksJson)
+		case "DELETE":
+			valMap, err := parseIntQueryParams(r, "webhook_id")
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			err = registry.DeleteWebhook(valMap["webhook_id"])
+			if errors.Is(err, store.WebhookNotFoundErr) {
+				s.handleError(err, http.StatusNotFound, w, r)
+				return
+			}
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			s.audit(r.Context(), models.AuditWebhookDeleted, webhookResource(valMap["webhook_id"]), nil, nil)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
+
+func (s *APIServer) handleWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.webhooks == nil {
+			s.handleError(webhooksDisabledErr, http.StatusNotImplemented, w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-type", "application/json")
+			valMap, err := parseIntQueryParams(r, "limit")
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			status := r.URL.Query().Get("status")
+			if status == "" {
+				status = webhooks.StatusFailed
+			}
+			deliveries, err := s.webhooks.Store().GetDeliveries(status, valMap["limit"])
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			deliveriesJson := make([]WebhookDeliveryJsonView, len(deliveries))
+			for i, d := range deliveries {
+				deliveriesJson[i] = WebhookDeliveryJsonView{
+					DeliveryID: d.DeliveryID,
+					WebhookID:  d.WebhookID,
+					CreatedAt:  d.CreatedAt,
+					UpdatedAt:  d.UpdatedAt,
+					EventType:  d.EventType,
+					Payload:    d.Payload,
+					Status:     d.Status,
+					Attempts:   d.Attempts,
+					LastError:  d.LastError,
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(deliveriesJson)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
+
+func (s *APIServer) handleWebhookReplay() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.webhooks == nil {
+			s.handleError(webhooksDisabledErr, http.StatusNotImplemented, w, r)
+			return
+		}
+		switch r.Method {
+		case "POST":
+			valMap, err := parseIntQueryParams(r, "delivery_id")
+			if err != nil {
+				s.handleError(err, http.StatusBadRequest, w, r)
+				return
+			}
+			err = s.webhooks.Replay(valMap["delivery_id"])
+			if errors.Is(err, webhooks.DeliveryNotFailedErr) {
+				s.handleError(err, http.StatusConflict, w, r)
+				return
+			}
+			if err != nil {
+				s.handleError(err, http.StatusInternalServerError, w, r)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gorilla/websocket"
+)
+
+// Types of the websocket messages
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsTransfer    = "transfer"
+	wsAck         = "ack"
+	wsResult      = "result"
+	wsEvent       = "event"
+	wsError       = "error"
+)
+
+const (
+	wsWriteTimeout  = 10 * time.Second
+	wsPongTimeout   = 60 * time.Second
+	wsPingInterval  = wsPongTimeout * 9 / 10
+	wsMaxMessage    = 4096
+	wsOutboxSize    = 256
+	wsStatusSuccess = "completed"
+	wsStatusFailure = "failed"
+)
+
+var (
+	unknownMessageTypeErr = errors.New("Unknown message type")
+	transferNotPassedErr  = errors.New("Transfer is not passed in the message")
+	slowClientErr         = errors.New("Client doesn't keep up with the messages rate")
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsSession holds state of a single websocket connection:
+// account subscriptions and the queue of outgoing messages
+type wsSession struct {
+	s   *APIServer
+	log *logger
+	// ctx carries the audit info and the api key of the upgrade request, it's not cancelled with the request
+	ctx  context.Context
+	conn *websocket.Conn
+	out  chan WSResponseJsonView
+	quit chan struct{}
+	once sync.Once
+	mx   sync.Mutex
+	subs map[int64]*pubsub.Subscription
+	wg   sync.WaitGroup
+}
+
+func (ws *wsSession) close() {
+	ws.once.Do(func() {
+		close(ws.quit)
+	})
+}
+
+// send queues message for the writer; the session is closed
+// when the client reads slower than the events arrive
+func (ws *wsSession) send(msg WSResponseJsonView) {
+	select {
+	case ws.out <- msg:
+	case <-ws.quit:
+	default:
+		ws.log.Warn("Websocket session is closed", errField(slowClientErr))
+		ws.close()
+	}
+}
+
+func (ws *wsSession) subscribe(accId int64) {
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	if _, ok := ws.subs[accId]; ok {
+		return
+	}
+	sub := ws.s.broker.Subscribe(accId)
+	ws.subs[accId] = sub
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		for event := range sub.C {
+			view := accountEventView(event)
+			ws.send(WSResponseJsonView{Type: wsEvent, Event: &view})
+		}
+	}()
+}
+
+func (ws *wsSession) unsubscribe(accId int64) {
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	if sub, ok := ws.subs[accId]; ok {
+		sub.Unsubscribe()
+		delete(ws.subs, accId)
+	}
+}
+
+func (ws *wsSession) unsubscribeAll() {
+	ws.mx.Lock()
+	for accId, sub := range ws.subs {
+		sub.Unsubscribe()
+		delete(ws.subs, accId)
+	}
+	ws.mx.Unlock()
+	ws.wg.Wait()
+}
+
+// flush writes out messages left in the queue, giving up once the write timeout is exceeded
+func (ws *wsSession) flush() {
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	for {
+		select {
+		case msg := <-ws.out:
+			if err := ws.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (ws *wsSession) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.quit:
+			ws.flush()
+			ws.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(wsWriteTimeout),
+			)
+			ws.conn.Close()
+			return
+		case msg := <-ws.out:
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := ws.conn.WriteJSON(msg); err != nil {
+				ws.close()
+			}
+		case <-ticker.C:
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := ws.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				ws.close()
+			}
+		}
+	}
+}
+
+func (ws *wsSession) handle(req WSRequestJsonView) {
+	switch req.Type {
+	case wsSubscribe:
+		for _, accId := range req.AccountIDs {
+			ws.subscribe(accId)
+		}
+		ws.send(WSResponseJsonView{Type: wsAck, ID: req.ID})
+	case wsUnsubscribe:
+		for _, accId := range req.AccountIDs {
+			ws.unsubscribe(accId)
+		}
+		ws.send(WSResponseJsonView{Type: wsAck, ID: req.ID})
+	case wsTransfer:
+		if req.Transfer == nil {
+			ws.send(WSResponseJsonView{Type: wsError, ID: req.ID, Error: transferNotPassedErr.Error()})
+			return
+		}
+		if err := ws.s.checkTransfer(ws.ctx, *req.Transfer); err != nil {
+			ws.send(WSResponseJsonView{Type: wsError, ID: req.ID, Error: err.Error()})
+			return
+		}
+		// NOTE: the connection outlives single requests, so every transfer gets its own deadline
+		ctx, cancel := timeoutContext(ws.ctx, ws.s.config.Timeouts.Transfer)
+		defer cancel()
+		// NOTE: the key could be revoked or rotated while the connection is open, so it's checked on every transfer
+		if err := ws.s.reauthorize(ctx, models.ScopeTransfersCreate); err != nil {
+			ws.send(WSResponseJsonView{Type: wsError, ID: req.ID, Error: err.Error()})
+			return
+		}
+		ws.send(WSResponseJsonView{Type: wsAck, ID: req.ID})
+		if err := ws.s.transferMoney(ctx, *req.Transfer); err != nil {
+			ws.send(WSResponseJsonView{Type: wsResult, ID: req.ID, Status: wsStatusFailure, Error: err.Error()})
+			return
+		}
+		ws.send(WSResponseJsonView{Type: wsResult, ID: req.ID, Status: wsStatusSuccess})
+	default:
+		ws.send(WSResponseJsonView{Type: wsError, ID: req.ID, Error: unknownMessageTypeErr.Error()})
+	}
+}
+
+// handleWebSocket serves bidirectional api: client subscribes to the accounts activity
+// and submits transfers, every request is answered with messages carrying its id
+func (s *APIServer) handleWebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// NOTE: hijacked connections are not tracked by the http server, so they are drained separately
+		if !s.streams.acquire() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		defer s.streams.release()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			s.log(r.Context()).Error("Websocket upgrade failed", errField(err))
+			return
+		}
+		ctx := s.withAuditInfo(context.Background(), auditInfo(r.Context(), r.RemoteAddr))
+		if key, ok := apiKeyFrom(r.Context()); ok {
+			ctx = contextWithAPIKey(ctx, key)
+		}
+		ws := &wsSession{
+			s:    s,
+			log:  s.log(r.Context()),
+			ctx:  ctx,
+			conn: conn,
+			out:  make(chan WSResponseJsonView, wsOutboxSize),
+			quit: make(chan struct{}),
+			subs: make(map[int64]*pubsub.Subscription),
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ws.writeLoop()
+		}()
+		defer func() {
+			ws.unsubscribeAll()
+			ws.close()
+			<-done
+		}()
+
+		conn.SetReadLimit(wsMaxMessage)
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			select {
+			case <-s.streams.done():
+				return conn.SetReadDeadline(time.Now())
+			default:
+			}
+			return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+		// NOTE: on drain the read is interrupted, so the request being handled is completed
+		// and answered before the session is closed
+		go func() {
+			select {
+			case <-s.streams.done():
+				conn.SetReadDeadline(time.Now())
+			case <-ws.quit:
+			}
+		}()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req WSRequestJsonView
+			if err := json.Unmarshal(msg, &req); err != nil {
+				ws.send(WSResponseJsonView{Type: wsError, Error: err.Error()})
+				continue
+			}
+			select {
+			case <-ws.quit:
+				return
+			default:
+			}
+			ws.handle(req)
+		}
+	}
+}
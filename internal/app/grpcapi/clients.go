@@ -0,0 +1,120 @@
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// AccountsClient is the client API for Accounts service
+type AccountsClient interface {
+	CreateAccount(ctx context.Context, in *CreateAccountRequest, opts ...grpc.CallOption) (*Account, error)
+	GetAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*Account, error)
+	DeleteAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*Empty, error)
+}
+
+type accountsClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewAccountsClient ...
+func NewAccountsClient(cc *grpc.ClientConn) AccountsClient {
+	return &accountsClient{cc}
+}
+
+func (c *accountsClient) CreateAccount(ctx context.Context, in *CreateAccountRequest, opts ...grpc.CallOption) (*Account, error) {
+	out := new(Account)
+	err := c.cc.Invoke(ctx, "/transfers.v1.Accounts/CreateAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsClient) GetAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*Account, error) {
+	out := new(Account)
+	err := c.cc.Invoke(ctx, "/transfers.v1.Accounts/GetAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *accountsClient) DeleteAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/transfers.v1.Accounts/DeleteAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TransfersClient is the client API for Transfers service
+type TransfersClient interface {
+	TransferMoney(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*Empty, error)
+}
+
+type transfersClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewTransfersClient ...
+func NewTransfersClient(cc *grpc.ClientConn) TransfersClient {
+	return &transfersClient{cc}
+}
+
+func (c *transfersClient) TransferMoney(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/transfers.v1.Transfers/TransferMoney", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TransactionsClient is the client API for Transactions service
+type TransactionsClient interface {
+	GetTransactionsHistory(ctx context.Context, in *TransactionsHistoryRequest, opts ...grpc.CallOption) (Transactions_GetTransactionsHistoryClient, error)
+}
+
+// Transactions_GetTransactionsHistoryClient is the client side of the history stream
+type Transactions_GetTransactionsHistoryClient interface {
+	Recv() (*Transaction, error)
+	grpc.ClientStream
+}
+
+type transactionsClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewTransactionsClient ...
+func NewTransactionsClient(cc *grpc.ClientConn) TransactionsClient {
+	return &transactionsClient{cc}
+}
+
+func (c *transactionsClient) GetTransactionsHistory(ctx context.Context, in *TransactionsHistoryRequest, opts ...grpc.CallOption) (Transactions_GetTransactionsHistoryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &transactionsServiceDesc.Streams[0], "/transfers.v1.Transactions/GetTransactionsHistory", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transactionsGetTransactionsHistoryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type transactionsGetTransactionsHistoryClient struct {
+	grpc.ClientStream
+}
+
+func (x *transactionsGetTransactionsHistoryClient) Recv() (*Transaction, error) {
+	m := new(Transaction)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,90 @@
+// Package grpcapi holds messages and service definitions described in api/proto/transfers.proto.
+// Code is kept by hand in the layout of protoc-gen-go output, so the build doesn't depend on protoc;
+// keep field numbers in sync with the proto file
+package grpcapi
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// Empty ...
+type Empty struct{}
+
+func (m *Empty) Reset()         { *m = Empty{} }
+func (m *Empty) String() string { return proto.CompactTextString(m) }
+func (*Empty) ProtoMessage()    {}
+
+// Account holds account id and its current balance
+type Account struct {
+	AccountId int64                `protobuf:"varint,1,opt,name=account_id,json=accountId,proto3" json:"account_id,omitempty"`
+	Balance   int64                `protobuf:"varint,2,opt,name=balance,proto3" json:"balance,omitempty"`
+	CreatedAt *timestamp.Timestamp `protobuf:"bytes,3,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+}
+
+func (m *Account) Reset()         { *m = Account{} }
+func (m *Account) String() string { return proto.CompactTextString(m) }
+func (*Account) ProtoMessage()    {}
+
+// AccountID ...
+type AccountID struct {
+	AccountId int64 `protobuf:"varint,1,opt,name=account_id,json=accountId,proto3" json:"account_id,omitempty"`
+}
+
+func (m *AccountID) Reset()         { *m = AccountID{} }
+func (m *AccountID) String() string { return proto.CompactTextString(m) }
+func (*AccountID) ProtoMessage()    {}
+
+// CreateAccountRequest holds initial balance of the new account
+type CreateAccountRequest struct {
+	Balance int64 `protobuf:"varint,1,opt,name=balance,proto3" json:"balance,omitempty"`
+}
+
+func (m *CreateAccountRequest) Reset()         { *m = CreateAccountRequest{} }
+func (m *CreateAccountRequest) String() string { return proto.CompactTextString(m) }
+func (*CreateAccountRequest) ProtoMessage()    {}
+
+// TransferRequest holds data needed to perform money transfer
+type TransferRequest struct {
+	FromAccountId int64 `protobuf:"varint,1,opt,name=from_account_id,json=fromAccountId,proto3" json:"from_account_id,omitempty"`
+	ToAccountId   int64 `protobuf:"varint,2,opt,name=to_account_id,json=toAccountId,proto3" json:"to_account_id,omitempty"`
+	Amount        int64 `protobuf:"varint,3,opt,name=amount,proto3" json:"amount,omitempty"`
+}
+
+func (m *TransferRequest) Reset()         { *m = TransferRequest{} }
+func (m *TransferRequest) String() string { return proto.CompactTextString(m) }
+func (*TransferRequest) ProtoMessage()    {}
+
+// TransactionsHistoryRequest holds filters of the transactions history query
+type TransactionsHistoryRequest struct {
+	AccountId int64 `protobuf:"varint,1,opt,name=account_id,json=accountId,proto3" json:"account_id,omitempty"`
+	NLastDays int64 `protobuf:"varint,2,opt,name=n_last_days,json=nLastDays,proto3" json:"n_last_days,omitempty"`
+	Limit     int64 `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (m *TransactionsHistoryRequest) Reset()         { *m = TransactionsHistoryRequest{} }
+func (m *TransactionsHistoryRequest) String() string { return proto.CompactTextString(m) }
+func (*TransactionsHistoryRequest) ProtoMessage()    {}
+
+// Transaction holds committed money transfer
+type Transaction struct {
+	TransactionId int64                `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	Timestamp     *timestamp.Timestamp `protobuf:"bytes,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	FromAccountId int64                `protobuf:"varint,3,opt,name=from_account_id,json=fromAccountId,proto3" json:"from_account_id,omitempty"`
+	ToAccountId   int64                `protobuf:"varint,4,opt,name=to_account_id,json=toAccountId,proto3" json:"to_account_id,omitempty"`
+	Amount        int64                `protobuf:"varint,5,opt,name=amount,proto3" json:"amount,omitempty"`
+}
+
+func (m *Transaction) Reset()         { *m = Transaction{} }
+func (m *Transaction) String() string { return proto.CompactTextString(m) }
+func (*Transaction) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*Empty)(nil), "transfers.v1.Empty")
+	proto.RegisterType((*Account)(nil), "transfers.v1.Account")
+	proto.RegisterType((*AccountID)(nil), "transfers.v1.AccountID")
+	proto.RegisterType((*CreateAccountRequest)(nil), "transfers.v1.CreateAccountRequest")
+	proto.RegisterType((*TransferRequest)(nil), "transfers.v1.TransferRequest")
+	proto.RegisterType((*TransactionsHistoryRequest)(nil), "transfers.v1.TransactionsHistoryRequest")
+	proto.RegisterType((*Transaction)(nil), "transfers.v1.Transaction")
+}
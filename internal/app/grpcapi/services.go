@@ -0,0 +1,169 @@
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// AccountsServer is the server API for Accounts service
+type AccountsServer interface {
+	CreateAccount(context.Context, *CreateAccountRequest) (*Account, error)
+	GetAccount(context.Context, *AccountID) (*Account, error)
+	DeleteAccount(context.Context, *AccountID) (*Empty, error)
+}
+
+// RegisterAccountsServer ...
+func RegisterAccountsServer(s *grpc.Server, srv AccountsServer) {
+	s.RegisterService(&accountsServiceDesc, srv)
+}
+
+func accountsCreateAccountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsServer).CreateAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/transfers.v1.Accounts/CreateAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsServer).CreateAccount(ctx, req.(*CreateAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func accountsGetAccountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsServer).GetAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/transfers.v1.Accounts/GetAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsServer).GetAccount(ctx, req.(*AccountID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func accountsDeleteAccountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AccountsServer).DeleteAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/transfers.v1.Accounts/DeleteAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AccountsServer).DeleteAccount(ctx, req.(*AccountID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var accountsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "transfers.v1.Accounts",
+	HandlerType: (*AccountsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "CreateAccount", Handler: accountsCreateAccountHandler},
+		{MethodName: "GetAccount", Handler: accountsGetAccountHandler},
+		{MethodName: "DeleteAccount", Handler: accountsDeleteAccountHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/proto/transfers.proto",
+}
+
+// TransfersServer is the server API for Transfers service
+type TransfersServer interface {
+	TransferMoney(context.Context, *TransferRequest) (*Empty, error)
+}
+
+// RegisterTransfersServer ...
+func RegisterTransfersServer(s *grpc.Server, srv TransfersServer) {
+	s.RegisterService(&transfersServiceDesc, srv)
+}
+
+func transfersTransferMoneyHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransfersServer).TransferMoney(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/transfers.v1.Transfers/TransferMoney",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransfersServer).TransferMoney(ctx, req.(*TransferRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var transfersServiceDesc = grpc.ServiceDesc{
+	ServiceName: "transfers.v1.Transfers",
+	HandlerType: (*TransfersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "TransferMoney", Handler: transfersTransferMoneyHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/proto/transfers.proto",
+}
+
+// TransactionsServer is the server API for Transactions service
+type TransactionsServer interface {
+	GetTransactionsHistory(*TransactionsHistoryRequest, Transactions_GetTransactionsHistoryServer) error
+}
+
+// Transactions_GetTransactionsHistoryServer is the server side of the history stream
+type Transactions_GetTransactionsHistoryServer interface {
+	Send(*Transaction) error
+	grpc.ServerStream
+}
+
+type transactionsGetTransactionsHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *transactionsGetTransactionsHistoryServer) Send(m *Transaction) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// RegisterTransactionsServer ...
+func RegisterTransactionsServer(s *grpc.Server, srv TransactionsServer) {
+	s.RegisterService(&transactionsServiceDesc, srv)
+}
+
+func transactionsGetTransactionsHistoryHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TransactionsHistoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TransactionsServer).GetTransactionsHistory(m, &transactionsGetTransactionsHistoryServer{stream})
+}
+
+var transactionsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "transfers.v1.Transactions",
+	HandlerType: (*TransactionsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetTransactionsHistory",
+			Handler:       transactionsGetTransactionsHistoryHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/proto/transfers.proto",
+}
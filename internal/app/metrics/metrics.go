@@ -0,0 +1,343 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of the metric families
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// ContentType of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are upper bounds of the latency histograms in seconds
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Sample is a single value of the metric along with its label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Family is a named group of samples of the same type, computed at the scrape time
+type Family struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+	// Samples are written in the given order
+	Samples []Sample
+}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mx         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounter registers counter partitioned by the labels
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	r.register(c)
+	return c
+}
+
+// NewHistogram registers histogram partitioned by the labels; buckets are upper bounds in the ascending order
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// RegisterFunc registers function which returns counters or gauges computed at the scrape time,
+// e.g. the stats of the connection pool
+func (r *Registry) RegisterFunc(f func() []Family) {
+	r.register(funcCollector(f))
+}
+
+// WriteTo writes all the metrics in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mx.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mx.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics to the scraper
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		w.WriteHeader(http.StatusOK)
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+// key joins label values into the key of the series
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// CounterVec is the monotonically increasing value per label values
+type CounterVec struct {
+	desc
+	mx     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Add increases the counter of the label values by v, which must not be negative
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+// Inc increases the counter of the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns current value of the counter, used in tests
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if cv, ok := c.values[key]; ok {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mx.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, cv := range c.values {
+		samples = append(samples, Sample{LabelValues: cv.labelValues, Value: cv.value})
+	}
+	c.mx.Unlock()
+	sortSamples(samples)
+	c.writeHeader(w, CounterType)
+	for _, sample := range samples {
+		writeSample(w, c.name, c.labels, sample.LabelValues, sample.Value)
+	}
+}
+
+// HistogramVec counts observations in the configured buckets per label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mx      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// Observe adds the value to the histogram of the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+	// NOTE: counts are kept per bucket and accumulated on write
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Count returns number of the observations of the label values, used in tests
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mx.Lock()
+	values := make([]histogramValue, 0, len(h.values))
+	for _, hv := range h.values {
+		v := *hv
+		v.counts = append([]uint64(nil), hv.counts...)
+		values = append(values, v)
+	}
+	h.mx.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return lessLabels(values[i].labelValues, values[j].labelValues)
+	})
+
+	h.writeHeader(w, HistogramType)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, v := range values {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			writeSample(w, h.name+"_bucket", labels, append(append([]string(nil), v.labelValues...), formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(append([]string(nil), v.labelValues...), "+Inf"), float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labelValues, v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labelValues, float64(v.count))
+	}
+}
+
+type funcCollector func() []Family
+
+func (f funcCollector) write(w *bufio.Writer) {
+	for _, family := range f() {
+		d := desc{name: family.Name, help: family.Help, labels: family.Labels}
+		d.writeHeader(w, family.Type)
+		for _, sample := range family.Samples {
+			writeSample(w, family.Name, family.Labels, sample.LabelValues, sample.Value)
+		}
+	}
+}
+
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return lessLabels(samples[i].LabelValues, samples[j].LabelValues)
+	})
+}
+
+func lessLabels(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabelValue(labelValues[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
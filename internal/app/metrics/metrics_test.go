@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("Counter", func(t *testing.T) {
+		r := NewRegistry()
+		c := r.NewCounter("transfers_total", "Number of transfers.", "outcome")
+		c.Inc("failed")
+		c.Add(2, "completed")
+		c.Inc("completed")
+		var buf bytes.Buffer
+		if _, err := r.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		expected := "# HELP transfers_total Number of transfers.\n" +
+			"# TYPE transfers_total counter\n" +
+			"transfers_total{outcome=\"completed\"} 3\n" +
+			"transfers_total{outcome=\"failed\"} 1\n"
+		if buf.String() != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+		}
+		if c.Value("completed") != 3 {
+			t.Errorf("expected counter value 3, got %v", c.Value("completed"))
+		}
+	})
+
+	t.Run("Histogram", func(t *testing.T) {
+		r := NewRegistry()
+		h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+		for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+			h.Observe(v, "/a")
+		}
+		var buf bytes.Buffer
+		r.WriteTo(&buf)
+		expected := "# HELP latency_seconds Latency.\n" +
+			"# TYPE latency_seconds histogram\n" +
+			"latency_seconds_bucket{route=\"/a\",le=\"0.1\"} 2\n" +
+			"latency_seconds_bucket{route=\"/a\",le=\"1\"} 3\n" +
+			"latency_seconds_bucket{route=\"/a\",le=\"+Inf\"} 4\n" +
+			"latency_seconds_sum{route=\"/a\"} 3.65\n" +
+			"latency_seconds_count{route=\"/a\"} 4\n"
+		if buf.String() != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+		}
+	})
+
+	t.Run("FuncAndEscaping", func(t *testing.T) {
+		r := NewRegistry()
+		r.RegisterFunc(func() []Family {
+			return []Family{{
+				Name:    "pool_connections",
+				Help:    "Open connections,\nper pool.",
+				Type:    GaugeType,
+				Labels:  []string{"pool"},
+				Samples: []Sample{{LabelValues: []string{`a"b\c`}, Value: 2}},
+			}}
+		})
+		var buf bytes.Buffer
+		r.WriteTo(&buf)
+		expected := "# HELP pool_connections Open connections,\\nper pool.\n" +
+			"# TYPE pool_connections gauge\n" +
+			"pool_connections{pool=\"a\\\"b\\\\c\"} 2\n"
+		if buf.String() != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		r := NewRegistry()
+		r.RegisterRuntime()
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Handler().ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Type") != ContentType {
+			t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(rec.Body.String(), "\ngo_goroutines ") {
+			t.Errorf("expected runtime metrics, got:\n%s", rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// RegisterRuntime registers metrics of the Go runtime and the process uptime;
+// memory stats are read once per scrape, since reading them stops the world
+func (r *Registry) RegisterRuntime() {
+	started := time.Now()
+	r.RegisterFunc(func() []Family {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		gauge := func(name, help string, v float64) Family {
+			return Family{Name: name, Help: help, Type: GaugeType, Samples: []Sample{{Value: v}}}
+		}
+		counter := func(name, help string, v float64) Family {
+			return Family{Name: name, Help: help, Type: CounterType, Samples: []Sample{{Value: v}}}
+		}
+		return []Family{
+			{
+				Name:    "go_info",
+				Help:    "Information about the Go environment.",
+				Type:    GaugeType,
+				Labels:  []string{"version"},
+				Samples: []Sample{{LabelValues: []string{runtime.Version()}, Value: 1}},
+			},
+			gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())),
+			gauge("go_sched_gomaxprocs_threads", "Number of OS threads which may execute Go code simultaneously.", float64(runtime.GOMAXPROCS(0))),
+			gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc)),
+			counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc)),
+			gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys)),
+			gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse)),
+			gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects)),
+			counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(ms.Mallocs)),
+			counter("go_memstats_frees_total", "Total number of frees.", float64(ms.Frees)),
+			gauge("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(ms.NextGC)),
+			counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC)),
+			counter("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs)/float64(time.Second)),
+			gauge("process_uptime_seconds", "Time since the metrics registry was created.", time.Since(started).Seconds()),
+		}
+	})
+}
@@ -9,6 +9,8 @@ type Account struct {
 	CreatedAt time.Time
 	AccountID int64
 	Balance   int64
+	// Version is incremented on every change of the balance, starting from 1
+	Version int64
 }
 
 // Transaction holds data needed to perform money transfer
@@ -19,3 +21,97 @@ type Transaction struct {
 	ToAccountID   int64
 	Amount        int64
 }
+
+// Webhook holds info about registered subscriber endpoint
+type Webhook struct {
+	WebhookID int64
+	CreatedAt time.Time
+	URL       string
+	Secret    string
+}
+
+// WebhookDelivery holds the state of a single event delivery attempt series
+type WebhookDelivery struct {
+	DeliveryID int64
+	WebhookID  int64
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	EventType  string
+	Payload    []byte
+	Status     string
+	Attempts   int64
+	LastError  string
+	// NextAttemptAt is the time the pending delivery is due, zero means right away
+	NextAttemptAt time.Time
+}
+
+// Types of the events produced by the state changes
+const (
+	AccountCreatedEvent    = "account.created"
+	AccountDeletedEvent    = "account.deleted"
+	TransferCompletedEvent = "transfer.completed"
+	TransferFailedEvent    = "transfer.failed"
+)
+
+// OutboxEvent holds event committed along with the state change
+type OutboxEvent struct {
+	EventID   int64
+	CreatedAt time.Time
+	EventType string
+	Payload   []byte
+	SentAt    *time.Time
+}
+
+// Actions recorded in the audit log
+const (
+	AuditAccountCreated    = "account.created"
+	AuditAccountDeleted    = "account.deleted"
+	AuditTransferCompleted = "transfer.completed"
+	AuditTransferRejected  = "transfer.rejected"
+	AuditWebhookCreated    = "webhook.created"
+	AuditWebhookDeleted    = "webhook.deleted"
+	AuditBackupCreated     = "backup.created"
+	AuditLogLevelChanged   = "config.log_level_changed"
+	AuditAPIKeyCreated     = "apikey.created"
+	AuditAPIKeyRotated     = "apikey.rotated"
+	AuditAPIKeyRevoked     = "apikey.revoked"
+	AuditSchemaMigrated    = "schema.migrated"
+	AuditDBRestored        = "db.restored"
+)
+
+// AuditEntry is the record of the audit log; every entry holds hash of the previous one,
+// so any change of the recorded history breaks the chain
+type AuditEntry struct {
+	AuditID   int64
+	CreatedAt time.Time
+	Actor     string
+	SourceIP  string
+	RequestID string
+	Action    string
+	Resource  string
+	// Before and After hold json of the changed resource, nil if it didn't exist
+	Before   []byte
+	After    []byte
+	PrevHash string
+	Hash     string
+}
+
+// Scopes of the api keys; admin grants all of them
+const (
+	ScopeAccountsRead    = "accounts:read"
+	ScopeAccountsWrite   = "accounts:write"
+	ScopeTransfersCreate = "transfers:create"
+	ScopeAdmin           = "admin"
+)
+
+// APIKey holds the key of the api client; only hash of the secret is stored,
+// so the key can't be recovered and is shown once, when it's issued or rotated
+type APIKey struct {
+	KeyID      string
+	Name       string
+	Scopes     []string
+	SecretHash string
+	CreatedAt  time.Time
+	RotatedAt  *time.Time
+	RevokedAt  *time.Time
+}
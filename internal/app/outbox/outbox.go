@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+var (
+	relayStoppedErr = errors.New("Outbox relay is stopped")
+)
+
+// Source is the storage which keeps events committed along with the state changes
+type Source interface {
+	GetUnsentEvents(limit int64) ([]models.OutboxEvent, error)
+	MarkEventsSent(eventIds []int64) error
+}
+
+// Publisher delivers single event to the outer world
+type Publisher interface {
+	Publish(event models.OutboxEvent) error
+	// Close releases resources held by the publisher, it's called once the relay is stopped
+	Close() error
+}
+
+// Relay periodically moves events from the outbox to the publisher.
+// Events are published in order and marked as sent only after the successful publication,
+// so every event is delivered at least once and could be deduplicated by its id
+type Relay struct {
+	source    Source
+	publisher Publisher
+	interval  time.Duration
+	batchSize int64
+	onError   func(error)
+	mx        sync.Mutex
+	lastErr   error
+	quit      chan struct{}
+	done      chan struct{}
+	once      sync.Once
+}
+
+// NewRelay creates new instance of Relay
+func NewRelay(source Source, publisher Publisher, interval time.Duration, batchSize int64) *Relay {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &Relay{
+		source:    source,
+		publisher: publisher,
+		interval:  interval,
+		batchSize: batchSize,
+		onError:   func(error) {},
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// OnError sets callback which is called on every failed relay iteration
+func (r *Relay) OnError(f func(error)) {
+	r.onError = f
+}
+
+// Start runs relay loop in background
+func (r *Relay) Start() {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			_, err := r.Flush()
+			r.mx.Lock()
+			r.lastErr = err
+			r.mx.Unlock()
+			if err != nil {
+				r.onError(err)
+			}
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops relay loop, waits for the current iteration to finish and closes the publisher
+func (r *Relay) Stop() {
+	r.once.Do(func() {
+		close(r.quit)
+		<-r.done
+		if err := r.publisher.Close(); err != nil {
+			r.onError(err)
+		}
+	})
+}
+
+// Health returns error of the last relay iteration, nil if it has succeeded
+func (r *Relay) Health() error {
+	select {
+	case <-r.quit:
+		return relayStoppedErr
+	default:
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.lastErr
+}
+
+// Flush publishes pending events until the outbox is empty or publication fails;
+// returns number of published events
+func (r *Relay) Flush() (int, error) {
+	published := 0
+	for {
+		events, err := r.source.GetUnsentEvents(r.batchSize)
+		if err != nil {
+			return published, err
+		}
+		if len(events) == 0 {
+			return published, nil
+		}
+		sent := make([]int64, 0, len(events))
+		var pubErr error
+		for _, event := range events {
+			if pubErr = r.publisher.Publish(event); pubErr != nil {
+				break
+			}
+			sent = append(sent, event.EventID)
+		}
+		if err := r.source.MarkEventsSent(sent); err != nil {
+			return published, err
+		}
+		published += len(sent)
+		if pubErr != nil {
+			return published, pubErr
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+var (
+	eventsCorruptedErr = errors.New("Events corrupted")
+	publishFailedErr   = errors.New("Publish failed")
+)
+
+type memSource struct {
+	mx     sync.Mutex
+	events []models.OutboxEvent
+	sent   map[int64]bool
+}
+
+func newMemSource(n int) *memSource {
+	src := &memSource{sent: make(map[int64]bool)}
+	for i := 1; i <= n; i++ {
+		src.events = append(src.events, models.OutboxEvent{
+			EventID:   int64(i),
+			EventType: models.TransferCompletedEvent,
+			Payload:   []byte(`{"amount":100}`),
+		})
+	}
+	return src
+}
+
+func (m *memSource) GetUnsentEvents(limit int64) ([]models.OutboxEvent, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	res := make([]models.OutboxEvent, 0)
+	for _, event := range m.events {
+		if !m.sent[event.EventID] && int64(len(res)) < limit {
+			res = append(res, event)
+		}
+	}
+	return res, nil
+}
+
+func (m *memSource) MarkEventsSent(eventIds []int64) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, id := range eventIds {
+		m.sent[id] = true
+	}
+	return nil
+}
+
+type flakyPublisher struct {
+	failOn    int64
+	published []int64
+	closed    bool
+}
+
+func (p *flakyPublisher) Publish(event models.OutboxEvent) error {
+	if event.EventID == p.failOn {
+		return publishFailedErr
+	}
+	p.published = append(p.published, event.EventID)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	t.Run("FlushInOrder", func(t *testing.T) {
+		var buf bytes.Buffer
+		src := newMemSource(5)
+		relay := NewRelay(src, NewWriterPublisher(&buf), 0, 2)
+		n, err := relay.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 5 {
+			t.Error(eventsCorruptedErr)
+		}
+		dec := json.NewDecoder(&buf)
+		for i := int64(1); i <= 5; i++ {
+			msg := Message{}
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.EventID != i || msg.Type != models.TransferCompletedEvent {
+				t.Error(eventsCorruptedErr)
+			}
+		}
+	})
+
+	t.Run("StopOnFailure", func(t *testing.T) {
+		src := newMemSource(5)
+		pub := &flakyPublisher{failOn: 3}
+		relay := NewRelay(src, pub, 0, 10)
+		n, err := relay.Flush()
+		if err == nil || n != 2 {
+			t.Fatal(eventsCorruptedErr)
+		}
+		unsent, _ := src.GetUnsentEvents(10)
+		if len(unsent) != 3 || unsent[0].EventID != 3 {
+			t.Error(eventsCorruptedErr)
+		}
+		pub.failOn = 0
+		n, err = relay.Flush()
+		if err != nil || n != 3 {
+			t.Error(eventsCorruptedErr)
+		}
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		src := newMemSource(1)
+		pub := &flakyPublisher{failOn: 1}
+		relay := NewRelay(src, pub, time.Hour, 10)
+		relay.Start()
+		for i := 0; relay.Health() == nil; i++ {
+			if i == 100 {
+				t.Fatal("expected failed iteration to be reported")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !errors.Is(relay.Health(), publishFailedErr) {
+			t.Errorf("expected publish error, got %v", relay.Health())
+		}
+		relay.Stop()
+		if !errors.Is(relay.Health(), relayStoppedErr) {
+			t.Errorf("expected stopped relay, got %v", relay.Health())
+		}
+		if !pub.closed {
+			t.Error("expected publisher to be closed on stop")
+		}
+	})
+
+	t.Run("HTTPPublisher", func(t *testing.T) {
+		ids := make(chan string, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ids <- r.Header.Get(EventIDHeader)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		pub, err := NewPublisher("http", srv.URL, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Publish(models.OutboxEvent{EventID: 7}); err != nil {
+			t.Fatal(err)
+		}
+		if <-ids != "7" {
+			t.Error(eventsCorruptedErr)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// EventIDHeader holds outbox event id, so receivers could drop duplicates
+const EventIDHeader = "X-Outbox-Event-ID"
+
+var (
+	badResponseCodeErr  = errors.New("Publisher endpoint responded with non-2xx status code")
+	unknownPublisherErr = errors.New("Unknown outbox publisher")
+)
+
+// Message is the serialized representation of the outbox event
+type Message struct {
+	EventID   int64           `json:"event_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func newMessage(event models.OutboxEvent) Message {
+	return Message{
+		EventID:   event.EventID,
+		CreatedAt: event.CreatedAt,
+		Type:      event.EventType,
+		Data:      event.Payload,
+	}
+}
+
+// WriterPublisher writes events as json lines
+type WriterPublisher struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterPublisher creates publisher on top of any writer
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewStdoutPublisher creates publisher which prints events to stdout
+func NewStdoutPublisher() *WriterPublisher {
+	return NewWriterPublisher(os.Stdout)
+}
+
+// Publish writes out event
+func (p *WriterPublisher) Publish(event models.OutboxEvent) error {
+	b, err := json.Marshal(newMessage(event))
+	if err != nil {
+		return err
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	_, err = p.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close does nothing, the writer is owned by the caller
+func (p *WriterPublisher) Close() error {
+	return nil
+}
+
+// FilePublisher appends events to the file and syncs it after every write
+type FilePublisher struct {
+	WriterPublisher
+	f *os.File
+}
+
+// NewFilePublisher opens file for appending
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{
+		WriterPublisher: WriterPublisher{w: f},
+		f:               f,
+	}, nil
+}
+
+// Publish writes out event and flushes it to disk
+func (p *FilePublisher) Publish(event models.OutboxEvent) error {
+	if err := p.WriterPublisher.Publish(event); err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
+
+// Close closes underlying file
+func (p *FilePublisher) Close() error {
+	return p.f.Close()
+}
+
+// HTTPPublisher posts events to the endpoint
+type HTTPPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPPublisher creates new instance of HTTPPublisher
+func NewHTTPPublisher(url string, timeout time.Duration) *HTTPPublisher {
+	return &HTTPPublisher{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Publish posts event to the endpoint
+func (p *HTTPPublisher) Publish(event models.OutboxEvent) error {
+	b, err := json.Marshal(newMessage(event))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, strconv.FormatInt(event.EventID, 10))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", badResponseCodeErr, resp.StatusCode)
+	}
+	return nil
+}
+
+// Close closes idle connections to the endpoint
+func (p *HTTPPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// NewPublisher creates publisher by its name: `stdout`, `file` or `http`;
+// target holds file path or url respectively
+func NewPublisher(kind, target string, timeout time.Duration) (Publisher, error) {
+	switch kind {
+	case "stdout":
+		return NewStdoutPublisher(), nil
+	case "file":
+		return NewFilePublisher(target)
+	case "http":
+		return NewHTTPPublisher(target, timeout), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", unknownPublisherErr, kind)
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// Types of the account activity events
+const (
+	BalanceChanged     = "balance.changed"
+	TransactionCreated = "transaction.created"
+	AccountClosed      = "account.closed"
+)
+
+const defaultBufferSize = 64
+
+// Event describes a committed change of the single account
+type Event struct {
+	Type        string
+	AccountID   int64
+	Balance     int64
+	Transaction *models.Transaction
+}
+
+// Subscription receives events of the single account
+type Subscription struct {
+	C         <-chan Event
+	ch        chan Event
+	accountId int64
+	broker    *Broker
+	once      sync.Once
+}
+
+// Unsubscribe detaches subscription from the broker and closes its channel
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		sub.broker.remove(sub)
+	})
+}
+
+// Broker is an in-process pub/sub which fans out account events to the subscribers.
+// Publishing never blocks: events are dropped for subscribers which don't keep up
+type Broker struct {
+	mx         sync.RWMutex
+	bufferSize int
+	subs       map[int64]map[*Subscription]struct{}
+}
+
+// NewBroker creates new instance of Broker
+func NewBroker() *Broker {
+	return &Broker{
+		bufferSize: defaultBufferSize,
+		subs:       make(map[int64]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates subscription on the account events
+func (b *Broker) Subscribe(accountId int64) *Subscription {
+	ch := make(chan Event, b.bufferSize)
+	sub := &Subscription{
+		C:         ch,
+		ch:        ch,
+		accountId: accountId,
+		broker:    b,
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if _, ok := b.subs[accountId]; !ok {
+		b.subs[accountId] = make(map[*Subscription]struct{})
+	}
+	b.subs[accountId][sub] = struct{}{}
+	return sub
+}
+
+func (b *Broker) remove(sub *Subscription) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	subs := b.subs[sub.accountId]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.accountId)
+	}
+	close(sub.ch)
+}
+
+// Publish sends events to the subscribers of the corresponding accounts;
+// nil broker is a valid no-op publisher
+func (b *Broker) Publish(events ...Event) {
+	if b == nil {
+		return
+	}
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	for _, event := range events {
+		for sub := range b.subs[event.AccountID] {
+			select {
+			case sub.ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+// TransferEvents builds events produced by the committed transfer for both accounts
+func TransferEvents(tr models.Transaction, fromBalance, toBalance int64) []Event {
+	return []Event{
+		{Type: TransactionCreated, AccountID: tr.FromAccountID, Balance: fromBalance, Transaction: &tr},
+		{Type: BalanceChanged, AccountID: tr.FromAccountID, Balance: fromBalance},
+		{Type: TransactionCreated, AccountID: tr.ToAccountID, Balance: toBalance, Transaction: &tr},
+		{Type: BalanceChanged, AccountID: tr.ToAccountID, Balance: toBalance},
+	}
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+var (
+	eventCorruptedErr = errors.New("Event corrupted")
+)
+
+func TestBroker(t *testing.T) {
+	t.Run("FanOut", func(t *testing.T) {
+		b := NewBroker()
+		subFrom := b.Subscribe(1)
+		defer subFrom.Unsubscribe()
+		subTo := b.Subscribe(2)
+		defer subTo.Unsubscribe()
+		subOther := b.Subscribe(3)
+		defer subOther.Unsubscribe()
+
+		b.Publish(TransferEvents(models.Transaction{
+			FromAccountID: 1,
+			ToAccountID:   2,
+			Amount:        100,
+		}, 900, 100)...)
+
+		for _, sub := range []*Subscription{subFrom, subTo} {
+			event := <-sub.C
+			if event.Type != TransactionCreated || event.Transaction.Amount != 100 {
+				t.Error(eventCorruptedErr)
+			}
+			event = <-sub.C
+			if event.Type != BalanceChanged || event.Balance == 0 {
+				t.Error(eventCorruptedErr)
+			}
+		}
+		if len(subFrom.C) != 0 || len(subOther.C) != 0 {
+			t.Error(eventCorruptedErr)
+		}
+	})
+
+	t.Run("SlowSubscriber", func(t *testing.T) {
+		b := NewBroker()
+		sub := b.Subscribe(1)
+		for i := 0; i < defaultBufferSize*2; i++ {
+			b.Publish(Event{Type: BalanceChanged, AccountID: 1, Balance: int64(i)})
+		}
+		if len(sub.C) != defaultBufferSize {
+			t.Error(eventCorruptedErr)
+		}
+		sub.Unsubscribe()
+		sub.Unsubscribe()
+		b.Publish(Event{Type: BalanceChanged, AccountID: 1})
+	})
+
+	t.Run("NilBroker", func(t *testing.T) {
+		var b *Broker
+		b.Publish(Event{Type: BalanceChanged, AccountID: 1})
+	})
+}
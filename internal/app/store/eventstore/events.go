@@ -0,0 +1,237 @@
+package eventstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of the events in the log
+const (
+	AccountOpened    = "AccountOpened"
+	FundsTransferred = "FundsTransferred"
+	AccountClosed    = "AccountClosed"
+)
+
+var (
+	unknownEventErr      = errors.New("Unknown event type")
+	eventLogClosedErr    = errors.New("Event log is closed")
+	eventLogFailedErr    = errors.New("Event log has failed, changes are rejected until restart")
+	eventLogCorruptedErr = errors.New("Event log is corrupted")
+)
+
+// Event is a single fact in the log; the state of the store is derived from the events only
+type Event struct {
+	Seq       int64     `json:"seq"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// AccountOpened, AccountClosed
+	AccountID      int64 `json:"account_id,omitempty"`
+	InitialBalance int64 `json:"initial_balance,omitempty"`
+	// FundsTransferred
+	TransactionID int64 `json:"transaction_id,omitempty"`
+	FromAccountID int64 `json:"from_account_id,omitempty"`
+	ToAccountID   int64 `json:"to_account_id,omitempty"`
+	Amount        int64 `json:"amount,omitempty"`
+}
+
+// Log is an append-only sequence of events
+type Log interface {
+	// Append assigns sequence numbers to the events, stores them and returns the stored events
+	Append(events ...Event) ([]Event, error)
+	// Read passes events with seq greater than `after` in the log order, until f returns false
+	Read(after int64, f func(Event) bool) error
+	Close() error
+}
+
+// memoryLog keeps events in memory
+type memoryLog struct {
+	mx     sync.RWMutex
+	events []Event
+}
+
+// NewMemoryLog creates log which is lost on restart, handy for tests
+func NewMemoryLog() Log {
+	return &memoryLog{}
+}
+
+func (l *memoryLog) Append(events ...Event) ([]Event, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	stored := make([]Event, 0, len(events))
+	for _, e := range events {
+		e.Seq = int64(len(l.events)) + 1
+		l.events = append(l.events, e)
+		stored = append(stored, e)
+	}
+	return stored, nil
+}
+
+func (l *memoryLog) Read(after int64, f func(Event) bool) error {
+	l.mx.RLock()
+	events := l.events
+	l.mx.RUnlock()
+	if after < 0 {
+		after = 0
+	}
+	for i := after; i < int64(len(events)); i++ {
+		if !f(events[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *memoryLog) Close() error {
+	return nil
+}
+
+// fileLog keeps events as json lines in the single file, every append is synced
+type fileLog struct {
+	mx      sync.Mutex
+	path    string
+	f       *os.File
+	lastSeq int64
+	// size is the length of the file up to the last complete record
+	size int64
+	// failed holds the error which left the file in unknown state, all the later appends are rejected
+	failed error
+}
+
+// OpenFileLog opens the log file; torn tail (the last line without the newline, left by a crash
+// in the middle of the write) is truncated, any other invalid record means the log is corrupted
+func OpenFileLog(path string) (Log, error) {
+	l := &fileLog{path: path}
+	var offset int64
+	err := l.scan(func(e Event, end int64) bool {
+		l.lastSeq = e.Seq
+		offset = end
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := os.Truncate(path, offset); err != nil {
+			return nil, err
+		}
+	}
+	l.f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.size = offset
+	return l, nil
+}
+
+// scan reads events from the start of the file until the last complete record;
+// f also gets the offset of the record end
+func (l *fileLog) scan(f func(e Event, end int64) bool) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		// NOTE: the line without the newline is either torn or still being written
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// NOTE: events after the invalid one are synced, so it's never cut off
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", eventLogCorruptedErr, offset, err)
+		}
+		offset += int64(len(line))
+		if !f(e, offset) {
+			return nil
+		}
+	}
+}
+
+func (l *fileLog) Append(events ...Event) ([]Event, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.f == nil {
+		return nil, eventLogClosedErr
+	}
+	if l.failed != nil {
+		return nil, fmt.Errorf("%w: %v", eventLogFailedErr, l.failed)
+	}
+
+	var buf []byte
+	stored := make([]Event, 0, len(events))
+	seq := l.lastSeq
+	for _, e := range events {
+		seq++
+		e.Seq = seq
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, b...), '\n')
+		stored = append(stored, e)
+	}
+	// NOTE: all events of the command are written at once, so they are either all in the log or none;
+	// the failed write is cut off, so the rejected command isn't replayed and the next one doesn't follow the torn record
+	if _, err := l.f.Write(buf); err != nil {
+		l.rollback(err)
+		return nil, err
+	}
+	if err := l.f.Sync(); err != nil {
+		// NOTE: after the failed fsync it's unknown what has reached the disk, so the log isn't trusted anymore
+		l.rollback(err)
+		l.failed = err
+		return nil, err
+	}
+	l.size += int64(len(buf))
+	l.lastSeq = seq
+	return stored, nil
+}
+
+// rollback truncates the file to the last complete record; the log is marked as failed if that's not possible
+func (l *fileLog) rollback(cause error) {
+	if err := l.f.Truncate(l.size); err != nil {
+		l.failed = fmt.Errorf("%v, truncate: %v", cause, err)
+	}
+}
+
+func (l *fileLog) Read(after int64, f func(Event) bool) error {
+	l.mx.Lock()
+	lastSeq := l.lastSeq
+	l.mx.Unlock()
+
+	// NOTE: events appended after the read has started are skipped
+	return l.scan(func(e Event, _ int64) bool {
+		if e.Seq > lastSeq {
+			return false
+		}
+		if e.Seq <= after {
+			return true
+		}
+		return f(e)
+	})
+}
+
+func (l *fileLog) Close() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
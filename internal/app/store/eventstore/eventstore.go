@@ -0,0 +1,468 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+)
+
+const (
+	eventLogFileName = "events.log"
+	snapshotFileName = "snapshot.json"
+)
+
+var (
+	accNotFoundErr        = store.AccountNotFoundErr
+	notEnoghMoneyOnAccErr = errors.New("There is no enough money on account to complete a transaction")
+	snapshotCorruptedErr  = errors.New("Projection snapshot is corrupted, the whole event log is replayed")
+)
+
+// projection is the read model built from the events: balances of the open accounts
+// and per-account transactions history ordered by time
+type projection struct {
+	Seq               int64                          `json:"seq"`
+	LastAccountID     int64                          `json:"last_account_id"`
+	LastTransactionID int64                          `json:"last_transaction_id"`
+	Accounts          map[int64]models.Account       `json:"accounts"`
+	History           map[int64][]models.Transaction `json:"history"`
+}
+
+func newProjection() *projection {
+	return &projection{
+		Accounts: make(map[int64]models.Account),
+		History:  make(map[int64][]models.Transaction),
+	}
+}
+
+// apply folds the event into the projection; events are already validated, so it never fails on them
+func (p *projection) apply(e Event) error {
+	switch e.Type {
+	case AccountOpened:
+		p.Accounts[e.AccountID] = models.Account{
+			AccountID: e.AccountID,
+			CreatedAt: e.Timestamp,
+			Balance:   e.InitialBalance,
+			Version:   1,
+		}
+		if e.AccountID > p.LastAccountID {
+			p.LastAccountID = e.AccountID
+		}
+	case AccountClosed:
+		delete(p.Accounts, e.AccountID)
+	case FundsTransferred:
+		from := p.Accounts[e.FromAccountID]
+		from.Balance -= e.Amount
+		from.Version++
+		p.Accounts[e.FromAccountID] = from
+		to := p.Accounts[e.ToAccountID]
+		to.Balance += e.Amount
+		to.Version++
+		p.Accounts[e.ToAccountID] = to
+
+		tr := models.Transaction{
+			TransactionID: e.TransactionID,
+			Timestamp:     e.Timestamp,
+			FromAccountID: e.FromAccountID,
+			ToAccountID:   e.ToAccountID,
+			Amount:        e.Amount,
+		}
+		p.History[e.FromAccountID] = append(p.History[e.FromAccountID], tr)
+		if e.ToAccountID != e.FromAccountID {
+			p.History[e.ToAccountID] = append(p.History[e.ToAccountID], tr)
+		}
+		if e.TransactionID > p.LastTransactionID {
+			p.LastTransactionID = e.TransactionID
+		}
+	default:
+		return unknownEventErr
+	}
+	p.Seq = e.Seq
+	return nil
+}
+
+// Store is the store.Store where the source of truth is the append-only event log;
+// accounts and transactions are projections of the events
+type Store struct {
+	mx            sync.RWMutex
+	log           Log
+	proj          *projection
+	dir           string
+	snapshotEvery int64
+	sinceSnapshot int64
+	onError       func(error)
+	broker        *pubsub.Broker
+}
+
+// Options holds persistence settings of the store
+type Options struct {
+	// SnapshotEvery is the number of events after which the projection snapshot is written, 0 disables snapshotting
+	SnapshotEvery int64
+	// OnError receives errors of the snapshot which don't fail the store: failed write or corrupted file
+	OnError func(error)
+}
+
+// New creates store over the in-memory event log
+func New() *Store {
+	return &Store{
+		log:     NewMemoryLog(),
+		proj:    newProjection(),
+		onError: func(error) {},
+	}
+}
+
+// Open creates store which keeps the event log and projection snapshots in dir;
+// projection is loaded from the last snapshot and caught up with the events after it.
+// Snapshot is written after every `snapshotEvery` events, 0 disables snapshotting
+func Open(dir string, snapshotEvery int64) (*Store, error) {
+	return OpenWithOptions(dir, Options{SnapshotEvery: snapshotEvery})
+}
+
+// OpenWithOptions creates store which keeps the event log and projection snapshots in dir;
+// corrupted snapshot is reported to OnError and the projection is rebuilt from the whole log
+func OpenWithOptions(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	log, err := OpenFileLog(filepath.Join(dir, eventLogFileName))
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		log:           log,
+		proj:          newProjection(),
+		dir:           dir,
+		snapshotEvery: opts.SnapshotEvery,
+		onError:       func(error) {},
+	}
+	if opts.OnError != nil {
+		s.onError = opts.OnError
+	}
+	if err := s.loadSnapshot(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := s.catchUp(s.proj); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetBroker sets pub/sub which receives events after every state change
+func (s *Store) SetBroker(broker *pubsub.Broker) {
+	s.broker = broker
+}
+
+// Close closes the event log
+func (s *Store) Close() {
+	s.log.Close()
+}
+
+// Ping returns error of the context only: the projection is kept in memory
+// and the log is appended on every change, which reports its own errors
+func (s *Store) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// catchUp applies events which are not yet in the projection
+func (s *Store) catchUp(p *projection) error {
+	var applyErr error
+	err := s.log.Read(p.Seq, func(e Event) bool {
+		applyErr = p.apply(e)
+		return applyErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return applyErr
+}
+
+func (s *Store) loadSnapshot() error {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	proj := newProjection()
+	if err := json.Unmarshal(b, proj); err != nil {
+		// NOTE: snapshot is only an optimization, the log holds all the events
+		s.onError(fmt.Errorf("%w: %v", snapshotCorruptedErr, err))
+		return nil
+	}
+	s.proj = proj
+	return nil
+}
+
+// Snapshot writes the projection to disk, so the next start replays only the events after it
+func (s *Store) Snapshot() error {
+	if s.dir == "" {
+		return nil
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.writeSnapshot()
+}
+
+// writeSnapshot atomically replaces the snapshot file: data is written into the temporary file
+// which is synced and renamed, then the directory is synced to make the rename durable;
+// must be called under the write lock
+func (s *Store) writeSnapshot() error {
+	b, err := json.Marshal(s.proj)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, snapshotFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFileName)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Rebuild throws the projection away and replays the whole event log from scratch
+func (s *Store) Rebuild() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	proj := newProjection()
+	if err := s.catchUp(proj); err != nil {
+		return err
+	}
+	s.proj = proj
+	return nil
+}
+
+// AccountAt returns the state of the account at the moment t, replaying the events up to it
+func (s *Store) AccountAt(accId int64, t time.Time) (models.Account, error) {
+	proj := newProjection()
+	var applyErr error
+	err := s.log.Read(0, func(e Event) bool {
+		if e.Timestamp.After(t) {
+			return false
+		}
+		applyErr = proj.apply(e)
+		return applyErr == nil
+	})
+	if err != nil {
+		return models.Account{}, err
+	}
+	if applyErr != nil {
+		return models.Account{}, applyErr
+	}
+	acc, ok := proj.Accounts[accId]
+	if !ok {
+		return models.Account{}, accNotFoundErr
+	}
+	return acc, nil
+}
+
+// Events returns up to `limit` events of the log after the seq, i.e. the full audit trail
+func (s *Store) Events(after, limit int64) ([]Event, error) {
+	events := make([]Event, 0)
+	err := s.log.Read(after, func(e Event) bool {
+		events = append(events, e)
+		return int64(len(events)) < limit
+	})
+	return events, err
+}
+
+// commit appends events to the log and applies them to the projection; must be called under the write lock
+func (s *Store) commit(events ...Event) error {
+	stored, err := s.log.Append(events...)
+	if err != nil {
+		return err
+	}
+	for _, e := range stored {
+		if err := s.proj.apply(e); err != nil {
+			return err
+		}
+	}
+	s.sinceSnapshot += int64(len(stored))
+	if s.snapshotEvery > 0 && s.sinceSnapshot >= s.snapshotEvery {
+		s.sinceSnapshot = 0
+		// NOTE: snapshot is only an optimization, the log is already durable,
+		// so the command doesn't fail if the snapshot can't be written, the error is only reported
+		if err := s.writeSnapshot(); err != nil {
+			s.onError(err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	s.mx.Lock()
+	if err := ctx.Err(); err != nil {
+		s.mx.Unlock()
+		return models.Account{}, err
+	}
+	e := Event{
+		Type:           AccountOpened,
+		Timestamp:      time.Now().Round(0),
+		AccountID:      s.proj.LastAccountID + 1,
+		InitialBalance: balance,
+	}
+	if err := s.commit(e); err != nil {
+		s.mx.Unlock()
+		return models.Account{}, err
+	}
+	acc := s.proj.Accounts[e.AccountID]
+	// NOTE: events are published under the lock, so subscribers get them in the commit order
+	s.broker.Publish(pubsub.Event{
+		Type:      pubsub.BalanceChanged,
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
+	s.mx.Unlock()
+	return acc, nil
+}
+
+func (s *Store) DeleteAccount(ctx context.Context, accId, version int64) error {
+	s.mx.Lock()
+	if err := ctx.Err(); err != nil {
+		s.mx.Unlock()
+		return err
+	}
+	acc, ok := s.proj.Accounts[accId]
+	if !ok {
+		s.mx.Unlock()
+		return accNotFoundErr
+	}
+	if version != store.AnyVersion && acc.Version != version {
+		s.mx.Unlock()
+		return store.VersionConflictErr
+	}
+	err := s.commit(Event{
+		Type:      AccountClosed,
+		Timestamp: time.Now().Round(0),
+		AccountID: accId,
+	})
+	if err != nil {
+		s.mx.Unlock()
+		return err
+	}
+	s.broker.Publish(pubsub.Event{
+		Type:      pubsub.AccountClosed,
+		AccountID: accId,
+	})
+	s.mx.Unlock()
+	return nil
+}
+
+func (s *Store) GetAccount(ctx context.Context, accId int64) (models.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Account{}, err
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	acc, ok := s.proj.Accounts[accId]
+	if !ok {
+		return models.Account{}, accNotFoundErr
+	}
+	return acc, nil
+}
+
+// TransferMoney validates the command against the current projection and records the FundsTransferred event
+func (s *Store) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	s.mx.Lock()
+	// NOTE: commands wait for each other on the lock, so the context is checked after it
+	if err := ctx.Err(); err != nil {
+		s.mx.Unlock()
+		return err
+	}
+	_, toOk := s.proj.Accounts[accountToId]
+	from, fromOk := s.proj.Accounts[accountFromId]
+	if !toOk || !fromOk {
+		s.mx.Unlock()
+		return accNotFoundErr
+	}
+	if from.Balance < amount {
+		s.mx.Unlock()
+		return notEnoghMoneyOnAccErr
+	}
+	e := Event{
+		Type:          FundsTransferred,
+		Timestamp:     time.Now().Round(0),
+		TransactionID: s.proj.LastTransactionID + 1,
+		FromAccountID: accountFromId,
+		ToAccountID:   accountToId,
+		Amount:        amount,
+	}
+	if err := s.commit(e); err != nil {
+		s.mx.Unlock()
+		return err
+	}
+	tr := models.Transaction{
+		TransactionID: e.TransactionID,
+		Timestamp:     e.Timestamp,
+		FromAccountID: e.FromAccountID,
+		ToAccountID:   e.ToAccountID,
+		Amount:        e.Amount,
+	}
+	// NOTE: broker never blocks, so the balance events are published under the lock
+	// and can't be reordered with the ones of the next transfer
+	s.broker.Publish(pubsub.TransferEvents(
+		tr,
+		s.proj.Accounts[accountFromId].Balance,
+		s.proj.Accounts[accountToId].Balance,
+	)...)
+	s.mx.Unlock()
+	return nil
+}
+
+// GetTransactionsHistory returns up to `limit` transactions of the account for the last `nLastdays`, ordered by time
+func (s *Store) GetTransactionsHistory(ctx context.Context, accountId, nLastdays, limit int64) ([]models.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	refTime := time.Now().AddDate(0, 0, -int(nLastdays))
+	history := s.proj.History[accountId]
+	from := sort.Search(len(history), func(i int) bool {
+		return !history[i].Timestamp.Before(refTime)
+	})
+	to := len(history)
+	if limit >= 0 && int64(to-from) > limit {
+		to = from + int(limit)
+	}
+	tr := make([]models.Transaction, to-from)
+	copy(tr, history[from:to])
+	return tr, nil
+}
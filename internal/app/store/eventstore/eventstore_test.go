@@ -0,0 +1,245 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventStore(t *testing.T) {
+	s := New()
+	store.TestStore(s, t)
+	store.TestStoreConcurrentTransfer(s, t)
+
+	broker := pubsub.NewBroker()
+	s.SetBroker(broker)
+	store.TestStoreEventsOrder(s, broker, t)
+}
+
+func TestDurableEventStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "eventstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *Store {
+		s, err := Open(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		s := open()
+		defer s.Close()
+		store.TestStore(s, t)
+		store.TestStoreConcurrentTransfer(s, t)
+	})
+
+	t.Run("RecoveryFromSnapshotAndLog", func(t *testing.T) {
+		s := open()
+		acc1, _ := s.InsertAccount(ctx, 100)
+		acc2, _ := s.InsertAccount(ctx, 0)
+		for i := 0; i < 15; i++ {
+			if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+		if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+			t.Errorf("expected snapshot to be written: %v", err)
+		}
+
+		s = open()
+		defer s.Close()
+		acc, err := s.GetAccount(ctx, acc2.AccountID)
+		if err != nil || acc.Balance != 15 {
+			t.Errorf("expected recovered balance 15, got %v: %v", acc.Balance, err)
+		}
+		tr, _ := s.GetTransactionsHistory(ctx, acc1.AccountID, 1, 100)
+		if len(tr) != 15 {
+			t.Errorf("expected 15 transactions, got %v", len(tr))
+		}
+	})
+
+	t.Run("TornTail", func(t *testing.T) {
+		s := open()
+		acc, _ := s.InsertAccount(ctx, 100)
+		s.Close()
+
+		f, err := os.OpenFile(filepath.Join(dir, eventLogFileName), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"seq":`)
+		f.Close()
+
+		s = open()
+		next, err := s.InsertAccount(ctx, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		for _, accId := range []int64{acc.AccountID, next.AccountID} {
+			if _, err := s.GetAccount(ctx, accId); err != nil {
+				t.Errorf("expected account %v to be recovered: %v", accId, err)
+			}
+		}
+	})
+
+	t.Run("CorruptedRecord", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupted.log")
+		defer os.RemoveAll(path)
+		l, err := OpenFileLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := l.Append(Event{Type: AccountOpened, AccountID: int64(i + 1)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.Close()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupted := append([]byte{'#'}, b[1:]...)
+		if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFileLog(path); !errors.Is(err, eventLogCorruptedErr) {
+			t.Errorf("expected %v, got %v", eventLogCorruptedErr, err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != int64(len(b)) {
+			t.Errorf("expected events after the corrupted one to be kept, got %v: %v", info.Size(), err)
+		}
+	})
+
+	t.Run("FailedAppend", func(t *testing.T) {
+		s := open()
+		acc, _ := s.InsertAccount(ctx, 100)
+		log := s.log.(*fileLog)
+		// NOTE: the record torn by the failed write is cut off, so the next one is appended right after acc
+		log.f.WriteString(`{"seq":`)
+		log.rollback(eventLogClosedErr)
+		next, err := s.InsertAccount(ctx, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readOnly, err := os.Open(filepath.Join(dir, eventLogFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer readOnly.Close()
+		f := log.f
+		log.f = readOnly
+		if _, err := s.InsertAccount(ctx, 5); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+		log.f = f
+		if _, err := s.InsertAccount(ctx, 5); !errors.Is(err, eventLogFailedErr) {
+			t.Errorf("expected log which can't be truncated to reject writes, got %v", err)
+		}
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		for _, accId := range []int64{acc.AccountID, next.AccountID} {
+			if _, err := s.GetAccount(ctx, accId); err != nil {
+				t.Errorf("expected account %v to be recovered: %v", accId, err)
+			}
+		}
+	})
+
+	t.Run("CorruptedSnapshot", func(t *testing.T) {
+		s := open()
+		acc, _ := s.InsertAccount(ctx, 100)
+		s.Close()
+		if err := ioutil.WriteFile(filepath.Join(dir, snapshotFileName), []byte(`{"seq":`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var reported error
+		s, err := OpenWithOptions(dir, Options{
+			SnapshotEvery: 10,
+			OnError:       func(err error) { reported = err },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if !errors.Is(reported, snapshotCorruptedErr) {
+			t.Errorf("expected corrupted snapshot to be reported, got %v", reported)
+		}
+		if got, err := s.GetAccount(ctx, acc.AccountID); err != nil || got.Balance != 100 {
+			t.Errorf("expected account to be replayed from the log, got %v: %v", got, err)
+		}
+	})
+}
+
+func TestProjections(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	acc1, _ := s.InsertAccount(ctx, 100)
+	acc2, _ := s.InsertAccount(ctx, 0)
+	s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 30)
+	beforeClose := time.Now()
+	time.Sleep(time.Millisecond)
+	s.TransferMoney(ctx, acc1.AccountID, acc2.AccountID, 10)
+	s.DeleteAccount(ctx, acc2.AccountID, store.AnyVersion)
+
+	t.Run("Rebuild", func(t *testing.T) {
+		before, _ := s.GetAccount(ctx, acc1.AccountID)
+		if err := s.Rebuild(); err != nil {
+			t.Fatal(err)
+		}
+		after, err := s.GetAccount(ctx, acc1.AccountID)
+		if err != nil || after != before {
+			t.Errorf("expected rebuilt projection to match, got %v and %v: %v", before, after, err)
+		}
+		if _, err := s.GetAccount(ctx, acc2.AccountID); err != accNotFoundErr {
+			t.Error("expected closed account to stay closed after rebuild")
+		}
+	})
+
+	t.Run("TimeTravel", func(t *testing.T) {
+		acc, err := s.AccountAt(acc2.AccountID, beforeClose)
+		if err != nil || acc.Balance != 30 {
+			t.Errorf("expected balance 30 before the account was closed, got %v: %v", acc.Balance, err)
+		}
+		if _, err := s.AccountAt(acc2.AccountID, time.Now()); err != accNotFoundErr {
+			t.Error("expected account to be closed now")
+		}
+	})
+
+	t.Run("AuditTrail", func(t *testing.T) {
+		events, err := s.Events(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := []string{AccountOpened, AccountOpened, FundsTransferred, FundsTransferred, AccountClosed}
+		if len(events) != len(types) {
+			t.Fatalf("expected %v events, got %v", len(types), len(events))
+		}
+		for i, e := range events {
+			if e.Type != types[i] || e.Seq != int64(i+1) {
+				t.Errorf("unexpected event %v", e)
+			}
+		}
+	})
+}
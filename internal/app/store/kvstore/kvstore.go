@@ -1,147 +1,493 @@
 package kvstore
 
 import (
+	"context"
 	"errors"
 	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+	"os"
 	"sort"
 	"sync"
 	"time"
 )
 
 var (
-	accNotFoundErr        = errors.New("Account not found")
+	accNotFoundErr        = store.AccountNotFoundErr
 	notEnoghMoneyOnAccErr = errors.New("There is no enough money on account to complete a transaction")
 )
 
+// lockStripes is the number of mutexes guarding account balances;
+// account is mapped to the stripe by its id, so unrelated transfers rarely contend
+const lockStripes = 256
+
 type ConcurrentAccount struct {
 	models.Account
-	mx sync.RWMutex
 }
 
+// KVStore keeps accounts in the map and transactions in the append-only log,
+// indexed by account in time order.
+// Locks are always taken in the same order to avoid deadlocks:
+// account stripes (by ascending index) -> mx -> txMx.
+// Balance of the account is read and changed only under its stripe lock,
+// account is removed from the map only under its stripe lock too,
+// so the transfer checks and mutates both accounts atomically.
 type KVStore struct {
 	mx               sync.RWMutex
+	stripes          [lockStripes]sync.RWMutex
 	accIncID         int64
-	transactionIncID int64
 	accounts         map[int64]*ConcurrentAccount
-	transactions     map[int64]models.Transaction
+	txMx             sync.RWMutex
+	transactionIncID int64
+	transactions     []models.Transaction
+	history          map[int64][]int
+	broker           *pubsub.Broker
+
+	// persistMx is held for reading by every state change along with its logging,
+	// and for writing by the snapshot, so the snapshot sees the state consistent with the log
+	persistMx  sync.RWMutex
+	snapshotMx sync.Mutex
+	wal        *wal
+	dir        string
+	onError    func(error)
+	// bgErr holds error of the last background fsync or snapshot
+	bgMx      sync.Mutex
+	bgErr     error
+	quit      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Options holds persistence settings of the store
+type Options struct {
+	// Dir keeps the write-ahead log segments and the snapshot
+	Dir string
+	// Fsync is one of FsyncAlways, FsyncInterval or FsyncNever
+	Fsync            string
+	FsyncInterval    time.Duration
+	SnapshotInterval time.Duration
+	// OnError receives errors of the background fsync and snapshotting
+	OnError func(error)
 }
 
 func New() *KVStore {
 	return &KVStore{
-		accounts:     make(map[int64]*ConcurrentAccount),
-		transactions: make(map[int64]models.Transaction),
+		accounts: make(map[int64]*ConcurrentAccount),
+		history:  make(map[int64][]int),
+		onError:  func(error) {},
+		quit:     make(chan struct{}),
 	}
 }
 
-func (s *KVStore) InsertAccount(balance int64) (models.Account, error) {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+// Open creates durable store: state is recovered from the last snapshot
+// and the write-ahead log records after it, then every change is logged before it's applied
+func Open(opts Options) (*KVStore, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	s := New()
+	s.dir = opts.Dir
+	if opts.OnError != nil {
+		s.onError = opts.OnError
+	}
+	snap, err := readSnapshot(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	s.loadSnapshot(snap)
+	lastLSN, err := replaySegments(opts.Dir, snap.LSN, s.applyRecord)
+	if err != nil {
+		return nil, err
+	}
+	s.wal, err = openWal(opts.Dir, opts.Fsync, lastLSN)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Fsync == FsyncInterval && opts.FsyncInterval > 0 {
+		s.runEvery(opts.FsyncInterval, s.wal.sync)
+	}
+	if opts.SnapshotInterval > 0 {
+		s.runEvery(opts.SnapshotInterval, s.Snapshot)
+	}
+	return s, nil
+}
 
-	s.accIncID++
+func (s *KVStore) runEvery(interval time.Duration, f func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				err := f()
+				s.bgMx.Lock()
+				s.bgErr = err
+				s.bgMx.Unlock()
+				if err != nil {
+					s.onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// Ping returns error of the last background fsync or snapshot, since writes
+// of the durable store are not safe once persistence is failing
+func (s *KVStore) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.bgMx.Lock()
+	defer s.bgMx.Unlock()
+	return s.bgErr
+}
+
+// log writes the record ahead of applying the change; no-op for in-memory store
+func (s *KVStore) log(rec walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(rec)
+}
+
+func (s *KVStore) loadSnapshot(snap snapshot) {
+	s.accIncID = snap.AccIncID
+	s.transactionIncID = snap.TransactionIncID
+	for _, acc := range snap.Accounts {
+		s.accounts[acc.AccountID] = &ConcurrentAccount{Account: versioned(acc)}
+	}
+	sort.Slice(snap.Transactions, func(i, j int) bool {
+		return snap.Transactions[i].TransactionID < snap.Transactions[j].TransactionID
+	})
+	for _, tr := range snap.Transactions {
+		s.appendTransaction(tr)
+	}
+}
+
+// versioned sets the initial version of the account persisted before versions were introduced
+func versioned(acc models.Account) models.Account {
+	if acc.Version == 0 {
+		acc.Version = 1
+	}
+	return acc
+}
+
+// applyRecord repeats logged change during the recovery, mirroring the live operations
+func (s *KVStore) applyRecord(rec walRecord) error {
+	switch rec.Op {
+	case opInsertAccount:
+		if rec.Account.AccountID > s.accIncID {
+			s.accIncID = rec.Account.AccountID
+		}
+		s.accounts[rec.Account.AccountID] = &ConcurrentAccount{Account: versioned(*rec.Account)}
+	case opDeleteAccount:
+		delete(s.accounts, rec.AccountID)
+	case opTransfer:
+		tr := *rec.Transaction
+		if acc, ok := s.accounts[tr.FromAccountID]; ok {
+			acc.Balance -= tr.Amount
+			acc.Version++
+		}
+		if acc, ok := s.accounts[tr.ToAccountID]; ok {
+			acc.Balance += tr.Amount
+			acc.Version++
+		}
+		s.transactionIncID = tr.TransactionID
+		s.appendTransaction(tr)
+	default:
+		return unknownWalOpErr
+	}
+	return nil
+}
+
+// Snapshot writes the whole state to disk and drops log segments covered by it
+func (s *KVStore) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.snapshotMx.Lock()
+	defer s.snapshotMx.Unlock()
+
+	s.persistMx.Lock()
+	s.mx.RLock()
+	s.txMx.RLock()
+	snap := snapshot{
+		AccIncID:         s.accIncID,
+		TransactionIncID: s.transactionIncID,
+		Accounts:         make([]models.Account, 0, len(s.accounts)),
+		Transactions:     make([]models.Transaction, 0, len(s.transactions)),
+	}
+	for _, acc := range s.accounts {
+		snap.Accounts = append(snap.Accounts, acc.Account)
+	}
+	snap.Transactions = append(snap.Transactions, s.transactions...)
+	s.txMx.RUnlock()
+	s.mx.RUnlock()
+	lsn, err := s.wal.rotate()
+	s.persistMx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	snap.LSN = lsn
+	if err := writeSnapshot(s.dir, snap); err != nil {
+		return err
+	}
+	return s.wal.removeSegmentsBefore(lsn)
+}
+
+// SetBroker sets pub/sub which receives events after every state change
+func (s *KVStore) SetBroker(broker *pubsub.Broker) {
+	s.broker = broker
+}
+
+func (s *KVStore) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	waitLock(ctx, "persist", s.persistMx.RLock)
+	defer s.persistMx.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return models.Account{}, err
+	}
+
+	s.mx.Lock()
 	acc := &ConcurrentAccount{
 		Account: models.Account{
-			AccountID: s.accIncID,
+			AccountID: s.accIncID + 1,
 			CreatedAt: time.Now(),
 			Balance:   balance,
+			Version:   1,
 		},
 	}
+	if err := s.log(walRecord{Op: opInsertAccount, Account: &acc.Account}); err != nil {
+		s.mx.Unlock()
+		return models.Account{}, err
+	}
+	s.accIncID++
 	s.accounts[s.accIncID] = acc
+	s.mx.Unlock()
+
+	s.broker.Publish(pubsub.Event{
+		Type:      pubsub.BalanceChanged,
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
 	return acc.Account, nil
 }
 
-func (s *KVStore) DeleteAccount(accId int64) error {
-	s.mx.RLock()
-	if _, ok := s.accounts[accId]; !ok {
-		s.mx.RUnlock()
-		return accNotFoundErr
+// stripe returns the lock guarding the account
+func (s *KVStore) stripe(accId int64) *sync.RWMutex {
+	return &s.stripes[uint64(accId)%lockStripes]
+}
+
+// waitLock acquires the lock within the span, so the time spent waiting for it is seen in the trace
+func waitLock(ctx context.Context, name string, lock func()) {
+	_, span := tracing.Start(ctx, "kvstore.lock_wait")
+	span.SetAttribute("lock", name)
+	lock()
+	span.End()
+}
+
+// lockAccounts locks stripes of all passed accounts in ascending order,
+// every stripe is locked once even if it's shared by several accounts
+func (s *KVStore) lockAccounts(ctx context.Context, accIds ...int64) func() {
+	_, span := tracing.Start(ctx, "kvstore.lock_wait")
+	span.SetAttribute("lock", "accounts")
+	defer span.End()
+	idx := make([]int, 0, len(accIds))
+	for _, accId := range accIds {
+		idx = append(idx, int(uint64(accId)%lockStripes))
 	}
-	s.mx.RUnlock()
+	sort.Ints(idx)
+	locked := idx[:0]
+	for i, stripe := range idx {
+		if i > 0 && stripe == idx[i-1] {
+			continue
+		}
+		s.stripes[stripe].Lock()
+		locked = append(locked, stripe)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			s.stripes[locked[i]].Unlock()
+		}
+	}
+}
 
-	s.mx.Lock()
-	defer s.mx.Unlock()
+// DeleteAccount removes account, if its version matches; ids of removed accounts are never reused
+func (s *KVStore) DeleteAccount(ctx context.Context, accId, version int64) error {
+	waitLock(ctx, "persist", s.persistMx.RLock)
+	defer s.persistMx.RUnlock()
+
+	unlock := s.lockAccounts(ctx, accId)
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	s.accIncID--
+	s.mx.Lock()
+	acc, ok := s.accounts[accId]
+	if !ok {
+		s.mx.Unlock()
+		return accNotFoundErr
+	}
+	if version != store.AnyVersion && acc.Version != version {
+		s.mx.Unlock()
+		return store.VersionConflictErr
+	}
+	if err := s.log(walRecord{Op: opDeleteAccount, AccountID: accId}); err != nil {
+		s.mx.Unlock()
+		return err
+	}
 	delete(s.accounts, accId)
+	s.mx.Unlock()
+
+	s.broker.Publish(pubsub.Event{
+		Type:      pubsub.AccountClosed,
+		AccountID: accId,
+	})
 	return nil
 }
 
-func (s *KVStore) GetAccount(accId int64) (models.Account, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
+func (s *KVStore) GetAccount(ctx context.Context, accId int64) (models.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Account{}, err
+	}
+	stripe := s.stripe(accId)
+	waitLock(ctx, "account", stripe.RLock)
+	defer stripe.RUnlock()
 
+	s.mx.RLock()
 	acc, ok := s.accounts[accId]
+	s.mx.RUnlock()
 	if !ok {
 		return models.Account{}, accNotFoundErr
 	}
 	return acc.Account, nil
 }
 
-func (s *KVStore) TransferMoney(accountToId, accountFromId, amount int64) error {
-	s.mx.RLock()
-	accTo, ok := s.accounts[accountToId]
-	if !ok {
-		s.mx.RUnlock()
-		return accNotFoundErr
+// TransferMoney checks the balance, moves the money and appends the transaction
+// while both accounts are locked, so concurrent transfers can't overdraw the account
+func (s *KVStore) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	waitLock(ctx, "persist", s.persistMx.RLock)
+	defer s.persistMx.RUnlock()
+
+	unlock := s.lockAccounts(ctx, accountToId, accountFromId)
+	defer unlock()
+	// NOTE: waiting for the locks could take a while, so the context is checked after it
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	accFrom, ok := s.accounts[accountFromId]
-	if !ok {
-		s.mx.RUnlock()
+
+	s.mx.RLock()
+	accTo, toOk := s.accounts[accountToId]
+	accFrom, fromOk := s.accounts[accountFromId]
+	s.mx.RUnlock()
+	if !toOk || !fromOk {
 		return accNotFoundErr
 	}
-	s.mx.RUnlock()
-
-	accFrom.mx.RLock()
 	if accFrom.Balance < amount {
-		accFrom.mx.RUnlock()
 		return notEnoghMoneyOnAccErr
 	}
-	accFrom.mx.RUnlock()
 
-	accs := []*ConcurrentAccount{accTo, accFrom}
-	sort.Slice(accs, func(i, j int) bool {
-		return accs[i].AccountID < accs[j].AccountID
-	})
-
-	for _, acc := range accs {
-		acc.mx.Lock()
-	}
-	accFrom.Balance -= amount
-	accTo.Balance += amount
-	for _, acc := range accs {
-		acc.mx.Unlock()
-	}
-
-	s.mx.Lock()
-	defer s.mx.Unlock()
-	s.transactionIncID++
-	s.transactions[s.transactionIncID] = models.Transaction{
-		TransactionID: s.transactionIncID,
-		Timestamp:     time.Now(),
+	s.txMx.Lock()
+	tr := models.Transaction{
+		TransactionID: s.transactionIncID + 1,
+		// monotonic clock reading is stripped, so the index order is the same after recovery
+		Timestamp:     time.Now().Round(0),
 		FromAccountID: accFrom.AccountID,
 		ToAccountID:   accTo.AccountID,
 		Amount:        amount,
 	}
+	if err := s.log(walRecord{Op: opTransfer, Transaction: &tr}); err != nil {
+		s.txMx.Unlock()
+		return err
+	}
+	s.transactionIncID++
+	s.appendTransaction(tr)
+	s.txMx.Unlock()
+
+	accFrom.Balance -= amount
+	accFrom.Version++
+	accTo.Balance += amount
+	accTo.Version++
+
+	s.broker.Publish(pubsub.TransferEvents(tr, accFrom.Balance, accTo.Balance)...)
 	return nil
 }
 
-func (s *KVStore) GetTransactionsHistory(accountId, nLastdays, limit int64) ([]models.Transaction, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-
-	limConv := int(limit)
-	nLastdaysConv := int(nLastdays)
-	tr := make([]models.Transaction, 0)
-	refTime := time.Now().AddDate(0, 0, -nLastdaysConv)
-	// NOTE: here I used just run the full scan against all transactions
-	for _, v := range s.transactions {
-		accountIDMatches := v.ToAccountID == accountId || v.FromAccountID == accountId
-		dateMatches := v.Timestamp.After(refTime)
-		if accountIDMatches && dateMatches {
-			tr = append(tr, v)
-		}
-		if len(tr) >= limConv {
-			break
+// transactionBefore defines the order of the history index: by time, then by id
+func transactionBefore(a, b models.Transaction) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.TransactionID < b.TransactionID
+	}
+	return a.Timestamp.Before(b.Timestamp)
+}
+
+// appendTransaction adds transaction to the log and to the history of both accounts.
+// Transactions usually come in time order, so index entry is just appended;
+// otherwise (e.g. the clock went back) it's inserted to keep the index sorted
+func (s *KVStore) appendTransaction(tr models.Transaction) {
+	pos := len(s.transactions)
+	s.transactions = append(s.transactions, tr)
+
+	accIds := []int64{tr.FromAccountID}
+	if tr.ToAccountID != tr.FromAccountID {
+		accIds = append(accIds, tr.ToAccountID)
+	}
+	for _, accId := range accIds {
+		index := s.history[accId]
+		i := len(index)
+		if i > 0 && transactionBefore(tr, s.transactions[index[i-1]]) {
+			i = sort.Search(len(index), func(j int) bool {
+				return transactionBefore(tr, s.transactions[index[j]])
+			})
 		}
+		index = append(index, 0)
+		copy(index[i+1:], index[i:])
+		index[i] = pos
+		s.history[accId] = index
+	}
+}
+
+// GetTransactionsHistory returns up to `limit` transactions of the account
+// for the last `nLastdays`, ordered by time; lookup is O(log n + limit)
+func (s *KVStore) GetTransactionsHistory(ctx context.Context, accountId, nLastdays, limit int64) ([]models.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.txMx.RLock()
+	defer s.txMx.RUnlock()
+
+	refTime := time.Now().AddDate(0, 0, -int(nLastdays))
+	index := s.history[accountId]
+	from := sort.Search(len(index), func(i int) bool {
+		return !s.transactions[index[i]].Timestamp.Before(refTime)
+	})
+	to := len(index)
+	if limit >= 0 && int64(to-from) > limit {
+		to = from + int(limit)
+	}
+	tr := make([]models.Transaction, 0, to-from)
+	for _, pos := range index[from:to] {
+		tr = append(tr, s.transactions[pos])
 	}
 	return tr, nil
 }
+
+// Close stops background routines and closes the write-ahead log;
+// it's a no-op for the in-memory store and safe to call more than once
+func (s *KVStore) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		s.wg.Wait()
+		if s.wal != nil {
+			if err := s.wal.close(); err != nil {
+				s.onError(err)
+			}
+		}
+	})
+}
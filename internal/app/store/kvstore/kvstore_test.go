@@ -1,12 +1,449 @@
 package kvstore
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gasparian/money-transfers-api/internal/app/models"
 	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
+// stressTransfers runs randomized concurrent transfers between the accounts
+// and checks that money is neither created nor lost
+func stressTransfers(s *KVStore, t *testing.T, accounts []models.Account, workers, transfersPerWorker int) {
+	ctx := context.Background()
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+
+	var total int64
+	initial := make(map[int64]int64, len(accounts))
+	for _, acc := range accounts {
+		total += acc.Balance
+		initial[acc.AccountID] = acc.Balance
+	}
+
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	succeeded := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			for i := 0; i < transfersPerWorker; i++ {
+				from := accounts[rnd.Intn(len(accounts))].AccountID
+				to := accounts[rnd.Intn(len(accounts))].AccountID
+				if from == to {
+					continue
+				}
+				err := s.TransferMoney(ctx, to, from, rnd.Int63n(total/int64(len(accounts))))
+				if err == nil {
+					mx.Lock()
+					succeeded++
+					mx.Unlock()
+				} else if err != notEnoghMoneyOnAccErr {
+					t.Error(err)
+					return
+				}
+			}
+		}(rand.New(rand.NewSource(seed + int64(w))))
+	}
+	wg.Wait()
+
+	var sum int64
+	transactions := make(map[int64]models.Transaction)
+	for _, acc := range accounts {
+		current, err := s.GetAccount(ctx, acc.AccountID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Balance < 0 {
+			t.Errorf("account %v is overdrawn: %v", acc.AccountID, current.Balance)
+		}
+		sum += current.Balance
+
+		history, err := s.GetTransactionsHistory(ctx, acc.AccountID, 1, int64(workers*transfersPerWorker))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := initial[acc.AccountID]
+		for _, tr := range history {
+			transactions[tr.TransactionID] = tr
+			if tr.ToAccountID == acc.AccountID {
+				expected += tr.Amount
+			}
+			if tr.FromAccountID == acc.AccountID {
+				expected -= tr.Amount
+			}
+		}
+		if expected != current.Balance {
+			t.Errorf("balance of account %v doesn't match its history: %v != %v", acc.AccountID, current.Balance, expected)
+		}
+	}
+	if sum != total {
+		t.Errorf("money is not conserved: %v != %v", sum, total)
+	}
+	if len(transactions) != succeeded {
+		t.Errorf("expected %v transactions, got %v", succeeded, len(transactions))
+	}
+}
+
 func TestKVStore(t *testing.T) {
 	s := New()
 	store.TestStore(s, t)
 	store.TestStoreConcurrentTransfer(s, t)
 }
+
+func TestKVStoreConcurrency(t *testing.T) {
+	ctx := context.Background()
+	t.Run("RandomTransfers", func(t *testing.T) {
+		s := New()
+		accounts := make([]models.Account, 0, 20)
+		for i := 0; i < 20; i++ {
+			acc, err := s.InsertAccount(ctx, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accounts = append(accounts, acc)
+		}
+		stressTransfers(s, t, accounts, 32, 500)
+	})
+
+	t.Run("IDsNotReused", func(t *testing.T) {
+		s := New()
+		acc1, _ := s.InsertAccount(ctx, 0)
+		acc2, _ := s.InsertAccount(ctx, 0)
+		if err := s.DeleteAccount(ctx, acc2.AccountID, store.AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteAccount(ctx, acc1.AccountID, store.AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		acc3, _ := s.InsertAccount(ctx, 0)
+		if acc3.AccountID <= acc2.AccountID {
+			t.Errorf("account id %v is reused", acc3.AccountID)
+		}
+	})
+
+	t.Run("DeleteDuringTransfers", func(t *testing.T) {
+		s := New()
+		from, _ := s.InsertAccount(ctx, 100000)
+		to, _ := s.InsertAccount(ctx, 0)
+
+		var wg sync.WaitGroup
+		var transferred int64
+		var mx sync.Mutex
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					err := s.TransferMoney(ctx, to.AccountID, from.AccountID, 10)
+					if err == nil {
+						mx.Lock()
+						transferred += 10
+						mx.Unlock()
+					} else if err != accNotFoundErr {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		deleted := 0
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.DeleteAccount(ctx, to.AccountID, store.AnyVersion); err == nil {
+					mx.Lock()
+					deleted++
+					mx.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if deleted != 1 {
+			t.Errorf("expected account to be deleted once, got %v", deleted)
+		}
+		acc, err := s.GetAccount(ctx, from.AccountID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc.Balance != from.Balance-transferred {
+			t.Errorf("money debited from account without transfer: %v != %v", acc.Balance, from.Balance-transferred)
+		}
+	})
+}
+
+func TestKVStoreHistoryIndex(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	acc1, _ := s.InsertAccount(ctx, 0)
+	acc2, _ := s.InsertAccount(ctx, 0)
+	now := time.Now()
+	// transactions are added out of time order, as if the clock went back
+	for i, daysAgo := range []int{5, 1, 3, 0, 10, 2} {
+		s.appendTransaction(models.Transaction{
+			TransactionID: int64(i + 1),
+			Timestamp:     now.AddDate(0, 0, -daysAgo),
+			FromAccountID: acc1.AccountID,
+			ToAccountID:   acc2.AccountID,
+			Amount:        int64(daysAgo),
+		})
+	}
+
+	t.Run("Sorted", func(t *testing.T) {
+		tr, err := s.GetTransactionsHistory(ctx, acc2.AccountID, 30, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tr) != 6 {
+			t.Fatalf("expected 6 transactions, got %v", len(tr))
+		}
+		for i := 1; i < len(tr); i++ {
+			if tr[i].Timestamp.Before(tr[i-1].Timestamp) {
+				t.Errorf("history is not sorted: %v", tr)
+			}
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		tr, _ := s.GetTransactionsHistory(ctx, acc1.AccountID, 4, 100)
+		if len(tr) != 4 || tr[0].Amount != 3 || tr[3].Amount != 0 {
+			t.Errorf("expected transactions of the last 4 days, got %v", tr)
+		}
+		tr, _ = s.GetTransactionsHistory(ctx, acc1.AccountID, 4, 2)
+		if len(tr) != 2 || tr[0].Amount != 3 || tr[1].Amount != 2 {
+			t.Errorf("expected 2 oldest transactions of the last 4 days, got %v", tr)
+		}
+		tr, _ = s.GetTransactionsHistory(ctx, acc2.AccountID+1, 30, 100)
+		if len(tr) != 0 {
+			t.Errorf("expected empty history, got %v", tr)
+		}
+	})
+}
+
+func TestDurableKVStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *KVStore {
+		s, err := Open(Options{Dir: dir, Fsync: FsyncAlways})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		s := open()
+		defer s.Close()
+		store.TestStore(s, t)
+		store.TestStoreConcurrentTransfer(s, t)
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		s := open()
+		acc1, _ := s.InsertAccount(ctx, 100)
+		acc2, _ := s.InsertAccount(ctx, 0)
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 30); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		acc, err := s.GetAccount(ctx, acc2.AccountID)
+		if err != nil || acc.Balance != 30 {
+			t.Errorf("expected recovered balance 30, got %v: %v", acc.Balance, err)
+		}
+		tr, err := s.GetTransactionsHistory(ctx, acc1.AccountID, 1, 10)
+		if err != nil || len(tr) != 1 {
+			t.Errorf("expected recovered transaction, got %v: %v", tr, err)
+		}
+	})
+
+	t.Run("SnapshotAndReplay", func(t *testing.T) {
+		s := open()
+		acc1, _ := s.InsertAccount(ctx, 100)
+		if err := s.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		acc2, _ := s.InsertAccount(ctx, 0)
+		s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 60)
+		s.Close()
+
+		segments, _ := listSegments(dir)
+		if len(segments) != 1 {
+			t.Errorf("expected segments before snapshot to be removed, got %v", segments)
+		}
+
+		s = open()
+		defer s.Close()
+		from, _ := s.GetAccount(ctx, acc1.AccountID)
+		to, _ := s.GetAccount(ctx, acc2.AccountID)
+		if from.Balance != 40 || to.Balance != 60 {
+			t.Errorf("expected balances 40 and 60, got %v and %v", from.Balance, to.Balance)
+		}
+		acc3, _ := s.InsertAccount(ctx, 0)
+		if acc3.AccountID != acc2.AccountID+1 {
+			t.Errorf("expected id sequence to be recovered, got %v", acc3.AccountID)
+		}
+	})
+
+	t.Run("TornTail", func(t *testing.T) {
+		s := open()
+		acc, _ := s.InsertAccount(ctx, 100)
+		s.Close()
+
+		segments, _ := listSegments(dir)
+		path := filepath.Join(dir, segments[len(segments)-1])
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`1234abcd {"lsn":`)
+		f.Close()
+
+		s = open()
+		if _, err := s.GetAccount(ctx, acc.AccountID); err != nil {
+			t.Error(err)
+		}
+		next, err := s.InsertAccount(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		if _, err := s.GetAccount(ctx, next.AccountID); err != nil {
+			t.Errorf("expected record written after truncated tail to be recovered: %v", err)
+		}
+	})
+
+	t.Run("CorruptedRecord", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "kvstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := Open(Options{Dir: dir, Fsync: FsyncAlways})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := s.InsertAccount(ctx, 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+
+		segments, _ := listSegments(dir)
+		path := filepath.Join(dir, segments[len(segments)-1])
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: balance of the first account is changed, so the crc doesn't match
+		first := bytes.IndexByte(b, '\n')
+		corrupted := bytes.Replace(b[:first], []byte(`"Balance":100`), []byte(`"Balance":900`), 1)
+		if first < 0 || bytes.Equal(corrupted, b[:first]) {
+			t.Fatalf("expected the first record to hold the account, got %q", b)
+		}
+		if err := ioutil.WriteFile(path, append(corrupted, b[first:]...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Open(Options{Dir: dir, Fsync: FsyncAlways}); !errors.Is(err, walCorruptedErr) {
+			t.Errorf("expected %v, got %v", walCorruptedErr, err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != int64(len(b)) {
+			t.Errorf("expected records after the corrupted one to be kept, got %v: %v", info.Size(), err)
+		}
+	})
+
+	t.Run("FailedAppend", func(t *testing.T) {
+		s := open()
+		acc, _ := s.InsertAccount(ctx, 100)
+		// NOTE: the record torn by the failed write is cut off, so the next one is appended right after acc
+		s.wal.f.WriteString(`1234abcd {"lsn":`)
+		s.wal.rollback(walCorruptedErr)
+		if info, err := s.wal.f.Stat(); err != nil || info.Size() != s.wal.size {
+			t.Fatalf("expected torn record to be truncated, got %v: %v", info.Size(), err)
+		}
+		next, err := s.InsertAccount(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segments, _ := listSegments(dir)
+		readOnly, err := os.Open(filepath.Join(dir, segments[len(segments)-1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer readOnly.Close()
+		f := s.wal.f
+		s.wal.f = readOnly
+		if _, err := s.InsertAccount(ctx, 10); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+		s.wal.f = f
+		if _, err := s.InsertAccount(ctx, 10); !errors.Is(err, walFailedErr) {
+			t.Errorf("expected log which can't be truncated to reject writes, got %v", err)
+		}
+		s.Close()
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		for _, accId := range []int64{acc.AccountID, next.AccountID} {
+			if _, err := s.GetAccount(ctx, accId); err != nil {
+				t.Errorf("expected account %v to be recovered: %v", accId, err)
+			}
+		}
+	})
+
+	t.Run("RandomTransfersRecovery", func(t *testing.T) {
+		s := open()
+		accounts := make([]models.Account, 0, 10)
+		for i := 0; i < 10; i++ {
+			acc, _ := s.InsertAccount(ctx, 1000)
+			accounts = append(accounts, acc)
+		}
+		stressTransfers(s, t, accounts, 8, 50)
+		balances := make(map[int64]int64, len(accounts))
+		for _, acc := range accounts {
+			acc, _ = s.GetAccount(ctx, acc.AccountID)
+			balances[acc.AccountID] = acc.Balance
+		}
+		s.Close()
+
+		s = open()
+		defer s.Close()
+		for accId, balance := range balances {
+			acc, err := s.GetAccount(ctx, accId)
+			if err != nil || acc.Balance != balance {
+				t.Errorf("expected recovered balance %v of account %v, got %v: %v", balance, accId, acc.Balance, err)
+			}
+		}
+	})
+
+	t.Run("UnknownFsyncPolicy", func(t *testing.T) {
+		if _, err := Open(Options{Dir: dir, Fsync: "sometimes"}); err == nil {
+			t.Error("expected unknown fsync policy error")
+		}
+	})
+}
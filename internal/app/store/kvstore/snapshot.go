@@ -0,0 +1,76 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+const snapshotFileName = "snapshot.json"
+
+// snapshot holds the whole store state up to the lsn
+type snapshot struct {
+	LSN              uint64               `json:"lsn"`
+	AccIncID         int64                `json:"acc_inc_id"`
+	TransactionIncID int64                `json:"transaction_inc_id"`
+	Accounts         []models.Account     `json:"accounts"`
+	Transactions     []models.Transaction `json:"transactions"`
+}
+
+// readSnapshot returns empty snapshot if there is no file yet
+func readSnapshot(dir string) (snapshot, error) {
+	var snap snapshot
+	b, err := ioutil.ReadFile(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	err = json.Unmarshal(b, &snap)
+	return snap, err
+}
+
+// writeSnapshot atomically replaces the snapshot file:
+// data is written into the temporary file which is synced and renamed
+func writeSnapshot(dir string, snap snapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, snapshotFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotFileName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,315 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// Fsync policies of the write-ahead log
+const (
+	// FsyncAlways syncs the log before every operation is acknowledged
+	FsyncAlways = "always"
+	// FsyncInterval syncs the log in background, so the last interval could be lost on crash
+	FsyncInterval = "interval"
+	// FsyncNever leaves flushing to the OS
+	FsyncNever = "never"
+)
+
+const (
+	opInsertAccount = "insert_account"
+	opDeleteAccount = "delete_account"
+	opTransfer      = "transfer"
+
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+)
+
+var (
+	unknownFsyncPolicyErr = errors.New("Unknown fsync policy")
+	walCorruptedErr       = errors.New("Write-ahead log is corrupted")
+	unknownWalOpErr       = errors.New("Unknown write-ahead log operation")
+	walFailedErr          = errors.New("Write-ahead log has failed, changes are rejected until restart")
+)
+
+// walRecord is a single logged state change
+type walRecord struct {
+	LSN         uint64              `json:"lsn"`
+	Op          string              `json:"op"`
+	Account     *models.Account     `json:"account,omitempty"`
+	AccountID   int64               `json:"account_id,omitempty"`
+	Transaction *models.Transaction `json:"transaction,omitempty"`
+}
+
+// wal is an append-only log split into segments; every segment is named
+// after the first lsn it may contain and every line is prefixed with crc32 of the record
+type wal struct {
+	mx    sync.Mutex
+	dir   string
+	fsync string
+	f     *os.File
+	// size is the length of the current segment up to the last complete record
+	size  int64
+	lsn   uint64
+	dirty bool
+	// failed holds the error which left the log in unknown state, all the later appends are rejected
+	failed error
+}
+
+func segmentName(firstLSN uint64) string {
+	return fmt.Sprintf("%s%020d%s", walSegmentPrefix, firstLSN, walSegmentSuffix)
+}
+
+// listSegments returns segments sorted by their first lsn
+func listSegments(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, walSegmentPrefix) && strings.HasSuffix(name, walSegmentSuffix) {
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func segmentFirstLSN(name string) uint64 {
+	lsn, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix), 10, 64)
+	return lsn
+}
+
+func encodeRecord(rec walRecord) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(b)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(b))...)
+	line = append(line, b...)
+	return append(line, '\n'), nil
+}
+
+func decodeRecord(line []byte) (walRecord, bool) {
+	var rec walRecord
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	if len(line) < 10 || line[8] != ' ' {
+		return rec, false
+	}
+	crc, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || uint32(crc) != crc32.ChecksumIEEE(line[9:]) {
+		return rec, false
+	}
+	if err := json.Unmarshal(line[9:], &rec); err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+// replaySegments passes records with lsn greater than `after` to apply;
+// torn tail of the last segment (the record without the newline left by crash in the middle of write)
+// is truncated, any other invalid record means the log is corrupted
+func replaySegments(dir string, after uint64, apply func(walRecord) error) (uint64, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	lastLSN := after
+	for i, name := range segments {
+		path := filepath.Join(dir, name)
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		reader := bufio.NewReader(f)
+		var offset int64
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				break
+			}
+			if err != nil && err != io.EOF {
+				f.Close()
+				return 0, err
+			}
+			if err == io.EOF {
+				f.Close()
+				if i != len(segments)-1 {
+					return 0, fmt.Errorf("%w: %s at offset %d", walCorruptedErr, name, offset)
+				}
+				if err := os.Truncate(path, offset); err != nil {
+					return 0, err
+				}
+				return lastLSN, nil
+			}
+			// NOTE: records after the invalid one are acknowledged, so it's never cut off
+			rec, ok := decodeRecord(line)
+			if !ok {
+				f.Close()
+				return 0, fmt.Errorf("%w: %s at offset %d", walCorruptedErr, name, offset)
+			}
+			offset += int64(len(line))
+			if rec.LSN <= after {
+				continue
+			}
+			if err := apply(rec); err != nil {
+				f.Close()
+				return 0, err
+			}
+			lastLSN = rec.LSN
+		}
+		f.Close()
+	}
+	return lastLSN, nil
+}
+
+// openWal opens the last segment for appending or creates the new one
+func openWal(dir, fsync string, lastLSN uint64) (*wal, error) {
+	switch fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("%w: %s", unknownFsyncPolicyErr, fsync)
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	name := segmentName(lastLSN + 1)
+	if len(segments) > 0 {
+		name = segments[len(segments)-1]
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{
+		dir:   dir,
+		fsync: fsync,
+		f:     f,
+		size:  info.Size(),
+		lsn:   lastLSN,
+	}, nil
+}
+
+// append assigns next lsn to the record and writes it out.
+// Failed write is cut off the segment, so the record the caller hasn't applied
+// is never replayed and the next record doesn't follow the torn one
+func (w *wal) append(rec walRecord) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.failed != nil {
+		return fmt.Errorf("%w: %v", walFailedErr, w.failed)
+	}
+	rec.LSN = w.lsn + 1
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(line); err != nil {
+		w.rollback(err)
+		return err
+	}
+	if w.fsync == FsyncAlways {
+		if err := w.f.Sync(); err != nil {
+			// NOTE: after the failed fsync it's unknown what has reached the disk, so the log isn't trusted anymore
+			w.rollback(err)
+			w.failed = err
+			return err
+		}
+	} else {
+		w.dirty = true
+	}
+	w.size += int64(len(line))
+	w.lsn = rec.LSN
+	return nil
+}
+
+// rollback truncates the segment to the last complete record;
+// the log is marked as failed if that's not possible
+func (w *wal) rollback(cause error) {
+	if err := w.f.Truncate(w.size); err != nil {
+		w.failed = fmt.Errorf("%v, truncate: %v", cause, err)
+	}
+}
+
+// sync flushes written records to disk if there are any
+func (w *wal) sync() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	if err := w.f.Sync(); err != nil {
+		w.failed = err
+		return err
+	}
+	return nil
+}
+
+// rotate starts the new segment and returns the last lsn of the previous one
+func (w *wal) rotate() (uint64, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err := w.f.Sync(); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(w.lsn+1)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	w.f.Close()
+	w.f = f
+	w.size = 0
+	w.dirty = false
+	return w.lsn, nil
+}
+
+// removeSegmentsBefore deletes segments which hold only records up to the lsn
+func (w *wal) removeSegmentsBefore(lsn uint64) error {
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(segments)-1; i++ {
+		if segmentFirstLSN(segments[i+1]) <= lsn+1 {
+			if err := os.Remove(filepath.Join(w.dir, segments[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,354 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	_ "github.com/lib/pq"
+)
+
+var (
+	accNotFoundErr        = store.AccountNotFoundErr
+	notEnoghMoneyOnAccErr = errors.New("There is no enough money on account to complete a transaction")
+)
+
+// Store object holds postgres connection pool
+type Store struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+	broker       *pubsub.Broker
+	// publishMx makes commit and publication of its events one step,
+	// so subscribers get events in the commit order
+	publishMx sync.Mutex
+}
+
+func newDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// New connects to the db and creates needed tables
+func New(dsn string, queryTimeout uint32) (*Store, error) {
+	db, err := newDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		db:           db,
+		queryTimeout: time.Duration(queryTimeout) * time.Second,
+	}
+	if err := s.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetBroker sets pub/sub which receives events after every committed change
+func (s *Store) SetBroker(broker *pubsub.Broker) {
+	s.broker = broker
+}
+
+// Close closes underlying connection pool
+func (s *Store) Close() {
+	s.db.Close()
+}
+
+func (s *Store) createTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS account (
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			account_id BIGSERIAL PRIMARY KEY,
+			balance BIGINT NOT NULL,
+			CHECK(balance >= 0)
+		)`,
+		`CREATE TABLE IF NOT EXISTS transactions (
+			transaction_id BIGSERIAL PRIMARY KEY,
+			timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			from_account_id BIGINT NOT NULL,
+			to_account_id BIGINT NOT NULL,
+			amount BIGINT NOT NULL,
+			CHECK(amount >= 0)
+		)`,
+		`ALTER TABLE account ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1`,
+		`CREATE INDEX IF NOT EXISTS idx_from_account_id ON transactions(from_account_id, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_to_account_id ON transactions(to_account_id, timestamp)`,
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Ping checks that the db is reachable
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// PoolStats returns stats of the connection pool
+func (s *Store) PoolStats() map[string]sql.DBStats {
+	return map[string]sql.DBStats{"primary": s.db.Stats()}
+}
+
+// dropTable removes table from the db
+// non-exposed method, because of potential sql-injections
+func (s *Store) dropTable(tableName string) error {
+	_, err := s.db.Exec(
+		fmt.Sprintf(
+			"DROP TABLE IF EXISTS %s",
+			tableName,
+		),
+	)
+	return err
+}
+
+// InsertAccount inserts new account into the accounts table and returns Account model
+func (s *Store) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	var acc models.Account
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return acc, err
+	}
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO account(balance) VALUES ($1) RETURNING created_at, account_id, balance, version",
+		balance,
+	).Scan(
+		&acc.CreatedAt,
+		&acc.AccountID,
+		&acc.Balance,
+		&acc.Version,
+	)
+	if err != nil {
+		tx.Rollback()
+		return acc, err
+	}
+	err = s.commitAndPublish(tx, pubsub.Event{
+		Type:      pubsub.BalanceChanged,
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
+	return acc, err
+}
+
+// DeleteAccount removes account from the accounts table, if its version matches
+func (s *Store) DeleteAccount(ctx context.Context, accId, version int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM account WHERE account_id=$1 AND ($2=0 OR version=$2)",
+		accId,
+		version,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM account WHERE account_id=$1)", accId).Scan(&exists)
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return store.VersionConflictErr
+		}
+		return accNotFoundErr
+	}
+	return s.commitAndPublish(tx, pubsub.Event{
+		Type:      pubsub.AccountClosed,
+		AccountID: accId,
+	})
+}
+
+// GetAccount returns account model
+func (s *Store) GetAccount(ctx context.Context, accId int64) (models.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	var acc models.Account
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT created_at, account_id, balance, version FROM account WHERE account_id=$1",
+		accId,
+	).Scan(
+		&acc.CreatedAt,
+		&acc.AccountID,
+		&acc.Balance,
+		&acc.Version,
+	)
+	if err == sql.ErrNoRows {
+		return acc, accNotFoundErr
+	}
+	return acc, err
+}
+
+// TransferMoney transfers money from one account to another; writes transfer info into the transfers table.
+// Both account rows are locked in the order of their ids, so concurrent opposite transfers can't deadlock,
+// and the balance is checked while the lock is held
+func (s *Store) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT account_id, balance FROM account
+		WHERE account_id IN ($1, $2) ORDER BY account_id FOR UPDATE`,
+		accountFromId,
+		accountToId,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	balances := make(map[int64]int64, 2)
+	for rows.Next() {
+		var accId, balance int64
+		if err := rows.Scan(&accId, &balance); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		balances[accId] = balance
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	fromBalance, fromOk := balances[accountFromId]
+	toBalance, toOk := balances[accountToId]
+	if !fromOk || !toOk {
+		tx.Rollback()
+		return accNotFoundErr
+	}
+	if fromBalance < amount {
+		tx.Rollback()
+		return notEnoghMoneyOnAccErr
+	}
+
+	updateBalanceQuery := "UPDATE account SET balance = balance + $1, version = version + 1 WHERE account_id=$2"
+	if _, err := tx.ExecContext(ctx, updateBalanceQuery, -amount, accountFromId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, updateBalanceQuery, amount, accountToId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tr := models.Transaction{
+		FromAccountID: accountFromId,
+		ToAccountID:   accountToId,
+		Amount:        amount,
+	}
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO transactions(from_account_id, to_account_id, amount)
+		VALUES ($1, $2, $3) RETURNING transaction_id, timestamp`,
+		accountFromId,
+		accountToId,
+		amount,
+	).Scan(&tr.TransactionID, &tr.Timestamp)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.commitAndPublish(tx, pubsub.TransferEvents(tr, fromBalance-amount, toBalance+amount)...)
+}
+
+// commitAndPublish commits the transaction and publishes its events under the same lock,
+// so events of concurrent changes can't be reordered between the commit and the publication
+func (s *Store) commitAndPublish(tx *sql.Tx, events ...pubsub.Event) error {
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.broker.Publish(events...)
+	return nil
+}
+
+// GetTransactionsHistory retunrs array of transcations for the requested period of time
+func (s *Store) GetTransactionsHistory(ctx context.Context, accountId, nLastdays, limit int64) ([]models.Transaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT transaction_id, timestamp, from_account_id, to_account_id, amount FROM transactions
+		WHERE timestamp >= NOW() - make_interval(days => $2) AND
+		(from_account_id=$1 OR to_account_id=$1)
+		ORDER BY timestamp, transaction_id LIMIT $3`,
+		accountId,
+		nLastdays,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []models.Transaction
+	for rows.Next() {
+		tmpRecord := models.Transaction{}
+		err := rows.Scan(
+			&tmpRecord.TransactionID,
+			&tmpRecord.Timestamp,
+			&tmpRecord.FromAccountID,
+			&tmpRecord.ToAccountID,
+			&tmpRecord.Amount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tmpRecord)
+	}
+	return res, rows.Err()
+}
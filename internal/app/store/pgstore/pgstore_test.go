@@ -0,0 +1,37 @@
+package pgstore
+
+import (
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"os"
+	"testing"
+)
+
+// TestPgStore runs shared store suites against the local postgres instance,
+// e.g. POSTGRES_TEST_DSN="postgres://postgres@localhost:5432/postgres?sslmode=disable"
+func TestPgStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	s, err := New(dsn, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, table := range []string{"account", "transactions"} {
+		if err := s.dropTable(table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.createTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.TestStore(s, t)
+	store.TestStoreConcurrentTransfer(s, t)
+
+	broker := pubsub.NewBroker()
+	s.SetBroker(broker)
+	store.TestStoreEventsOrder(s, broker, t)
+}
@@ -0,0 +1,226 @@
+package shardstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+var (
+	crashErr = errors.New("Simulated crash")
+)
+
+// transferLegs splits the transfer into the debit of the sender and the credit of the recipient
+func transferLegs(tr sqlstore.TransferLeg) (debit, credit sqlstore.TransferLeg) {
+	debit, credit = tr, tr
+	debit.AccountID = tr.FromAccountID
+	credit.AccountID = tr.ToAccountID
+	return debit, credit
+}
+
+func (s *Store) logTransfer(ctx context.Context, tr sqlstore.TransferLeg) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.coordinator.ExecContext(
+		ctx,
+		`INSERT INTO transfer_log(transaction_id, timestamp, from_account_id, to_account_id, amount, state)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		tr.TransactionID,
+		tr.Timestamp.Format(time.RFC3339Nano),
+		tr.FromAccountID,
+		tr.ToAccountID,
+		tr.Amount,
+		stateStarted,
+	)
+	return err
+}
+
+func (s *Store) setState(transactionId int64, state string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	_, err := s.coordinator.ExecContext(
+		ctx,
+		`UPDATE transfer_log SET state=?, updated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')
+		WHERE transaction_id=?`,
+		state,
+		transactionId,
+	)
+	return err
+}
+
+// crash reports whether the test asked to stop the transfer at the state
+func (s *Store) crash(state string) bool {
+	return s.crashAt == state
+}
+
+// transferCrossShard runs the two-phase commit:
+// the transfer is logged as started, both shards prepare their legs and, if both succeeded,
+// the decision to commit is logged before any shard applies it. Everything logged as started
+// but not decided is aborted on recovery, so the decision record is the commit point.
+// Context of the caller limits only the prepare phase: once started, the transfer is always
+// brought to the end, so legs are never left in doubt because the client has gone
+func (s *Store) transferCrossShard(ctx context.Context, tr sqlstore.TransferLeg) error {
+	s.mx.Lock()
+	s.active[tr.TransactionID] = struct{}{}
+	s.mx.Unlock()
+	defer func() {
+		s.mx.Lock()
+		delete(s.active, tr.TransactionID)
+		s.mx.Unlock()
+	}()
+
+	if err := s.logTransfer(ctx, tr); err != nil {
+		return err
+	}
+	debit, credit := transferLegs(tr)
+	err := s.shard(debit.AccountID).Prepare(ctx, debit)
+	if err == nil {
+		err = s.shard(credit.AccountID).Prepare(ctx, credit)
+	}
+	if s.crash(stateStarted) {
+		return crashErr
+	}
+	if err != nil {
+		if abortErr := s.abort(tr); abortErr != nil {
+			return fmt.Errorf("%v, abort failed: %w", err, abortErr)
+		}
+		return err
+	}
+
+	if err := s.setState(tr.TransactionID, stateCommitting); err != nil {
+		// NOTE: the decision isn't durable, so it's still safe to abort
+		if abortErr := s.abort(tr); abortErr != nil {
+			return fmt.Errorf("%v, abort failed: %w", err, abortErr)
+		}
+		return err
+	}
+	if s.crash(stateCommitting) {
+		return crashErr
+	}
+	if err := s.commit(tr); err != nil {
+		return fmt.Errorf("%w: %v", transferInDoubtErr, err)
+	}
+	s.publishTransfer(tr)
+	return nil
+}
+
+// commit applies the committed transfer on both shards; it's idempotent, so it's repeated until it succeeds
+func (s *Store) commit(tr sqlstore.TransferLeg) error {
+	for _, accId := range []int64{tr.FromAccountID, tr.ToAccountID} {
+		if err := s.shard(accId).CommitPrepared(context.Background(), tr.TransactionID); err != nil {
+			return err
+		}
+	}
+	return s.setState(tr.TransactionID, stateCommitted)
+}
+
+// abort rolls back prepared legs of the transfer, if any
+func (s *Store) abort(tr sqlstore.TransferLeg) error {
+	if err := s.setState(tr.TransactionID, stateAborting); err != nil {
+		return err
+	}
+	for _, accId := range []int64{tr.FromAccountID, tr.ToAccountID} {
+		if err := s.shard(accId).AbortPrepared(context.Background(), tr.TransactionID); err != nil {
+			return err
+		}
+	}
+	return s.setState(tr.TransactionID, stateAborted)
+}
+
+func (s *Store) publishTransfer(tr sqlstore.TransferLeg) {
+	if s.broker == nil {
+		return
+	}
+	from, err := s.shard(tr.FromAccountID).GetAccount(context.Background(), tr.FromAccountID)
+	if err != nil {
+		return
+	}
+	to, err := s.shard(tr.ToAccountID).GetAccount(context.Background(), tr.ToAccountID)
+	if err != nil {
+		return
+	}
+	transaction := models.Transaction{
+		TransactionID: tr.TransactionID,
+		Timestamp:     tr.Timestamp,
+		FromAccountID: tr.FromAccountID,
+		ToAccountID:   tr.ToAccountID,
+		Amount:        tr.Amount,
+	}
+	s.broker.Publish(pubsub.TransferEvents(transaction, from.Balance, to.Balance)...)
+}
+
+// Recover finishes transfers interrupted by the crash or left in doubt by failures:
+// committed ones are applied to the shards, the ones without the decision are aborted.
+// Transfers still run by this process are skipped
+func (s *Store) Recover() error {
+	pending, err := s.pendingTransfers()
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		s.mx.Lock()
+		_, active := s.active[p.tr.TransactionID]
+		s.mx.Unlock()
+		if active {
+			continue
+		}
+		if p.state == stateCommitting {
+			if err = s.commit(p.tr); err == nil {
+				s.publishTransfer(p.tr)
+			}
+		} else {
+			err = s.abort(p.tr)
+		}
+		if err != nil {
+			return fmt.Errorf("recovery of the transfer %v: %w", p.tr.TransactionID, err)
+		}
+	}
+	return nil
+}
+
+type pendingTransfer struct {
+	tr    sqlstore.TransferLeg
+	state string
+}
+
+func (s *Store) pendingTransfers() ([]pendingTransfer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.coordinator.QueryContext(
+		ctx,
+		`SELECT transaction_id, timestamp, from_account_id, to_account_id, amount, state
+		FROM transfer_log WHERE state IN (?, ?, ?) ORDER BY transaction_id`,
+		stateStarted,
+		stateCommitting,
+		stateAborting,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingTransfer
+	for rows.Next() {
+		var (
+			p  pendingTransfer
+			ts string
+		)
+		err := rows.Scan(&p.tr.TransactionID, &ts, &p.tr.FromAccountID, &p.tr.ToAccountID, &p.tr.Amount, &p.state)
+		if err != nil {
+			return nil, err
+		}
+		if p.tr.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
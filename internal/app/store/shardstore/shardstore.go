@@ -0,0 +1,359 @@
+package shardstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+)
+
+// States of the cross-shard transfer in the coordinator log
+const (
+	stateStarted    = "started"
+	stateCommitting = "committing"
+	stateAborting   = "aborting"
+	stateCommitted  = "committed"
+	stateAborted    = "aborted"
+)
+
+var (
+	noShardsErr           = errors.New("At least one shard is required")
+	shardsCountChangedErr = errors.New("Number of shards differs from the one the data was partitioned with")
+	transferInDoubtErr    = errors.New("Transfer is committed but not yet applied to all shards")
+)
+
+// recoveryInterval is the period of retries of the transfers left in doubt by failures at runtime
+const recoveryInterval = 10 * time.Second
+
+var coordinatorSchema = []string{
+	`CREATE TABLE IF NOT EXISTS shards (
+		id INTEGER NOT NULL PRIMARY KEY CHECK(id = 1),
+		count INTEGER NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS account_seq (
+		account_id INTEGER PRIMARY KEY AUTOINCREMENT
+	);`,
+	`CREATE TABLE IF NOT EXISTS transaction_seq (
+		transaction_id INTEGER PRIMARY KEY AUTOINCREMENT
+	);`,
+	`CREATE TABLE IF NOT EXISTS transfer_log (
+		transaction_id INTEGER NOT NULL PRIMARY KEY,
+		timestamp TEXT NOT NULL,
+		from_account_id INTEGER NOT NULL,
+		to_account_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		state TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+	);`,
+	`CREATE INDEX IF NOT EXISTS idx_transfer_log_pending ON transfer_log(state)
+		WHERE state IN ('started', 'committing', 'aborting')`,
+}
+
+// Store partitions accounts across several sqlite stores by account id.
+// Account ids are allocated by the coordinator db, so they are unique across the shards, and
+// the shard of the account is derived from its id. Operations on a single account and transfers
+// within a shard go directly to the shard, while cross-shard transfers run the two-phase commit
+// with the coordinator db as the durable log of the decisions.
+// Transaction ids are partitioned: every shard allocates ids of its own residue modulo
+// the number of shards + 1 for the transfers within it, and the coordinator allocates the rest
+// for the cross-shard ones, so only cross-shard transfers touch the coordinator
+type Store struct {
+	coordinator  *sql.DB
+	shards       []*sqlstore.Store
+	queryTimeout time.Duration
+	broker       *pubsub.Broker
+	// idBase is the first id of the coordinator partition, it's above every id recorded before the start
+	idBase int64
+	mx     sync.Mutex
+	// active holds cross-shard transfers run by this process, so the recovery doesn't resolve them midway
+	active  map[int64]struct{}
+	onError func(error)
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+	// crashAt stops the transfer at the given state as if the process died, used in tests
+	crashAt string
+}
+
+// Open opens the coordinator db and the shards, creating them if needed,
+// and resolves transfers left in doubt by the previous run; transfers which fail
+// after the decision at runtime are retried in background
+func Open(coordinatorPath string, shardPaths []string, queryTimeout uint32, opts sqlstore.Options) (*Store, error) {
+	if len(shardPaths) == 0 {
+		return nil, noShardsErr
+	}
+	// NOTE: every decision of the coordinator must survive the power loss
+	coordinator, err := sql.Open(
+		sqlstore.TracedDriverName,
+		fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL&_synchronous=FULL&_txlock=immediate", coordinatorPath, opts.BusyTimeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	coordinator.SetMaxOpenConns(1)
+	s := &Store{
+		coordinator:  coordinator,
+		queryTimeout: time.Duration(queryTimeout) * time.Second,
+		active:       make(map[int64]struct{}),
+		onError:      func(error) {},
+		quit:         make(chan struct{}),
+	}
+	if err := s.initCoordinator(len(shardPaths)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	// replica is a single-db feature, shards don't share it
+	opts.ReplicaPath = ""
+	for _, path := range shardPaths {
+		shard, err := sqlstore.NewWithOptions(path, queryTimeout, opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, shard)
+	}
+	if err := s.Recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.partitionTransactionIDs(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.recoveryLoop(recoveryInterval)
+	return s, nil
+}
+
+// partitionTransactionIDs sets up the id partitions above every transaction id recorded so far,
+// so ids allocated before the partitioning, or with another shards count, are never reused
+func (s *Store) partitionTransactionIDs() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	var floor int64
+	err := s.coordinator.QueryRowContext(ctx, "SELECT IFNULL(MAX(transaction_id), 0) FROM transfer_log").Scan(&floor)
+	if err != nil {
+		return err
+	}
+	for _, shard := range s.shards {
+		last, err := shard.LastTransactionID(ctx)
+		if err != nil {
+			return err
+		}
+		if last > floor {
+			floor = last
+		}
+	}
+	stride := int64(len(s.shards)) + 1
+	for i, shard := range s.shards {
+		shard.PartitionTransactionIDs(stride, int64(i)+1, floor)
+	}
+	s.idBase = (floor/stride + 1) * stride
+	return nil
+}
+
+// OnError sets callback which receives errors of the background recovery
+func (s *Store) OnError(f func(error)) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.onError = f
+}
+
+// recoveryLoop periodically retries transfers left in doubt, e.g. when the shard was unavailable
+// while the decision was applied
+func (s *Store) recoveryLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			if err := s.Recover(); err != nil {
+				s.mx.Lock()
+				onError := s.onError
+				s.mx.Unlock()
+				onError(err)
+			}
+		}
+	}
+}
+
+func (s *Store) initCoordinator(shardsCount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.coordinator.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, q := range coordinatorSchema {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO shards(id, count) VALUES (1, ?)", shardsCount)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT count FROM shards").Scan(&count); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count != shardsCount {
+		tx.Rollback()
+		return fmt.Errorf("%w: %v, got %v", shardsCountChangedErr, count, shardsCount)
+	}
+	return tx.Commit()
+}
+
+// SetBroker sets pub/sub which receives events after every committed change
+func (s *Store) SetBroker(broker *pubsub.Broker) {
+	s.broker = broker
+	for _, shard := range s.shards {
+		shard.SetBroker(broker)
+	}
+}
+
+// Close stops the background recovery and closes the shards and the coordinator db
+func (s *Store) Close() {
+	s.once.Do(func() {
+		close(s.quit)
+		s.wg.Wait()
+		for _, shard := range s.shards {
+			shard.Close()
+		}
+		s.coordinator.Close()
+	})
+}
+
+// Ping checks the coordinator db and every shard
+func (s *Store) Ping(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var count int
+	if err := s.coordinator.QueryRowContext(pingCtx, "SELECT count FROM shards").Scan(&count); err != nil {
+		return err
+	}
+	for i, shard := range s.shards {
+		if err := shard.Ping(ctx); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// PoolStats returns stats of the coordinator pool and of the shard pools prefixed with the shard number
+func (s *Store) PoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"coordinator": s.coordinator.Stats()}
+	for i, shard := range s.shards {
+		for name, st := range shard.PoolStats() {
+			stats[fmt.Sprintf("shard_%d_%s", i, name)] = st
+		}
+	}
+	return stats
+}
+
+// SchemaVersion returns the lowest schema version of the shards
+func (s *Store) SchemaVersion() (int, error) {
+	lowest := sqlstore.LatestSchemaVersion()
+	for i, shard := range s.shards {
+		version, err := shard.SchemaVersion()
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+		if version < lowest {
+			lowest = version
+		}
+	}
+	return lowest, nil
+}
+
+// shard returns the store which holds the account
+func (s *Store) shard(accId int64) *sqlstore.Store {
+	if accId < 1 {
+		return s.shards[0]
+	}
+	return s.shards[(accId-1)%int64(len(s.shards))]
+}
+
+// nextID allocates the next id of the sequence; rows are removed right away,
+// since AUTOINCREMENT never reuses ids
+func (s *Store) nextID(ctx context.Context, table string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.coordinator.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO "+table+" DEFAULT VALUES")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *Store) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	accId, err := s.nextID(ctx, "account_seq")
+	if err != nil {
+		return models.Account{}, err
+	}
+	return s.shard(accId).InsertAccountWithID(ctx, accId, balance)
+}
+
+func (s *Store) DeleteAccount(ctx context.Context, accId, version int64) error {
+	return s.shard(accId).DeleteAccount(ctx, accId, version)
+}
+
+func (s *Store) GetAccount(ctx context.Context, accId int64) (models.Account, error) {
+	return s.shard(accId).GetAccount(ctx, accId)
+}
+
+// GetTransactionsHistory reads the shard of the account only:
+// cross-shard transactions are recorded on both sides
+func (s *Store) GetTransactionsHistory(ctx context.Context, accountId, nLastdays, limit int64) ([]models.Transaction, error) {
+	return s.shard(accountId).GetTransactionsHistory(ctx, accountId, nLastdays, limit)
+}
+
+// TransferMoney transfers money within the shard directly, with the id allocated by the shard,
+// and via the two-phase commit with the id allocated by the coordinator otherwise
+func (s *Store) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	from, to := s.shard(accountFromId), s.shard(accountToId)
+	if from == to {
+		return from.TransferMoney(ctx, accountToId, accountFromId, amount)
+	}
+	seq, err := s.nextID(ctx, "transaction_seq")
+	if err != nil {
+		return err
+	}
+	transactionId := s.idBase + seq*(int64(len(s.shards))+1)
+	return s.transferCrossShard(ctx, sqlstore.TransferLeg{
+		TransactionID: transactionId,
+		FromAccountID: accountFromId,
+		ToAccountID:   accountToId,
+		Amount:        amount,
+		Timestamp:     time.Now().UTC(),
+	})
+}
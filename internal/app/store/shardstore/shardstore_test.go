@@ -0,0 +1,217 @@
+package shardstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"github.com/gasparian/money-transfers-api/internal/app/store/sqlstore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openShards(t *testing.T, dir string, n int) *Store {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("shard-%v.db", i))
+	}
+	s, err := Open(filepath.Join(dir, "coordinator.db"), paths, 10, sqlstore.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "shardstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestShardStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openShards(t, dir, 3)
+	defer s.Close()
+	store.TestStore(s, t)
+	store.TestStoreConcurrentTransfer(s, t)
+}
+
+func TestCrossShardTransfer(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openShards(t, dir, 2)
+	defer s.Close()
+
+	acc1, _ := s.InsertAccount(ctx, 100)
+	acc2, _ := s.InsertAccount(ctx, 0)
+	acc3, _ := s.InsertAccount(ctx, 0)
+	if s.shard(acc1.AccountID) == s.shard(acc2.AccountID) || s.shard(acc1.AccountID) != s.shard(acc3.AccountID) {
+		t.Fatalf("expected accounts to be spread across shards: %v, %v, %v", acc1, acc2, acc3)
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 30); err != nil {
+			t.Fatal(err)
+		}
+		// same shard, direct transfer
+		if err := s.TransferMoney(ctx, acc3.AccountID, acc1.AccountID, 10); err != nil {
+			t.Fatal(err)
+		}
+		for accId, balance := range map[int64]int64{acc1.AccountID: 60, acc2.AccountID: 30, acc3.AccountID: 10} {
+			if acc, err := s.GetAccount(ctx, accId); err != nil || acc.Balance != balance {
+				t.Errorf("expected balance %v of account %v, got %v: %v", balance, accId, acc.Balance, err)
+			}
+		}
+		from, _ := s.GetTransactionsHistory(ctx, acc1.AccountID, 1, 100)
+		to, _ := s.GetTransactionsHistory(ctx, acc2.AccountID, 1, 100)
+		if len(from) != 2 || len(to) != 1 || from[0].TransactionID != to[0].TransactionID {
+			t.Errorf("expected cross-shard transaction on both sides, got %v and %v", from, to)
+		}
+		if from[0].TransactionID == from[1].TransactionID {
+			t.Errorf("expected unique transaction ids across shards, got %v", from)
+		}
+		// NOTE: only the cross-shard transfer takes its id from the coordinator partition
+		stride := int64(len(s.shards)) + 1
+		for _, tr := range from {
+			crossShard := s.shard(tr.FromAccountID) != s.shard(tr.ToAccountID)
+			if crossShard != (tr.TransactionID%stride == 0) {
+				t.Errorf("expected transaction %v to be allocated from its partition", tr)
+			}
+		}
+	})
+
+	t.Run("AbortOnFailedPrepare", func(t *testing.T) {
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 1000); err == nil {
+			t.Error("expected not enough money error")
+		}
+		if err := s.TransferMoney(ctx, 100, acc1.AccountID, 10); err == nil {
+			t.Error("expected missing recipient error")
+		}
+		if acc, _ := s.GetAccount(ctx, acc1.AccountID); acc.Balance != 60 {
+			t.Errorf("expected aborted transfers to keep the balance, got %v", acc.Balance)
+		}
+		for _, shard := range s.shards {
+			if ids, err := shard.PreparedTransactions(); err != nil || len(ids) != 0 {
+				t.Errorf("expected no prepared transfers left, got %v: %v", ids, err)
+			}
+		}
+	})
+
+	t.Run("ShardsCountChanged", func(t *testing.T) {
+		paths := []string{filepath.Join(dir, "shard-0.db")}
+		_, err := Open(filepath.Join(dir, "coordinator.db"), paths, 10, sqlstore.DefaultOptions())
+		if !errors.Is(err, shardsCountChangedErr) {
+			t.Errorf("expected shards count error, got %v", err)
+		}
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openShards(t, dir, 2)
+	acc1, _ := s.InsertAccount(ctx, 100)
+	acc2, _ := s.InsertAccount(ctx, 0)
+
+	checkBalances := func(s *Store, from, to int64) {
+		t.Helper()
+		accFrom, _ := s.GetAccount(ctx, acc1.AccountID)
+		accTo, _ := s.GetAccount(ctx, acc2.AccountID)
+		if accFrom.Balance != from || accTo.Balance != to {
+			t.Errorf("expected balances %v and %v, got %v and %v", from, to, accFrom.Balance, accTo.Balance)
+		}
+	}
+
+	t.Run("AbortUndecided", func(t *testing.T) {
+		s.crashAt = stateStarted
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 40); err != crashErr {
+			t.Fatalf("expected crash, got %v", err)
+		}
+		// money is reserved while the transfer is in doubt
+		checkBalances(s, 60, 0)
+		if err := s.DeleteAccount(ctx, acc2.AccountID, store.AnyVersion); err == nil {
+			t.Error("expected account with prepared transfer not to be deleted")
+		}
+		s.Close()
+
+		s = openShards(t, dir, 2)
+		checkBalances(s, 100, 0)
+	})
+
+	t.Run("CommitDecided", func(t *testing.T) {
+		s.crashAt = stateCommitting
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 40); err != crashErr {
+			t.Fatalf("expected crash, got %v", err)
+		}
+		checkBalances(s, 60, 0)
+		s.Close()
+
+		s = openShards(t, dir, 2)
+		defer s.Close()
+		checkBalances(s, 60, 40)
+		tr, _ := s.GetTransactionsHistory(ctx, acc2.AccountID, 1, 100)
+		if len(tr) != 1 || tr[0].Amount != 40 {
+			t.Errorf("expected recovered transaction in the history, got %v", tr)
+		}
+		pending, err := s.pendingTransfers()
+		if err != nil || len(pending) != 0 {
+			t.Errorf("expected no pending transfers, got %v: %v", pending, err)
+		}
+	})
+
+	t.Run("RetryInDoubt", func(t *testing.T) {
+		s = openShards(t, dir, 2)
+		defer s.Close()
+		s.crashAt = stateCommitting
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 10); err != crashErr {
+			t.Fatalf("expected crash, got %v", err)
+		}
+		s.crashAt = ""
+		pending, err := s.pendingTransfers()
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("expected transfer in doubt, got %v: %v", pending, err)
+		}
+
+		// transfer still run by the process is left to it
+		s.active[pending[0].tr.TransactionID] = struct{}{}
+		if err := s.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		checkBalances(s, 50, 40)
+		delete(s.active, pending[0].tr.TransactionID)
+
+		if err := s.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		checkBalances(s, 50, 50)
+		if pending, err := s.pendingTransfers(); err != nil || len(pending) != 0 {
+			t.Errorf("expected no pending transfers, got %v: %v", pending, err)
+		}
+	})
+
+	t.Run("IDsAboveRecorded", func(t *testing.T) {
+		s = openShards(t, dir, 2)
+		defer s.Close()
+		before, _ := s.GetTransactionsHistory(ctx, acc1.AccountID, 1, 100)
+		if err := s.TransferMoney(ctx, acc2.AccountID, acc1.AccountID, 1); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := s.GetTransactionsHistory(ctx, acc1.AccountID, 1, 100)
+		last := after[len(after)-1].TransactionID
+		for _, tr := range before {
+			if tr.TransactionID >= last {
+				t.Errorf("expected new id %v to be above the recorded ones, got %v", last, tr.TransactionID)
+			}
+		}
+	})
+}
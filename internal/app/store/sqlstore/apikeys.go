@@ -0,0 +1,178 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+)
+
+const apiKeyColumns = "key_id, name, scopes, secret_hash, created_at, rotated_at, revoked_at"
+
+// auditAPIKey is the state of the api key recorded in the audit log, the hash is left out
+type auditAPIKey struct {
+	KeyID     string     `json:"key_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func apiKeyState(key models.APIKey) auditAPIKey {
+	return auditAPIKey{
+		KeyID:     key.KeyID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		RotatedAt: key.RotatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+func apiKeyResource(keyId string) string {
+	return "apikey:" + keyId
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (models.APIKey, error) {
+	var (
+		key    models.APIKey
+		scopes string
+	)
+	err := row.Scan(
+		&key.KeyID,
+		&key.Name,
+		&scopes,
+		&key.SecretHash,
+		&key.CreatedAt,
+		&key.RotatedAt,
+		&key.RevokedAt,
+	)
+	if err == sql.ErrNoRows {
+		return key, store.APIKeyNotFoundErr
+	}
+	key.Scopes = strings.Fields(scopes)
+	return key, err
+}
+
+func getAPIKey(ctx context.Context, tx *sql.Tx, keyId string) (models.APIKey, error) {
+	return scanAPIKey(tx.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_key WHERE key_id=?", keyId))
+}
+
+// InsertAPIKey stores the new api key, key id and the hash of its secret are generated by the caller
+func (s *Store) InsertAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return key, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO api_key(key_id, name, scopes, secret_hash) VALUES (?, ?, ?, ?)",
+		key.KeyID,
+		key.Name,
+		strings.Join(key.Scopes, " "),
+		key.SecretHash,
+	)
+	if err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	if key, err = getAPIKey(ctx, tx, key.KeyID); err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	if err := appendAudit(ctx, tx, models.AuditAPIKeyCreated, apiKeyResource(key.KeyID), nil, apiKeyState(key)); err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	return key, tx.Commit()
+}
+
+// GetAPIKey returns the api key, revoked keys are returned too
+func (s *Store) GetAPIKey(ctx context.Context, keyId string) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	return scanAPIKey(s.readDB.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_key WHERE key_id=?", keyId))
+}
+
+// ListAPIKeys returns all issued api keys, oldest first
+func (s *Store) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_key ORDER BY created_at, key_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]models.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, key)
+	}
+	return res, rows.Err()
+}
+
+// updateAPIKey applies the change to the active api key and records it in the audit log
+func (s *Store) updateAPIKey(ctx context.Context, action, keyId, query string, args ...interface{}) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	before, err := getAPIKey(ctx, tx, keyId)
+	if err == nil && before.RevokedAt != nil {
+		err = store.APIKeyNotFoundErr
+	}
+	if err != nil {
+		tx.Rollback()
+		return before, err
+	}
+	if _, err := tx.ExecContext(ctx, query, append(args, keyId)...); err != nil {
+		tx.Rollback()
+		return before, err
+	}
+	after, err := getAPIKey(ctx, tx, keyId)
+	if err != nil {
+		tx.Rollback()
+		return after, err
+	}
+	if err := appendAudit(ctx, tx, action, apiKeyResource(keyId), apiKeyState(before), apiKeyState(after)); err != nil {
+		tx.Rollback()
+		return after, err
+	}
+	return after, tx.Commit()
+}
+
+// RotateAPIKey replaces the secret of the active api key, the old one stops working right away
+func (s *Store) RotateAPIKey(ctx context.Context, keyId, secretHash string) (models.APIKey, error) {
+	return s.updateAPIKey(
+		ctx,
+		models.AuditAPIKeyRotated,
+		keyId,
+		"UPDATE api_key SET secret_hash=?, rotated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW') WHERE key_id=?",
+		secretHash,
+	)
+}
+
+// RevokeAPIKey disables the api key; it's kept, so the audit log entries still refer to it
+func (s *Store) RevokeAPIKey(ctx context.Context, keyId string) error {
+	_, err := s.updateAPIKey(
+		ctx,
+		models.AuditAPIKeyRevoked,
+		keyId,
+		"UPDATE api_key SET revoked_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW') WHERE key_id=?",
+	)
+	return err
+}
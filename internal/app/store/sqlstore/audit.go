@@ -0,0 +1,319 @@
+package sqlstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+)
+
+// genesisHash is the previous hash of the first audit entry
+var genesisHash = strings.Repeat("0", 64)
+
+var (
+	auditInfoMissingErr = errors.New("Audit info is not passed with the context")
+	auditChainBrokenErr = errors.New("Audit log chain is broken")
+)
+
+// AuditFilter selects entries of the audit log, empty fields match everything
+type AuditFilter struct {
+	// AfterID skips entries up to the id, so the log could be paged through
+	AfterID  int64
+	Actor    string
+	Action   string
+	Resource string
+	Limit    int64
+}
+
+// AuditVerification is the outcome of the successful audit log check;
+// last hash could be recorded elsewhere, so removal of the latest entries is detected too
+type AuditVerification struct {
+	Entries  int64
+	LastID   int64
+	LastHash string
+}
+
+// auditAccount is the state of the account recorded in the audit log
+type auditAccount struct {
+	AccountID int64 `json:"account_id"`
+	Balance   int64 `json:"balance"`
+	Version   int64 `json:"version"`
+}
+
+// auditTransfer is the state of both accounts of the transfer recorded in the audit log
+type auditTransfer struct {
+	TransactionID int64        `json:"transaction_id,omitempty"`
+	Amount        int64        `json:"amount"`
+	From          auditAccount `json:"from_account"`
+	To            auditAccount `json:"to_account"`
+}
+
+// auditRecord lists the hashed fields in the fixed order, created_at is hashed as it's stored
+type auditRecord struct {
+	AuditID   int64           `json:"audit_id"`
+	CreatedAt string          `json:"created_at"`
+	Actor     string          `json:"actor"`
+	SourceIP  string          `json:"source_ip"`
+	RequestID string          `json:"request_id"`
+	Action    string          `json:"action"`
+	Resource  string          `json:"resource"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	PrevHash  string          `json:"prev_hash"`
+}
+
+func (r auditRecord) hash() (string, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditing reports whether changes made with ctx must be recorded
+func auditing(ctx context.Context) bool {
+	_, ok := store.AuditInfoFrom(ctx)
+	return ok
+}
+
+func auditValue(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// appendAudit records the change within the transaction which makes it, so the entry is stored
+// if and only if the change is committed; the write transaction holds the db lock,
+// so entries are chained strictly one after another. Nothing is recorded without the audit info
+func appendAudit(ctx context.Context, tx *sql.Tx, action, resource string, before, after interface{}) error {
+	info, ok := store.AuditInfoFrom(ctx)
+	if !ok {
+		return nil
+	}
+	rec := auditRecord{
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Actor:     info.Actor,
+		SourceIP:  info.SourceIP,
+		RequestID: info.RequestID,
+		Action:    action,
+		Resource:  resource,
+		PrevHash:  genesisHash,
+	}
+	var err error
+	if rec.Before, err = auditValue(before); err != nil {
+		return err
+	}
+	if rec.After, err = auditValue(after); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, "SELECT audit_id, hash FROM audit_log ORDER BY audit_id DESC LIMIT 1").Scan(&rec.AuditID, &rec.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	rec.AuditID++
+	hash, err := rec.hash()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO audit_log(audit_id, created_at, actor, source_ip, request_id, action, resource,
+		before_value, after_value, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.AuditID,
+		rec.CreatedAt,
+		rec.Actor,
+		rec.SourceIP,
+		rec.RequestID,
+		rec.Action,
+		rec.Resource,
+		nullableText(rec.Before),
+		nullableText(rec.After),
+		rec.PrevHash,
+		hash,
+	)
+	return err
+}
+
+func nullableText(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// auditAccountState reads the account to record it in the audit log
+func auditAccountState(ctx context.Context, tx *sql.Tx, accId int64) (auditAccount, error) {
+	acc := auditAccount{AccountID: accId}
+	err := tx.QueryRowContext(
+		ctx,
+		"SELECT balance, version FROM account WHERE account_id=?",
+		accId,
+	).Scan(&acc.Balance, &acc.Version)
+	if err == sql.ErrNoRows {
+		return acc, nil
+	}
+	return acc, err
+}
+
+// auditTransferState reads both accounts of the transfer to record them in the audit log
+func auditTransferState(ctx context.Context, tx *sql.Tx, accountToId, accountFromId, amount int64) (auditTransfer, error) {
+	tr := auditTransfer{Amount: amount}
+	var err error
+	if tr.From, err = auditAccountState(ctx, tx, accountFromId); err != nil {
+		return tr, err
+	}
+	tr.To, err = auditAccountState(ctx, tx, accountToId)
+	return tr, err
+}
+
+func accountResource(accId int64) string {
+	return "account:" + strconv.FormatInt(accId, 10)
+}
+
+func transferResource(transactionId int64) string {
+	return "transfer:" + strconv.FormatInt(transactionId, 10)
+}
+
+// AppendAudit records change which isn't made by the store itself, e.g. the change of the config;
+// ctx must hold the audit info
+func (s *Store) AppendAudit(ctx context.Context, action, resource string, before, after interface{}) error {
+	if !auditing(ctx) {
+		return auditInfoMissingErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := appendAudit(ctx, tx, action, resource, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const auditColumns = `audit_id, created_at, actor, source_ip, request_id, action, resource,
+	before_value, after_value, prev_hash, hash`
+
+func scanAuditEntry(rows *sql.Rows) (models.AuditEntry, string, error) {
+	var (
+		entry         models.AuditEntry
+		createdAt     string
+		before, after sql.NullString
+	)
+	err := rows.Scan(
+		&entry.AuditID,
+		&createdAt,
+		&entry.Actor,
+		&entry.SourceIP,
+		&entry.RequestID,
+		&entry.Action,
+		&entry.Resource,
+		&before,
+		&after,
+		&entry.PrevHash,
+		&entry.Hash,
+	)
+	if err != nil {
+		return entry, createdAt, err
+	}
+	if before.Valid {
+		entry.Before = []byte(before.String)
+	}
+	if after.Valid {
+		entry.After = []byte(after.String)
+	}
+	entry.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return entry, createdAt, err
+}
+
+// GetAuditLog returns entries of the audit log matching the filter, oldest first
+func (s *Store) GetAuditLog(ctx context.Context, filter AuditFilter) ([]models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		`SELECT `+auditColumns+` FROM audit_log WHERE audit_id > $1
+		AND ($2 = '' OR actor = $2) AND ($3 = '' OR action = $3) AND ($4 = '' OR resource = $4)
+		ORDER BY audit_id LIMIT $5`,
+		filter.AfterID,
+		filter.Actor,
+		filter.Action,
+		filter.Resource,
+		filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]models.AuditEntry, 0)
+	for rows.Next() {
+		entry, _, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+	return res, rows.Err()
+}
+
+// VerifyAuditLog walks the whole audit log and checks that ids are contiguous,
+// every entry refers to the hash of the previous one and its own hash matches the content
+func (s *Store) VerifyAuditLog(ctx context.Context) (AuditVerification, error) {
+	res := AuditVerification{LastHash: genesisHash}
+	rows, err := s.readDB.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log ORDER BY audit_id`)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, createdAt, err := scanAuditEntry(rows)
+		if err != nil {
+			return res, err
+		}
+		if entry.AuditID != res.LastID+1 {
+			return res, fmt.Errorf("%w: entry %d follows %d", auditChainBrokenErr, entry.AuditID, res.LastID)
+		}
+		if entry.PrevHash != res.LastHash {
+			return res, fmt.Errorf("%w: entry %d doesn't refer to the previous one", auditChainBrokenErr, entry.AuditID)
+		}
+		hash, err := auditRecord{
+			AuditID:   entry.AuditID,
+			CreatedAt: createdAt,
+			Actor:     entry.Actor,
+			SourceIP:  entry.SourceIP,
+			RequestID: entry.RequestID,
+			Action:    entry.Action,
+			Resource:  entry.Resource,
+			Before:    entry.Before,
+			After:     entry.After,
+			PrevHash:  entry.PrevHash,
+		}.hash()
+		if err != nil {
+			return res, err
+		}
+		if hash != entry.Hash {
+			return res, fmt.Errorf("%w: entry %d has been changed", auditChainBrokenErr, entry.AuditID)
+		}
+		res.Entries++
+		res.LastID = entry.AuditID
+		res.LastHash = entry.Hash
+	}
+	return res, rows.Err()
+}
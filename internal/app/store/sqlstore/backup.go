@@ -0,0 +1,134 @@
+package sqlstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	backupExistsErr    = errors.New("Backup target already exists")
+	backupCorruptedErr = errors.New("Backup file is corrupted")
+	backupNoSchemaErr  = errors.New("Backup file has no schema version")
+	dbLockedErr        = errors.New("Database is locked by another process")
+)
+
+// lockFileSuffix names the file next to the db which holds the lock of the db
+const lockFileSuffix = ".lock"
+
+// unlockDB releases the lock taken by lockDB
+func unlockDB(lock *os.File) {
+	if lock != nil {
+		lock.Close()
+	}
+}
+
+// Backup writes consistent copy of the db into the new file at path.
+// `VACUUM INTO` reads the db within a single read transaction, so in WAL mode writers are not blocked;
+// it runs on the separate connection, since the read pool is query-only and the write one must stay free
+func (s *Store) Backup(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%w: %s", backupExistsErr, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	db := s.db
+	if s.path != ":memory:" {
+		var err error
+		db, err = newDB(dsn(s.path, s.opts, false), 1)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	// NOTE: backup of the big db could take longer than a regular query, so there is no timeout
+	_, err := db.ExecContext(context.Background(), "VACUUM INTO ?", path)
+	return err
+}
+
+// ValidateBackup checks integrity of the backup file and returns its schema version;
+// backup written by the newer build is rejected
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := newDB(dsn(path, Options{}, true), 1)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", backupCorruptedErr, err.Error())
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("%w: %s", backupCorruptedErr, err.Error())
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("%w: %s", backupCorruptedErr, integrity)
+	}
+	var version int
+	err = db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil || version == 0 {
+		return 0, backupNoSchemaErr
+	}
+	return version, checkSchemaVersion(version)
+}
+
+// Restore replaces the db at dbPath with the validated backup; it's refused while the db is open
+// by the server or any other command, since they would keep working with the replaced file.
+// Backup is copied next to the db and renamed over it, so the db is never left half-written
+func Restore(dbPath, backupPath string) (int, error) {
+	version, err := ValidateBackup(backupPath)
+	if err != nil {
+		return 0, err
+	}
+	lock, err := lockDB(dbPath, true)
+	if errors.Is(err, dbLockedErr) {
+		return 0, fmt.Errorf("%w: stop the server using %s before the restore", err, dbPath)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer unlockDB(lock)
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	// NOTE: log files of the replaced db must not be applied to the restored one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return version, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
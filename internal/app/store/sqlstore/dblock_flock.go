@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package sqlstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDB takes the advisory lock on the lock file next to the db without waiting:
+// every opened store holds the shared lock, while restore takes the exclusive one
+func lockDB(dbPath string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(dbPath+lockFileSuffix, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, dbLockedErr
+		}
+		return nil, err
+	}
+	return f, nil
+}
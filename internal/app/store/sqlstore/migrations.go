@@ -0,0 +1,395 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	newerSchemaErr          = errors.New("Database schema is newer than the one supported by this build")
+	unknownSchemaVersionErr = errors.New("Unknown schema version")
+	auditLogNotEmptyErr     = errors.New("Audit log has entries and can't be dropped")
+)
+
+// AuditSchemaVersion is the first schema version which keeps the audit log
+const AuditSchemaVersion = 7
+
+// migration moves the schema one version up or down;
+// every migration is applied in its own transaction along with the schema_version update
+type migration struct {
+	version     int
+	description string
+	up          []string
+	down        []string
+	// checkDown is optional, it refuses to revert the migration which would lose data
+	checkDown func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations holds the whole schema history, new migration is appended with the next version.
+// First migrations use `IF NOT EXISTS`, so databases created before versioning are adopted as is
+var migrations = []migration{
+	{
+		version:     1,
+		description: "accounts and transactions",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS account (
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		account_id INTEGER NOT NULL PRIMARY KEY,
+	    		balance INTEGER,
+	    		CHECK(balance >= 0)
+	    	);`,
+			`CREATE TABLE IF NOT EXISTS transactions (
+	    		transaction_id INTEGER NOT NULL PRIMARY KEY,
+	    		timestamp TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		from_account_id INTEGER,
+	    		to_account_id INTEGER,
+	    		amount INTEGER,
+	    		CHECK(amount >= 0)
+	    	);`,
+			`CREATE INDEX IF NOT EXISTS idx_from_account_id ON transactions(from_account_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_to_account_id ON transactions(to_account_id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS transactions`,
+			`DROP TABLE IF EXISTS account`,
+		},
+	},
+	{
+		version:     2,
+		description: "webhooks and their deliveries",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS webhook (
+	    		webhook_id INTEGER NOT NULL PRIMARY KEY,
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		url TEXT NOT NULL,
+	    		secret TEXT NOT NULL
+	    	);`,
+			`CREATE TABLE IF NOT EXISTS webhook_delivery (
+	    		delivery_id INTEGER NOT NULL PRIMARY KEY,
+	    		webhook_id INTEGER NOT NULL,
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		updated_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		event_type TEXT NOT NULL,
+	    		payload BLOB,
+	    		status TEXT NOT NULL,
+	    		attempts INTEGER DEFAULT 0,
+	    		last_error TEXT DEFAULT ''
+	    	);`,
+			`CREATE INDEX IF NOT EXISTS idx_webhook_delivery_status ON webhook_delivery(status)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS webhook_delivery`,
+			`DROP TABLE IF EXISTS webhook`,
+		},
+	},
+	{
+		version:     3,
+		description: "transactional outbox",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS outbox (
+	    		event_id INTEGER NOT NULL PRIMARY KEY,
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		event_type TEXT NOT NULL,
+	    		payload BLOB,
+	    		sent_at TIMESTAMP
+	    	);`,
+			`CREATE INDEX IF NOT EXISTS idx_outbox_unsent ON outbox(event_id) WHERE sent_at IS NULL`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS outbox`,
+		},
+	},
+	{
+		version:     4,
+		description: "change feed of the replica",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS change_feed (
+	    		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	    		table_name TEXT NOT NULL,
+	    		row_id INTEGER NOT NULL
+	    	);`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS account_feed_insert`,
+			`DROP TRIGGER IF EXISTS account_feed_update`,
+			`DROP TRIGGER IF EXISTS account_feed_delete`,
+			`DROP TRIGGER IF EXISTS transactions_feed_insert`,
+			`DROP TABLE IF EXISTS change_feed`,
+		},
+	},
+	{
+		version:     5,
+		description: "prepared legs of the cross-shard transfers",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS prepared_transfer (
+	    		transaction_id INTEGER NOT NULL,
+	    		account_id INTEGER NOT NULL,
+	    		timestamp TEXT NOT NULL,
+	    		from_account_id INTEGER NOT NULL,
+	    		to_account_id INTEGER NOT NULL,
+	    		amount INTEGER NOT NULL,
+	    		PRIMARY KEY(transaction_id, account_id)
+	    	);`,
+			`CREATE INDEX IF NOT EXISTS idx_prepared_transfer_account_id ON prepared_transfer(account_id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS prepared_transfer`,
+		},
+	},
+	{
+		version:     6,
+		description: "account versions",
+		up: []string{
+			accountVersionColumn,
+		},
+		// NOTE: sqlite of this build can't drop columns, so the table is rebuilt without it
+		down: []string{
+			`CREATE TABLE account_unversioned (
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		account_id INTEGER NOT NULL PRIMARY KEY,
+	    		balance INTEGER,
+	    		CHECK(balance >= 0)
+	    	);`,
+			`INSERT INTO account_unversioned SELECT created_at, account_id, balance FROM account`,
+			`DROP TABLE account`,
+			`ALTER TABLE account_unversioned RENAME TO account`,
+		},
+	},
+	{
+		version:     AuditSchemaVersion,
+		description: "hash-chained audit log",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS audit_log (
+	    		audit_id INTEGER NOT NULL PRIMARY KEY,
+	    		created_at TEXT NOT NULL,
+	    		actor TEXT NOT NULL,
+	    		source_ip TEXT NOT NULL,
+	    		request_id TEXT NOT NULL,
+	    		action TEXT NOT NULL,
+	    		resource TEXT NOT NULL,
+	    		before_value TEXT,
+	    		after_value TEXT,
+	    		prev_hash TEXT NOT NULL,
+	    		hash TEXT NOT NULL
+	    	);`,
+			`CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log(resource)`,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+		},
+		// NOTE: the log is the only record of the changes, so only the empty one is dropped
+		down: []string{
+			`DROP TABLE IF EXISTS audit_log`,
+		},
+		checkDown: checkAuditLogEmpty,
+	},
+	{
+		version:     8,
+		description: "api keys",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS api_key (
+	    		key_id TEXT NOT NULL PRIMARY KEY,
+	    		name TEXT NOT NULL,
+	    		scopes TEXT NOT NULL,
+	    		secret_hash TEXT NOT NULL,
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		rotated_at TIMESTAMP,
+	    		revoked_at TIMESTAMP
+	    	);`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS api_key`,
+		},
+	},
+	{
+		version:     9,
+		description: "scheduled webhook retries",
+		up: []string{
+			`ALTER TABLE webhook_delivery ADD COLUMN next_attempt_at TEXT`,
+			`CREATE INDEX IF NOT EXISTS idx_webhook_delivery_due ON webhook_delivery(status, next_attempt_at)`,
+		},
+		// NOTE: sqlite of this build can't drop columns, so the table is rebuilt without it
+		down: []string{
+			`DROP INDEX IF EXISTS idx_webhook_delivery_due`,
+			`CREATE TABLE webhook_delivery_unscheduled (
+	    		delivery_id INTEGER NOT NULL PRIMARY KEY,
+	    		webhook_id INTEGER NOT NULL,
+	    		created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		updated_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+	    		event_type TEXT NOT NULL,
+	    		payload BLOB,
+	    		status TEXT NOT NULL,
+	    		attempts INTEGER DEFAULT 0,
+	    		last_error TEXT DEFAULT ''
+	    	);`,
+			`INSERT INTO webhook_delivery_unscheduled SELECT delivery_id, webhook_id, created_at, updated_at,
+			event_type, payload, status, attempts, last_error FROM webhook_delivery`,
+			`DROP TABLE webhook_delivery`,
+			`ALTER TABLE webhook_delivery_unscheduled RENAME TO webhook_delivery`,
+			`CREATE INDEX IF NOT EXISTS idx_webhook_delivery_status ON webhook_delivery(status)`,
+		},
+	},
+}
+
+// checkAuditLogEmpty refuses to drop the audit log which has entries
+func checkAuditLogEmpty(ctx context.Context, tx *sql.Tx) error {
+	var n int64
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log").Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %d entries, backup the db and drop the audit_log table by hand to revert the schema", auditLogNotEmptyErr, n)
+	}
+	return nil
+}
+
+// accountVersionColumn adds version of the account, bumped on every balance change
+const accountVersionColumn = `ALTER TABLE account ADD COLUMN version INTEGER NOT NULL DEFAULT 1`
+
+// LatestSchemaVersion returns version of the schema this build works with
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStatus describes single migration and whether it's applied
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+}
+
+func (s *Store) createSchemaVersionTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+		);`,
+	)
+	return err
+}
+
+// SchemaVersion returns version of the last applied migration, 0 for the empty db
+func (s *Store) SchemaVersion() (int, error) {
+	if err := s.createSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	var version int
+	err := s.db.QueryRowContext(ctx, "SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// MigrationsStatus lists all known migrations
+func (s *Store) MigrationsStatus() ([]MigrationStatus, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		res = append(res, MigrationStatus{
+			Version:     m.version,
+			Description: m.description,
+			Applied:     m.version <= version,
+		})
+	}
+	return res, nil
+}
+
+// checkSchemaVersion refuses to work with the schema written by the newer build
+func checkSchemaVersion(version int) error {
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("%w: %d > %d", newerSchemaErr, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Migrate applies up or down migrations until the schema reaches the target version
+func (s *Store) Migrate(target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return fmt.Errorf("%w: %d", unknownSchemaVersionErr, target)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(version); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version > version && m.version <= target {
+			if err := s.applyMigration(m.version, nil, m.up, "INSERT INTO schema_version(version) VALUES (?)"); err != nil {
+				return err
+			}
+		}
+	}
+	// NOTE: reverts are checked up front, so the refused one doesn't leave the schema half way down
+	for _, m := range migrations {
+		if m.version <= version && m.version > target && m.checkDown != nil {
+			if err := s.checkMigration(m.version, m.checkDown); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version && m.version > target {
+			if err := s.applyMigration(m.version, m.checkDown, m.down, "DELETE FROM schema_version WHERE version=?"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkMigration runs the check of the migration without applying it
+func (s *Store) checkMigration(version int, check func(context.Context, *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := check(ctx, tx); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	return nil
+}
+
+func (s *Store) applyMigration(version int, check func(context.Context, *sql.Tx) error, queries []string, versionQuery string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(ctx, tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, versionQuery, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,99 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// maxQueryArgs is the limit of bound variables of a single statement of the bundled sqlite
+const maxQueryArgs = 999
+
+// insertOutboxEvent writes event within the transaction which changes the state,
+// so the event is stored if and only if the change is committed
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, eventType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO outbox(event_type, payload) VALUES (?, ?)",
+		eventType,
+		b,
+	)
+	return err
+}
+
+// GetUnsentEvents returns outbox events which are not published yet, oldest first
+func (s *Store) GetUnsentEvents(limit int64) ([]models.OutboxEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		`SELECT event_id, created_at, event_type, payload, sent_at FROM outbox
+		WHERE sent_at IS NULL ORDER BY event_id LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []models.OutboxEvent
+	for rows.Next() {
+		event := models.OutboxEvent{}
+		err := rows.Scan(
+			&event.EventID,
+			&event.CreatedAt,
+			&event.EventType,
+			&event.Payload,
+			&event.SentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, event)
+	}
+	return res, rows.Err()
+}
+
+// MarkEventsSent sets the publication time for the outbox events;
+// ids are marked in chunks within one transaction, so any number of them fits the statement limits
+func (s *Store) MarkEventsSent(eventIds []int64) error {
+	if len(eventIds) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(eventIds); start += maxQueryArgs {
+		chunk := eventIds[start:]
+		if len(chunk) > maxQueryArgs {
+			chunk = chunk[:maxQueryArgs]
+		}
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		_, err := tx.ExecContext(
+			ctx,
+			`UPDATE outbox SET sent_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')
+			WHERE event_id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)`,
+			args...,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
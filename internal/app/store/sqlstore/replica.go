@@ -0,0 +1,327 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/store"
+)
+
+const replicaBatchSize = 1000
+
+// changeFeedTriggers record every change of accounts and transactions into the change_feed table;
+// they exist only while the replica is enabled, so the feed doesn't grow without a consumer
+var changeFeedTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS account_feed_insert AFTER INSERT ON account
+	BEGIN INSERT INTO change_feed(table_name, row_id) VALUES ('account', NEW.account_id); END`,
+	`CREATE TRIGGER IF NOT EXISTS account_feed_update AFTER UPDATE ON account
+	BEGIN INSERT INTO change_feed(table_name, row_id) VALUES ('account', NEW.account_id); END`,
+	`CREATE TRIGGER IF NOT EXISTS account_feed_delete AFTER DELETE ON account
+	BEGIN INSERT INTO change_feed(table_name, row_id) VALUES ('account', OLD.account_id); END`,
+	`CREATE TRIGGER IF NOT EXISTS transactions_feed_insert AFTER INSERT ON transactions
+	BEGIN INSERT INTO change_feed(table_name, row_id) VALUES ('transactions', NEW.transaction_id); END`,
+}
+
+var dropChangeFeed = []string{
+	`DROP TRIGGER IF EXISTS account_feed_insert`,
+	`DROP TRIGGER IF EXISTS account_feed_update`,
+	`DROP TRIGGER IF EXISTS account_feed_delete`,
+	`DROP TRIGGER IF EXISTS transactions_feed_insert`,
+	`DELETE FROM change_feed`,
+}
+
+// replica is a second sqlite file with copies of the account and transactions tables,
+// which serves reads so heavy history queries don't compete with transfers for the primary db.
+// It's kept in sync by tailing the change feed of the primary
+type replica struct {
+	db       *sql.DB
+	readDB   *sql.DB
+	interval time.Duration
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	mx      sync.Mutex
+	lastSeq int64
+	lastErr error
+}
+
+func execAll(ctx context.Context, db *sql.DB, queries []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// disableChangeFeed removes triggers and the pending feed when the replica is not used
+func (s *Store) disableChangeFeed() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+	return execAll(ctx, s.db, dropChangeFeed)
+}
+
+// startReplica opens the replica, copies current state of the primary into it
+// and starts tailing the change feed
+func (s *Store) startReplica(path string, opts Options) error {
+	db, err := newDB(dsn(path, opts, false), 1)
+	if err != nil {
+		return err
+	}
+	readDB, err := newDB(dsn(path, opts, true), opts.ReadPoolSize)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	r := &replica{
+		db:       db,
+		readDB:   readDB,
+		interval: opts.ReplicaInterval,
+		quit:     make(chan struct{}),
+	}
+	if err := s.initReplica(r); err != nil {
+		r.close()
+		return err
+	}
+	s.replica = r
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+				_, err := s.replicate()
+				r.mx.Lock()
+				r.lastErr = err
+				r.mx.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// initReplica installs the feed triggers and then copies the whole state within a single read transaction;
+// changes made after that snapshot are in the feed with seq greater than the recorded one
+func (s *Store) initReplica(r *replica) error {
+	ctx := context.Background()
+	// NOTE: replica is rebuilt from scratch, so it always has the current schema of the tables
+	schema := []string{`DROP TABLE IF EXISTS account`, `DROP TABLE IF EXISTS transactions`}
+	schema = append(schema, migrations[0].up...)
+	schema = append(schema, accountVersionColumn)
+	if err := execAll(ctx, r.db, schema); err != nil {
+		return err
+	}
+	if err := execAll(ctx, s.db, changeFeedTriggers); err != nil {
+		return err
+	}
+
+	src, err := s.readDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Rollback()
+	var seq int64
+	if err := src.QueryRowContext(ctx, "SELECT IFNULL(MAX(seq), 0) FROM change_feed").Scan(&seq); err != nil {
+		return err
+	}
+	dst, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := copyRows(ctx, src, dst, "account", ""); err != nil {
+		dst.Rollback()
+		return err
+	}
+	if err := copyRows(ctx, src, dst, "transactions", ""); err != nil {
+		dst.Rollback()
+		return err
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	r.lastSeq = seq
+	return nil
+}
+
+// replicaColumns lists columns of the replicated tables; timestamps are copied as text,
+// so they are compared in the same format as on the primary
+var replicaColumns = map[string]struct {
+	key     string
+	columns string
+	n       int
+}{
+	"account":      {"account_id", "CAST(created_at AS TEXT), account_id, balance, version", 4},
+	"transactions": {"transaction_id", "transaction_id, CAST(timestamp AS TEXT), from_account_id, to_account_id, amount", 5},
+}
+
+// copyRows upserts rows of the table from src into dst; `where` limits the copied rows
+func copyRows(ctx context.Context, src, dst *sql.Tx, table, where string, args ...interface{}) error {
+	t := replicaColumns[table]
+	rows, err := src.QueryContext(ctx, "SELECT "+t.columns+" FROM "+table+" "+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	placeholders := "?"
+	for i := 1; i < t.n; i++ {
+		placeholders += ", ?"
+	}
+	insert := "INSERT OR REPLACE INTO " + table + " VALUES (" + placeholders + ")"
+	values := make([]interface{}, t.n)
+	for i := range values {
+		values[i] = new(interface{})
+	}
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		args := make([]interface{}, t.n)
+		for i, v := range values {
+			args[i] = *(v.(*interface{}))
+			// NOTE: text must not turn into blob, otherwise it's compared differently
+			if b, ok := args[i].([]byte); ok {
+				args[i] = string(b)
+			}
+		}
+		if _, err := dst.ExecContext(ctx, insert, args...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// replicate applies the next batch of the change feed to the replica and returns the number of applied changes.
+// Feed only says which rows have changed, so the current version of every row is read from the primary
+// within the same read transaction as the feed itself, and the applied feed is removed afterwards
+func (s *Store) replicate() (int, error) {
+	r := s.replica
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	r.mx.Lock()
+	lastSeq := r.lastSeq
+	r.mx.Unlock()
+
+	src, err := s.readDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer src.Rollback()
+	rows, err := src.QueryContext(
+		ctx,
+		"SELECT seq, table_name, row_id FROM change_feed WHERE seq > ? ORDER BY seq LIMIT ?",
+		lastSeq,
+		replicaBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	type change struct {
+		table string
+		rowId int64
+	}
+	var changes []change
+	seen := make(map[change]bool)
+	seq := lastSeq
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&seq, &c.table, &c.rowId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !seen[c] {
+			seen[c] = true
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	dst, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range changes {
+		t := replicaColumns[c.table]
+		// NOTE: deleted row is removed, existing one is written again
+		if _, err := dst.ExecContext(ctx, "DELETE FROM "+c.table+" WHERE "+t.key+"=?", c.rowId); err != nil {
+			dst.Rollback()
+			return 0, err
+		}
+		if err := copyRows(ctx, src, dst, c.table, "WHERE "+t.key+"=?", c.rowId); err != nil {
+			dst.Rollback()
+			return 0, err
+		}
+	}
+	if err := dst.Commit(); err != nil {
+		return 0, err
+	}
+	r.mx.Lock()
+	r.lastSeq = seq
+	r.mx.Unlock()
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM change_feed WHERE seq <= ?", seq)
+	return len(changes), err
+}
+
+// ReplicaLag returns the number of changes not yet applied to the replica and the last replication error
+func (s *Store) ReplicaLag() (int64, error) {
+	if s.replica == nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	s.replica.mx.Lock()
+	lastSeq, lastErr := s.replica.lastSeq, s.replica.lastErr
+	s.replica.mx.Unlock()
+	var lag int64
+	err := s.readDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM change_feed WHERE seq > ?", lastSeq).Scan(&lag)
+	if err != nil {
+		return 0, err
+	}
+	return lag, lastErr
+}
+
+// Strong returns view of the store which reads from the primary db, so the caller sees its own writes;
+// the view shares connections with the store and must not be closed
+func (s *Store) Strong() store.Store {
+	strong := *s
+	strong.replica = nil
+	return &strong
+}
+
+// queryDB returns connection pool for the reads: replica if it's enabled, primary otherwise
+func (s *Store) queryDB() *sql.DB {
+	if s.replica != nil {
+		return s.replica.readDB
+	}
+	return s.readDB
+}
+
+func (r *replica) stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+func (r *replica) close() {
+	r.readDB.Close()
+	r.db.Close()
+}
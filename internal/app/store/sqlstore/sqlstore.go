@@ -5,99 +5,228 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gasparian/money-transfers-api/internal/app/models"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
+	"github.com/gasparian/money-transfers-api/internal/app/store"
 )
 
 var (
 	accountsArrayEmptyErr = errors.New("Accounts array is empty")
-	accNotFoundErr        = errors.New("Account not found")
+	accNotFoundErr        = store.AccountNotFoundErr
+	webhookNotFoundErr    = store.WebhookNotFoundErr
+	// account can't be removed while the money of the cross-shard transfer is on its way
+	accHasPreparedTransfersErr = errors.New("Account has transfers in progress")
 )
 
-// Store object holds db instance
+type accountEventPayload struct {
+	AccountID int64 `json:"account_id"`
+	Balance   int64 `json:"balance"`
+}
+
+type transferEventPayload struct {
+	TransactionID int64 `json:"transaction_id"`
+	FromAccountID int64 `json:"from_account_id"`
+	ToAccountID   int64 `json:"to_account_id"`
+	Amount        int64 `json:"amount"`
+}
+
+// Options holds sqlite connection settings, see https://www.sqlite.org/pragma.html
+type Options struct {
+	// JournalMode is one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF
+	JournalMode string
+	// Synchronous is one of OFF, NORMAL, FULL, EXTRA
+	Synchronous string
+	// BusyTimeout is how long (in ms) connection waits for the lock before failing with "database is locked"
+	BusyTimeout  uint32
+	ForeignKeys  bool
+	ReadPoolSize int
+	// ReplicaPath enables the replica db which serves account and history reads
+	ReplicaPath     string
+	ReplicaInterval time.Duration
+}
+
+// DefaultOptions returns settings tuned for concurrent access:
+// in WAL mode readers don't block the writer and vice versa
+func DefaultOptions() Options {
+	return Options{
+		JournalMode:     "WAL",
+		Synchronous:     "NORMAL",
+		BusyTimeout:     5000,
+		ForeignKeys:     true,
+		ReadPoolSize:    4,
+		ReplicaInterval: 100 * time.Millisecond,
+	}
+}
+
+// Store object holds db instance.
+// SQLite allows only one writer at a time, so all writes go through the single connection
+// and are serialized by the pool instead of failing on the lock, while reads use their own pool
 type Store struct {
 	db           *sql.DB
+	readDB       *sql.DB
+	path         string
+	opts         Options
+	replica      *replica
 	queryTimeout time.Duration
+	broker       *pubsub.Broker
+	// idStride, idOffset and idFloor partition transaction ids allocated by the store, see PartitionTransactionIDs
+	idStride int64
+	idOffset int64
+	idFloor  int64
+	// lock is the shared lock of the db file, so it's not restored while the store is open
+	lock *os.File
+	// publishMx orders commits of the account changes with publication of their events,
+	// it's shared with the strong view of the store
+	publishMx *sync.Mutex
+}
+
+func dsn(dbPath string, opts Options, readOnly bool) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatUint(uint64(opts.BusyTimeout), 10))
+	params.Set("_foreign_keys", strconv.FormatBool(opts.ForeignKeys))
+	if opts.JournalMode != "" {
+		params.Set("_journal_mode", opts.JournalMode)
+	}
+	if opts.Synchronous != "" {
+		params.Set("_synchronous", opts.Synchronous)
+	}
+	if readOnly {
+		params.Set("_query_only", "true")
+	} else {
+		// write lock is taken at the start of the transaction, so it's never upgraded midway
+		params.Set("_txlock", "immediate")
+	}
+	return fmt.Sprintf("file:%s?%s", dbPath, params.Encode())
 }
 
-func newDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+func newDB(dsn string, maxConns int) (*sql.DB, error) {
+	db, err := sql.Open(TracedDriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
 
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-// New creates new instance of the db and create needed tables
-func New(dbPath string, queryTimeout uint32) (*Store, error) {
-	db, err := newDB(dbPath)
+// Open connects to the db without touching the schema, used to run migrations manually;
+// it fails if the db is being restored
+func Open(dbPath string, queryTimeout uint32, opts Options) (*Store, error) {
+	var lock *os.File
+	if dbPath != ":memory:" {
+		var err error
+		if lock, err = lockDB(dbPath, false); errors.Is(err, dbLockedErr) {
+			return nil, fmt.Errorf("%w: %s is being restored", err, dbPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, err := newDB(dsn(dbPath, opts, false), 1)
 	if err != nil {
+		unlockDB(lock)
 		return nil, err
 	}
 	s := &Store{
 		db:           db,
+		readDB:       db,
+		path:         dbPath,
+		opts:         opts,
 		queryTimeout: time.Duration(queryTimeout) * time.Second,
+		lock:         lock,
+		publishMx:    &sync.Mutex{},
+	}
+	// NOTE: every connection to the in-memory db gets its own database
+	if dbPath != ":memory:" && opts.ReadPoolSize > 0 {
+		s.readDB, err = newDB(dsn(dbPath, opts, true), opts.ReadPoolSize)
+		if err != nil {
+			db.Close()
+			unlockDB(lock)
+			return nil, err
+		}
 	}
-	s.createAccountsTable()
-	s.createTransactionsTable()
 	return s, nil
 }
 
-// Close closes underlying db connection
-func (s *Store) Close() {
-	s.db.Close()
+// New creates new instance of the db with default settings and applies pending migrations
+func New(dbPath string, queryTimeout uint32) (*Store, error) {
+	return NewWithOptions(dbPath, queryTimeout, DefaultOptions())
 }
 
-func (s *Store) createAccountsTable() error {
-	q := `CREATE TABLE IF NOT EXISTS account (
-	    created_at TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
-		account_id INTEGER NOT NULL PRIMARY KEY,
-		balance INTEGER,
-        CHECK(balance >= 0)
-	);`
-	_, err := s.db.Exec(q)
+// NewWithOptions creates new instance of the db and applies pending migrations;
+// it fails if the schema was migrated by the newer build
+func NewWithOptions(dbPath string, queryTimeout uint32, opts Options) (*Store, error) {
+	s, err := Open(dbPath, queryTimeout, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if err := s.Migrate(LatestSchemaVersion()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if opts.ReplicaPath == "" {
+		err = s.disableChangeFeed()
+	} else {
+		err = s.startReplica(opts.ReplicaPath, opts)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
-func (s *Store) createTransactionsTable() error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+// SetBroker sets pub/sub which receives events after every committed change
+func (s *Store) SetBroker(broker *pubsub.Broker) {
+	s.broker = broker
+}
+
+// Close stops replication and closes underlying db connections
+func (s *Store) Close() {
+	if s.replica != nil {
+		s.replica.stop()
+		s.replica.close()
+	}
+	if s.readDB != s.db {
+		s.readDB.Close()
+	}
+	s.db.Close()
+	unlockDB(s.lock)
+}
+
+// Ping checks that the db file is readable; the read pool is used,
+// so the check doesn't queue behind the writes
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+	var tables int
+	return s.readDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+}
+
+// PoolStats returns stats of the connection pools by their names
+func (s *Store) PoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"write": s.db.Stats()}
+	if s.readDB != s.db {
+		stats["read"] = s.readDB.Stats()
 	}
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS transactions (
-	    	transaction_id INTEGER NOT NULL PRIMARY KEY,
-	    	timestamp TIMESTAMP DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
-	    	from_account_id INTEGER,
-	    	to_account_id INTEGER,
-	    	amount INTEGER,
-            CHECK(amount >= 0)
-	    );`,
-		`CREATE INDEX IF NOT EXISTS idx_from_account_id ON transactions(from_account_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_to_account_id ON transactions(to_account_id)`,
-	}
-	for _, q := range queries {
-		_, err := tx.Exec(q)
-		if err != nil {
-			tx.Rollback()
-			return nil
-		}
+	if s.replica != nil {
+		stats["replica_write"] = s.replica.db.Stats()
+		stats["replica_read"] = s.replica.readDB.Stats()
 	}
-	tx.Commit()
-	return nil
+	return stats
 }
 
 // dropTables removes table from the db
@@ -116,8 +245,18 @@ func (s *Store) dropTable(tableName string) error {
 }
 
 // InsertAccount inserts new account into the accounts table and returns Account model
-func (s *Store) InsertAccount(balance int64) (models.Account, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+func (s *Store) InsertAccount(ctx context.Context, balance int64) (models.Account, error) {
+	return s.insertAccount(ctx, 0, balance)
+}
+
+// InsertAccountWithID inserts account with the id allocated by the caller, e.g. by the shards coordinator
+func (s *Store) InsertAccountWithID(ctx context.Context, accId, balance int64) (models.Account, error) {
+	return s.insertAccount(ctx, accId, balance)
+}
+
+// insertAccount uses the next id of the table when accId is 0
+func (s *Store) insertAccount(ctx context.Context, accId, balance int64) (models.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
 	var acc models.Account
@@ -125,79 +264,229 @@ func (s *Store) InsertAccount(balance int64) (models.Account, error) {
 	if err != nil {
 		return acc, err
 	}
-	res, err := tx.Exec(
-		"INSERT INTO account(balance) VALUES (?)",
+	res, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO account(account_id, balance) VALUES (NULLIF(?, 0), ?)",
+		accId,
 		balance,
 	)
 	if err != nil {
 		tx.Rollback()
 		return acc, err
 	}
-	accId, err := res.LastInsertId()
+	accId, err = res.LastInsertId()
 	if err != nil {
 		tx.Rollback()
 		return acc, err
 	}
 	err = tx.QueryRowContext(
 		ctx,
-		"SELECT * FROM account WHERE account_id=?",
+		"SELECT created_at, account_id, balance, version FROM account WHERE account_id=?",
 		accId,
 	).Scan(
 		&acc.CreatedAt,
 		&acc.AccountID,
 		&acc.Balance,
+		&acc.Version,
 	)
 	if err != nil {
 		tx.Rollback()
 		return acc, err
 	}
-	tx.Commit()
-	return acc, nil
+	err = insertOutboxEvent(ctx, tx, models.AccountCreatedEvent, accountEventPayload{
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
+	if err != nil {
+		tx.Rollback()
+		return acc, err
+	}
+	err = appendAudit(ctx, tx, models.AuditAccountCreated, accountResource(acc.AccountID), nil, auditAccount{
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+		Version:   acc.Version,
+	})
+	if err != nil {
+		tx.Rollback()
+		return acc, err
+	}
+	err = s.commitAndPublish(tx, pubsub.Event{
+		Type:      pubsub.BalanceChanged,
+		AccountID: acc.AccountID,
+		Balance:   acc.Balance,
+	})
+	return acc, err
 }
 
-// DeleteAccount removes account from the accounts table
-func (s *Store) DeleteAccount(accId int64) error {
-	res, err := s.db.Exec(
-		"DELETE FROM account WHERE account_id=?",
+// DeleteAccount removes account from the accounts table, if its version matches
+func (s *Store) DeleteAccount(ctx context.Context, accId, version int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var prepared int64
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM prepared_transfer WHERE account_id=?",
 		accId,
+	).Scan(&prepared)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if prepared > 0 {
+		tx.Rollback()
+		return accHasPreparedTransfersErr
+	}
+	var before auditAccount
+	if auditing(ctx) {
+		if before, err = auditAccountState(ctx, tx, accId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM account WHERE account_id=$1 AND ($2=0 OR version=$2)",
+		accId,
+		version,
 	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	if rowsAffected == 0 {
-		return accNotFoundErr
+		err = accountMissingErr(ctx, tx, accId)
+		tx.Rollback()
+		return err
 	}
-	return err
+	err = insertOutboxEvent(ctx, tx, models.AccountDeletedEvent, accountEventPayload{
+		AccountID: accId,
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := appendAudit(ctx, tx, models.AuditAccountDeleted, accountResource(accId), before, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.commitAndPublish(tx, pubsub.Event{
+		Type:      pubsub.AccountClosed,
+		AccountID: accId,
+	})
+}
+
+// accountMissingErr tells why the account wasn't changed: it's gone or has another version
+func accountMissingErr(ctx context.Context, tx *sql.Tx, accId int64) error {
+	var n int64
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM account WHERE account_id=?", accId).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return store.VersionConflictErr
+	}
+	return accNotFoundErr
 }
 
 // GetAccount returns account model
-func (s *Store) GetAccount(accId int64) (models.Account, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+func (s *Store) GetAccount(ctx context.Context, accId int64) (models.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
 	var acc models.Account
-	err := s.db.QueryRowContext(
+	err := s.queryDB().QueryRowContext(
 		ctx,
-		"SELECT * FROM account WHERE account_id=?",
+		"SELECT created_at, account_id, balance, version FROM account WHERE account_id=?",
 		accId,
 	).Scan(
 		&acc.CreatedAt,
 		&acc.AccountID,
 		&acc.Balance,
+		&acc.Version,
 	)
+	if err == sql.ErrNoRows {
+		return acc, accNotFoundErr
+	}
 	return acc, err
 }
 
 // TransferMoney transfers money from one account to another; writes transfer info into the transfers table
-func (s *Store) TransferMoney(accountToId, accountFromId, amount int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+func (s *Store) TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error {
+	return s.transferMoney(ctx, 0, accountToId, accountFromId, amount)
+}
+
+// TransferMoneyWithID transfers money recording the transaction under the id allocated by the caller
+func (s *Store) TransferMoneyWithID(ctx context.Context, transactionId, accountToId, accountFromId, amount int64) error {
+	return s.transferMoney(ctx, transactionId, accountToId, accountFromId, amount)
+}
+
+// PartitionTransactionIDs makes the store allocate only transaction ids greater than floor
+// and equal to offset modulo stride, so the stores with different offsets never allocate the same id
+// and ids allocated by the caller don't collide with them if they are taken from the other offset
+func (s *Store) PartitionTransactionIDs(stride, offset, floor int64) {
+	s.idStride, s.idOffset, s.idFloor = stride, offset, floor
+}
+
+// LastTransactionID returns the greatest transaction id recorded by the store, 0 if there are none
+func (s *Store) LastTransactionID(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	var last int64
+	err := s.db.QueryRowContext(ctx, "SELECT IFNULL(MAX(transaction_id), 0) FROM transactions").Scan(&last)
+	return last, err
+}
+
+// nextTransactionID allocates the id from the partition of the store;
+// the write lock is taken at the start of the transaction, so the id can't be taken concurrently
+func (s *Store) nextTransactionID(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var last int64
+	if err := tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(transaction_id), 0) FROM transactions").Scan(&last); err != nil {
+		return 0, err
+	}
+	if last < s.idFloor {
+		last = s.idFloor
+	}
+	next := last + 1
+	return next + (s.idOffset-next%s.idStride+s.idStride)%s.idStride, nil
+}
+
+// transferMoney uses the next id of the transactions table, or of the partition if it's set, when transactionId is 0
+func (s *Store) transferMoney(ctx context.Context, transactionId, accountToId, accountFromId, amount int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	updateBalanceQuery := "UPDATE account SET balance = balance + ? WHERE account_id=?"
+	updateBalanceQuery := "UPDATE account SET balance = balance + ?, version = version + 1 WHERE account_id=?"
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(
+	if transactionId == 0 && s.idStride > 0 {
+		if transactionId, err = s.nextTransactionID(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var before auditTransfer
+	if auditing(ctx) {
+		if before, err = auditTransferState(ctx, tx, accountToId, accountFromId, amount); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.ExecContext(
+		ctx,
 		updateBalanceQuery,
 		-amount,
 		accountFromId,
@@ -206,7 +495,8 @@ func (s *Store) TransferMoney(accountToId, accountFromId, amount int64) error {
 		tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(
+		ctx,
 		updateBalanceQuery,
 		amount,
 		accountToId,
@@ -215,8 +505,10 @@ func (s *Store) TransferMoney(accountToId, accountFromId, amount int64) error {
 		tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec(
-		"INSERT INTO transactions(from_account_id, to_account_id, amount) VALUES (?, ?, ?)",
+	res, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO transactions(transaction_id, from_account_id, to_account_id, amount) VALUES (NULLIF(?, 0), ?, ?, ?)",
+		transactionId,
 		accountFromId,
 		accountToId,
 		amount,
@@ -225,20 +517,89 @@ func (s *Store) TransferMoney(accountToId, accountFromId, amount int64) error {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
+	transactionId, err = res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = insertOutboxEvent(ctx, tx, models.TransferCompletedEvent, transferEventPayload{
+		TransactionID: transactionId,
+		FromAccountID: accountFromId,
+		ToAccountID:   accountToId,
+		Amount:        amount,
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if auditing(ctx) {
+		after, err := auditTransferState(ctx, tx, accountToId, accountFromId, amount)
+		if err == nil {
+			after.TransactionID = transactionId
+			err = appendAudit(ctx, tx, models.AuditTransferCompleted, transferResource(transactionId), before, after)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var (
+		tr                     models.Transaction
+		fromBalance, toBalance int64
+	)
+	if s.broker != nil {
+		err = tx.QueryRowContext(
+			ctx,
+			"SELECT * FROM transactions WHERE transaction_id=?",
+			transactionId,
+		).Scan(
+			&tr.TransactionID,
+			&tr.Timestamp,
+			&tr.FromAccountID,
+			&tr.ToAccountID,
+			&tr.Amount,
+		)
+		if err == nil {
+			err = tx.QueryRowContext(
+				ctx,
+				`SELECT IFNULL((SELECT balance FROM account WHERE account_id=$1), 0),
+				IFNULL((SELECT balance FROM account WHERE account_id=$2), 0)`,
+				accountFromId,
+				accountToId,
+			).Scan(&fromBalance, &toBalance)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return s.commitAndPublish(tx, pubsub.TransferEvents(tr, fromBalance, toBalance)...)
+}
+
+// commitAndPublish commits the transaction and publishes its events under the ordering lock.
+// sqlite serializes the writers anyway, so the lock only makes subscribers get
+// events of the account in the commit order, e.g. `balance.changed` of two transfers is never swapped
+func (s *Store) commitAndPublish(tx *sql.Tx, events ...pubsub.Event) error {
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.broker.Publish(events...)
 	return nil
 }
 
 // GetTransactionsHistory retunrs array of transcations for the requested period of time
-func (s *Store) GetTransactionsHistory(accountId, nLastdays, limit int64) ([]models.Transaction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+func (s *Store) GetTransactionsHistory(ctx context.Context, accountId, nLastdays, limit int64) ([]models.Transaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	row, err := s.db.QueryContext(
+	row, err := s.queryDB().QueryContext(
 		ctx,
 		fmt.Sprintf(`SELECT * FROM transactions WHERE 
 		timestamp >= date('now', '-%v day') AND 
-		(from_account_id=$1 OR to_account_id=$1) LIMIT $2`, nLastdays),
+		(from_account_id=$1 OR to_account_id=$1)
+		ORDER BY timestamp, transaction_id LIMIT $2`, nLastdays),
 		accountId,
 		limit,
 	)
@@ -1,9 +1,18 @@
 package sqlstore
 
 import (
+	"context"
+	"errors"
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/outbox"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
 	"github.com/gasparian/money-transfers-api/internal/app/store"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSqlStore(t *testing.T) {
@@ -13,8 +22,752 @@ func TestSqlStore(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
 	defer os.RemoveAll(dbPath)
 
 	store.TestStore(s, t)
 	store.TestStoreConcurrentTransfer(s, t)
+
+	broker := pubsub.NewBroker()
+	s.SetBroker(broker)
+	store.TestStoreEventsOrder(s, broker, t)
+}
+
+func TestWebhooks(t *testing.T) {
+	dbPath := "/tmp/tets_webhooks.db"
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	hook, err := s.InsertWebhook("http://localhost:9000/hook", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := s.ListWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].URL != hook.URL || hooks[0].Secret != "secret" {
+		t.Error("Webhook corrupted")
+	}
+
+	delivery, err := s.InsertDelivery(models.WebhookDelivery{
+		WebhookID: hook.WebhookID,
+		EventType: "account.created",
+		Payload:   []byte(`{"account_id":1}`),
+		Status:    "pending",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery.Status = "failed"
+	delivery.Attempts = 3
+	delivery.LastError = "timeout"
+	if err := s.UpdateDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := s.GetDeliveries("failed", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Attempts != 3 || string(failed[0].Payload) != `{"account_id":1}` {
+		t.Error("Delivery corrupted")
+	}
+
+	retry, err := s.InsertDelivery(models.WebhookDelivery{
+		WebhookID: hook.WebhookID,
+		EventType: "account.created",
+		Status:    "pending",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err := s.GetDueDeliveries("pending", time.Now(), 10)
+	if err != nil || len(due) != 1 || !due[0].NextAttemptAt.IsZero() {
+		t.Errorf("expected new delivery to be due, got %+v: %v", due, err)
+	}
+	retry.NextAttemptAt = time.Now().Add(time.Minute)
+	if err := s.UpdateDelivery(retry); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := s.GetDueDeliveries("pending", time.Now(), 10); err != nil || len(due) != 0 {
+		t.Errorf("expected scheduled retry not to be due, got %+v: %v", due, err)
+	}
+	due, err = s.GetDueDeliveries("pending", time.Now().Add(2*time.Minute), 10)
+	if err != nil || len(due) != 1 || due[0].NextAttemptAt.Sub(retry.NextAttemptAt) > time.Millisecond {
+		t.Errorf("expected retry to be due later, got %+v: %v", due, err)
+	}
+
+	if err := s.DeleteWebhook(hook.WebhookID); err != nil {
+		t.Error(err)
+	}
+	if err := s.DeleteWebhook(hook.WebhookID); err == nil {
+		t.Error("Webhook deletion corrupted")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/tets_outbox.db"
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	accFrom, err := s.InsertAccount(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accTo, err := s.InsertAccount(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 5000); err == nil {
+		t.Fatal("Transfer must fail")
+	}
+	if err := s.DeleteAccount(ctx, accTo.AccountID, store.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.GetUnsentEvents(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		models.AccountCreatedEvent,
+		models.AccountCreatedEvent,
+		models.TransferCompletedEvent,
+		models.AccountDeletedEvent,
+	}
+	if len(events) != len(expected) {
+		t.Fatal("Outbox corrupted")
+	}
+	for i, event := range events {
+		if event.EventType != expected[i] {
+			t.Error("Outbox corrupted")
+		}
+	}
+
+	if err := s.MarkEventsSent([]int64{events[0].EventID, events[1].EventID}); err != nil {
+		t.Fatal(err)
+	}
+	events, err = s.GetUnsentEvents(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].EventType != models.TransferCompletedEvent {
+		t.Error("Outbox corrupted")
+	}
+
+	t.Run("FlushOverStatementLimit", func(t *testing.T) {
+		n := maxQueryArgs + 200
+		for i := 0; i < n; i++ {
+			if _, err := s.InsertAccount(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		relay := outbox.NewRelay(s, outbox.NewWriterPublisher(ioutil.Discard), time.Second, int64(2*n))
+		published, err := relay.Flush()
+		if err != nil || published != n+2 {
+			t.Fatalf("expected %v events to be published, got %v: %v", n+2, published, err)
+		}
+		events, err := s.GetUnsentEvents(10)
+		if err != nil || len(events) != 0 {
+			t.Errorf("expected all events to be marked as sent, got %v: %v", len(events), err)
+		}
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/tets_migrations.db"
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	tableExists := func(s *Store, table string) bool {
+		var n int
+		s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n)
+		return n == 1
+	}
+
+	t.Run("UpDown", func(t *testing.T) {
+		s, err := New(dbPath, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		version, err := s.SchemaVersion()
+		if err != nil || version != LatestSchemaVersion() {
+			t.Fatalf("expected schema version %v, got %v: %v", LatestSchemaVersion(), version, err)
+		}
+		if err := s.Migrate(1); err != nil {
+			t.Fatal(err)
+		}
+		if !tableExists(s, "account") || tableExists(s, "webhook") || tableExists(s, "outbox") {
+			t.Error("expected only the first migration to be applied")
+		}
+		if err := s.Migrate(0); err != nil {
+			t.Fatal(err)
+		}
+		if tableExists(s, "account") {
+			t.Error("expected all migrations to be reverted")
+		}
+		if err := s.Migrate(LatestSchemaVersion() + 1); !errors.Is(err, unknownSchemaVersionErr) {
+			t.Errorf("expected unknown version error, got %v", err)
+		}
+		if err := s.Migrate(LatestSchemaVersion()); err != nil {
+			t.Fatal(err)
+		}
+		statuses, err := s.MigrationsStatus()
+		if err != nil || len(statuses) != len(migrations) || !statuses[len(statuses)-1].Applied {
+			t.Errorf("wrong migrations status: %v: %v", statuses, err)
+		}
+	})
+
+	t.Run("KeepAuditLog", func(t *testing.T) {
+		s, err := New(dbPath, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := s.Migrate(AuditSchemaVersion - 1); err != nil {
+			t.Fatalf("expected the empty audit log to be dropped: %v", err)
+		}
+		if err := s.Migrate(LatestSchemaVersion()); err != nil {
+			t.Fatal(err)
+		}
+		auditCtx := store.WithAuditInfo(ctx, store.AuditInfo{Actor: "tester"})
+		if err := s.AppendAudit(auditCtx, models.AuditLogLevelChanged, "config:log_level", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Migrate(AuditSchemaVersion - 1); !errors.Is(err, auditLogNotEmptyErr) {
+			t.Errorf("expected %v, got %v", auditLogNotEmptyErr, err)
+		}
+		version, err := s.SchemaVersion()
+		if err != nil || version != LatestSchemaVersion() || !tableExists(s, "audit_log") {
+			t.Errorf("expected refused revert to keep the schema as is, got version %v: %v", version, err)
+		}
+	})
+
+	t.Run("NewerSchema", func(t *testing.T) {
+		s, err := Open(dbPath, 10, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec("INSERT INTO schema_version(version) VALUES (?)", LatestSchemaVersion()+1); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		if _, err := New(dbPath, 10); !errors.Is(err, newerSchemaErr) {
+			t.Errorf("expected newer schema error, got %v", err)
+		}
+	})
+
+	t.Run("AdoptExistingSchema", func(t *testing.T) {
+		os.RemoveAll(dbPath)
+		s, err := Open(dbPath, 10, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// tables created before versioning was introduced
+		for _, q := range migrations[0].up {
+			if _, err := s.db.Exec(q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.db.Exec("INSERT INTO account(balance) VALUES (100)"); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s, err = New(dbPath, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if acc, err := s.GetAccount(ctx, 1); err != nil || acc.Balance != 100 {
+			t.Errorf("expected existing data to be kept, got %v: %v", acc, err)
+		}
+	})
+}
+
+func TestConnectionPools(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/tets_pools.db"
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	t.Run("Pragmas", func(t *testing.T) {
+		var journalMode string
+		if err := s.readDB.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil || journalMode != "wal" {
+			t.Errorf("expected wal journal mode, got %q: %v", journalMode, err)
+		}
+		var foreignKeys int
+		if err := s.db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+			t.Errorf("expected foreign keys to be enabled, got %v: %v", foreignKeys, err)
+		}
+		if _, err := s.readDB.Exec("INSERT INTO account(balance) VALUES (1)"); err == nil {
+			t.Error("expected read pool to reject writes")
+		}
+	})
+
+	t.Run("ConcurrentReadsAndWrites", func(t *testing.T) {
+		accFrom, _ := s.InsertAccount(ctx, 100000)
+		accTo, _ := s.InsertAccount(ctx, 0)
+		n := 200
+		errs := make(chan error, 2*n)
+		for i := 0; i < n; i++ {
+			go func() {
+				errs <- s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 10)
+			}()
+			go func() {
+				_, err := s.GetTransactionsHistory(ctx, accTo.AccountID, 1, 10)
+				errs <- err
+			}()
+		}
+		for i := 0; i < 2*n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		acc, err := s.GetAccount(ctx, accTo.AccountID)
+		if err != nil || acc.Balance != int64(n*10) {
+			t.Errorf("expected balance %v, got %v: %v", n*10, acc.Balance, err)
+		}
+	})
+}
+
+func benchmarkStore(b *testing.B, opts Options, bench func(b *testing.B, s *Store, accIds []int64)) {
+	ctx := context.Background()
+	dbPath := "/tmp/bench.db"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath + "-wal")
+	defer os.RemoveAll(dbPath + "-shm")
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	s, err := NewWithOptions(dbPath, 10, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	accIds := make([]int64, 0, 100)
+	for i := 0; i < 100; i++ {
+		acc, err := s.InsertAccount(ctx, 1<<40)
+		if err != nil {
+			b.Fatal(err)
+		}
+		accIds = append(accIds, acc.AccountID)
+	}
+	b.ResetTimer()
+	bench(b, s, accIds)
+}
+
+func BenchmarkSqlStore(b *testing.B) {
+	ctx := context.Background()
+	rollback := DefaultOptions()
+	rollback.JournalMode = "DELETE"
+	rollback.Synchronous = "FULL"
+	configs := []struct {
+		name string
+		opts Options
+	}{
+		{"WAL", DefaultOptions()},
+		{"RollbackJournal", rollback},
+	}
+
+	for _, c := range configs {
+		b.Run(c.name+"/TransferParallel", func(b *testing.B) {
+			benchmarkStore(b, c.opts, func(b *testing.B, s *Store, accIds []int64) {
+				var i int64
+				var mx sync.Mutex
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						mx.Lock()
+						i++
+						from, to := accIds[i%int64(len(accIds))], accIds[(i+1)%int64(len(accIds))]
+						mx.Unlock()
+						if err := s.TransferMoney(ctx, to, from, 1); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		})
+
+		b.Run(c.name+"/GetAccountParallel", func(b *testing.B) {
+			benchmarkStore(b, c.opts, func(b *testing.B, s *Store, accIds []int64) {
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						i++
+						if _, err := s.GetAccount(ctx, accIds[i%len(accIds)]); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		})
+
+		b.Run(c.name+"/MixedParallel", func(b *testing.B) {
+			benchmarkStore(b, c.opts, func(b *testing.B, s *Store, accIds []int64) {
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						i++
+						accId := accIds[i%len(accIds)]
+						var err error
+						// one write per ten reads
+						if i%10 == 0 {
+							err = s.TransferMoney(ctx, accIds[(i+1)%len(accIds)], accId, 1)
+						} else {
+							_, err = s.GetAccount(ctx, accId)
+						}
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/tets_backup.db"
+	backupPath := "/tmp/tets_backup_copy.db"
+	restorePath := "/tmp/tets_restored.db"
+	for _, path := range []string{dbPath, backupPath, restorePath} {
+		defer os.RemoveAll(path + lockFileSuffix)
+		defer os.RemoveAll(path)
+	}
+
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	acc, _ := s.InsertAccount(ctx, 500)
+
+	t.Run("Backup", func(t *testing.T) {
+		if err := s.Backup(backupPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Backup(backupPath); !errors.Is(err, backupExistsErr) {
+			t.Errorf("expected existing backup not to be overwritten, got %v", err)
+		}
+		version, err := ValidateBackup(backupPath)
+		if err != nil || version != LatestSchemaVersion() {
+			t.Errorf("expected valid backup of version %v, got %v: %v", LatestSchemaVersion(), version, err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		// restored db replaces the existing one
+		restored, err := New(restorePath, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Restore(restorePath, backupPath); !errors.Is(err, dbLockedErr) {
+			t.Errorf("expected db in use not to be restored, got %v", err)
+		}
+		restored.Close()
+		if _, err := Restore(restorePath, backupPath); err != nil {
+			t.Fatal(err)
+		}
+		restored, err = New(restorePath, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		if got, err := restored.GetAccount(ctx, acc.AccountID); err != nil || got.Balance != 500 {
+			t.Errorf("expected account to be restored, got %v: %v", got, err)
+		}
+	})
+
+	t.Run("RejectInvalid", func(t *testing.T) {
+		garbage := "/tmp/tets_garbage.db"
+		defer os.RemoveAll(garbage)
+		ioutil.WriteFile(garbage, []byte("definitely not a database file, but long enough to be checked"), 0644)
+		if _, err := Restore(restorePath, garbage); !errors.Is(err, backupCorruptedErr) {
+			t.Errorf("expected corrupted backup error, got %v", err)
+		}
+
+		newer, err := Open(backupPath, 10, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		newer.db.Exec("INSERT INTO schema_version(version) VALUES (?)", LatestSchemaVersion()+1)
+		newer.Close()
+		if _, err := Restore(restorePath, backupPath); !errors.Is(err, newerSchemaErr) {
+			t.Errorf("expected newer schema error, got %v", err)
+		}
+	})
+}
+
+func TestReplica(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/tets_primary.db"
+	replicaPath := "/tmp/tets_replica.db"
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+	defer os.RemoveAll(replicaPath)
+
+	// state written before the replica is enabled is copied on start
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accFrom, _ := s.InsertAccount(ctx, 1000)
+	s.Close()
+
+	opts := DefaultOptions()
+	opts.ReplicaPath = replicaPath
+	opts.ReplicaInterval = 10 * time.Millisecond
+	s, err = NewWithOptions(dbPath, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	waitForReplica := func() {
+		for i := 0; i < 100; i++ {
+			if lag, err := s.ReplicaLag(); err == nil && lag == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("replica has not caught up")
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		// NOTE: shared suite expects to read its own writes
+		store.TestStore(s.Strong(), t)
+	})
+
+	t.Run("CatchUp", func(t *testing.T) {
+		acc, err := s.GetAccount(ctx, accFrom.AccountID)
+		if err != nil || acc.Balance != 1000 {
+			t.Errorf("expected initial state in the replica, got %v: %v", acc, err)
+		}
+
+		accTo, _ := s.InsertAccount(ctx, 0)
+		if err := s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 300); err != nil {
+			t.Fatal(err)
+		}
+		strong, err := s.Strong().GetAccount(ctx, accTo.AccountID)
+		if err != nil || strong.Balance != 300 {
+			t.Errorf("expected strong read to see the write, got %v: %v", strong, err)
+		}
+
+		waitForReplica()
+		acc, err = s.GetAccount(ctx, accTo.AccountID)
+		if err != nil || acc.Balance != 300 {
+			t.Errorf("expected replicated balance 300, got %v: %v", acc, err)
+		}
+		tr, err := s.GetTransactionsHistory(ctx, accTo.AccountID, 1, 10)
+		if err != nil || len(tr) != 1 || tr[0].Amount != 300 {
+			t.Errorf("expected replicated transaction, got %v: %v", tr, err)
+		}
+
+		if err := s.DeleteAccount(ctx, accTo.AccountID, store.AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		waitForReplica()
+		if _, err := s.GetAccount(ctx, accTo.AccountID); err == nil {
+			t.Error("expected deleted account to be removed from the replica")
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	dbPath := "/tmp/tets_audit.db"
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	// NOTE: changes made without the audit info are not recorded
+	if _, err := s.InsertAccount(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	ctx := store.WithAuditInfo(context.Background(), store.AuditInfo{
+		Actor:     "tester",
+		SourceIP:  "127.0.0.1",
+		RequestID: "req-1",
+	})
+	accFrom, err := s.InsertAccount(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accTo, err := s.InsertAccount(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 5000); err == nil {
+		t.Fatal("Transfer must fail")
+	}
+	if err := s.DeleteAccount(ctx, accTo.AccountID, store.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendAudit(ctx, models.AuditLogLevelChanged, "config:log_level", nil, map[string]string{"level": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendAudit(context.Background(), models.AuditLogLevelChanged, "config:log_level", nil, nil); !errors.Is(err, auditInfoMissingErr) {
+		t.Errorf("expected %v, got %v", auditInfoMissingErr, err)
+	}
+
+	entries, err := s.GetAuditLog(context.Background(), AuditFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		models.AuditAccountCreated,
+		models.AuditAccountCreated,
+		models.AuditTransferCompleted,
+		models.AuditAccountDeleted,
+		models.AuditLogLevelChanged,
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %v entries, got %v", len(expected), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Action != expected[i] || entry.Actor != "tester" || entry.RequestID != "req-1" {
+			t.Errorf("Audit entry %v corrupted: %+v", i, entry)
+		}
+	}
+	transfer := entries[2]
+	if transfer.Before == nil || transfer.After == nil {
+		t.Error("Transfer state is not recorded")
+	}
+	if entries[3].Before == nil || entries[3].After != nil {
+		t.Error("Deleted account state is not recorded")
+	}
+
+	deleted, err := s.GetAuditLog(context.Background(), AuditFilter{Action: models.AuditAccountDeleted, Limit: 10})
+	if err != nil || len(deleted) != 1 || deleted[0].AuditID != entries[3].AuditID {
+		t.Errorf("Audit filter corrupted: %v", err)
+	}
+	paged, err := s.GetAuditLog(context.Background(), AuditFilter{AfterID: entries[3].AuditID, Limit: 10})
+	if err != nil || len(paged) != 1 {
+		t.Errorf("Audit paging corrupted: %v", err)
+	}
+
+	res, err := s.VerifyAuditLog(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Entries != int64(len(expected)) || res.LastHash != entries[len(entries)-1].Hash {
+		t.Errorf("Audit verification corrupted: %+v", res)
+	}
+
+	if _, err := s.db.Exec("UPDATE audit_log SET actor='intruder' WHERE audit_id=?", transfer.AuditID); err == nil {
+		t.Fatal("Audit log must be append-only")
+	}
+	if _, err := s.db.Exec("DELETE FROM audit_log WHERE audit_id=?", transfer.AuditID); err == nil {
+		t.Fatal("Audit log must be append-only")
+	}
+	// NOTE: whoever has the access to the file can drop the trigger, but it's detected
+	if _, err := s.db.Exec("DROP TRIGGER audit_log_no_update"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("UPDATE audit_log SET after_value='{}' WHERE audit_id=?", transfer.AuditID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VerifyAuditLog(context.Background()); !errors.Is(err, auditChainBrokenErr) {
+		t.Errorf("expected %v, got %v", auditChainBrokenErr, err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	dbPath := "/tmp/tets_apikeys.db"
+	s, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.RemoveAll(dbPath + lockFileSuffix)
+	defer os.RemoveAll(dbPath)
+
+	ctx := store.WithAuditInfo(context.Background(), store.AuditInfo{Actor: "tester"})
+	key, err := s.InsertAPIKey(ctx, models.APIKey{
+		KeyID:      "mt_1",
+		Name:       "reporting",
+		Scopes:     []string{models.ScopeAccountsRead, models.ScopeTransfersCreate},
+		SecretHash: "hash-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.CreatedAt.IsZero() || len(key.Scopes) != 2 || key.RotatedAt != nil || key.RevokedAt != nil {
+		t.Errorf("API key corrupted: %+v", key)
+	}
+	if _, err := s.InsertAPIKey(ctx, key); err == nil {
+		t.Error("Key id must be unique")
+	}
+	if _, err := s.GetAPIKey(ctx, "mt_2"); !errors.Is(err, store.APIKeyNotFoundErr) {
+		t.Errorf("expected %v, got %v", store.APIKeyNotFoundErr, err)
+	}
+
+	rotated, err := s.RotateAPIKey(ctx, key.KeyID, "hash-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.SecretHash != "hash-2" || rotated.RotatedAt == nil || rotated.Name != key.Name {
+		t.Errorf("API key rotation corrupted: %+v", rotated)
+	}
+	if err := s.RevokeAPIKey(ctx, key.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeAPIKey(ctx, key.KeyID); !errors.Is(err, store.APIKeyNotFoundErr) {
+		t.Errorf("expected %v, got %v", store.APIKeyNotFoundErr, err)
+	}
+	if _, err := s.RotateAPIKey(ctx, key.KeyID, "hash-3"); !errors.Is(err, store.APIKeyNotFoundErr) {
+		t.Errorf("expected revoked key not to be rotated, got %v", err)
+	}
+	keys, err := s.ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].RevokedAt == nil || keys[0].SecretHash != "hash-2" {
+		t.Errorf("API keys corrupted: %+v", keys)
+	}
+
+	entries, err := s.GetAuditLog(ctx, AuditFilter{Resource: "apikey:mt_1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Action != models.AuditAPIKeyRotated || entries[2].Action != models.AuditAPIKeyRevoked {
+		t.Errorf("API key changes are not audited: %+v", entries)
+	}
+	for _, entry := range entries {
+		if strings.Contains(string(entry.Before)+string(entry.After), "hash-") {
+			t.Error("Secret hash must not be recorded in the audit log")
+		}
+	}
 }
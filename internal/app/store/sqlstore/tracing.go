@@ -0,0 +1,97 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/gasparian/money-transfers-api/internal/app/tracing"
+	"github.com/mattn/go-sqlite3"
+)
+
+// TracedDriverName is the sqlite driver which records every statement as a span
+// of the trace held by the query context; it's used by all the sqlite dbs of the api
+const TracedDriverName = "sqlite3_traced"
+
+func init() {
+	sql.Register(TracedDriverName, &tracedDriver{driver: &sqlite3.SQLiteDriver{}})
+}
+
+type tracedDriver struct {
+	driver driver.Driver
+}
+
+func (d *tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{conn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// tracedConn delegates to the sqlite connection; the context-aware methods are kept,
+// so database/sql runs queries directly instead of preparing them first
+type tracedConn struct {
+	conn *sqlite3.SQLiteConn
+}
+
+// startStatement starts client span of the statement named by its first keyword
+func startStatement(ctx context.Context, query string) *tracing.Span {
+	if tracing.FromContext(ctx) == nil {
+		return nil
+	}
+	name := "SQL"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		name = strings.ToUpper(fields[0])
+	}
+	_, span := tracing.StartKind(ctx, name, tracing.SpanKindClient)
+	span.SetAttribute("db.system", "sqlite")
+	span.SetAttribute("db.statement", query)
+	return span
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.PrepareContext(ctx, query)
+}
+
+func (c *tracedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *tracedConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	span := startStatement(ctx, "BEGIN")
+	tx, err := c.conn.BeginTx(ctx, opts)
+	span.SetError(err)
+	span.End()
+	return tx, err
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	span := startStatement(ctx, query)
+	res, err := c.conn.ExecContext(ctx, query, args)
+	span.SetError(err)
+	span.End()
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	// NOTE: the span covers execution of the statement, not reading of the rows
+	span := startStatement(ctx, query)
+	rows, err := c.conn.QueryContext(ctx, query, args)
+	span.SetError(err)
+	span.End()
+	return rows, err
+}
@@ -0,0 +1,229 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// timestampLayout matches the default value of the timestamp columns, so explicit and default
+// timestamps are compared the same way
+const timestampLayout = "2006-01-02 15:04:05.000"
+
+// TransferLeg is the part of the transfer which touches a single account of the store:
+// the debit when AccountID is the sender, the credit when it's the recipient
+type TransferLeg struct {
+	TransactionID int64
+	AccountID     int64
+	FromAccountID int64
+	ToAccountID   int64
+	Amount        int64
+	Timestamp     time.Time
+}
+
+func (l TransferLeg) isDebit() bool {
+	return l.AccountID == l.FromAccountID
+}
+
+// Prepare is the first phase of the two-phase commit: it durably records the leg and promises
+// to apply it later. Debited money is taken from the balance right away, so it can't be spent twice
+// while the transfer is in doubt; the credit only checks that the recipient exists
+func (s *Store) Prepare(ctx context.Context, leg TransferLeg) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var found int64
+	if leg.isDebit() {
+		var res sql.Result
+		res, err = tx.ExecContext(
+			ctx,
+			"UPDATE account SET balance = balance - ?, version = version + 1 WHERE account_id=?",
+			leg.Amount,
+			leg.AccountID,
+		)
+		if err == nil {
+			found, err = res.RowsAffected()
+		}
+	} else {
+		err = tx.QueryRowContext(
+			ctx,
+			"SELECT COUNT(*) FROM account WHERE account_id=?",
+			leg.AccountID,
+		).Scan(&found)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if found == 0 {
+		tx.Rollback()
+		return accNotFoundErr
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO prepared_transfer(transaction_id, account_id, timestamp, from_account_id, to_account_id, amount)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		leg.TransactionID,
+		leg.AccountID,
+		leg.Timestamp.UTC().Format(timestampLayout),
+		leg.FromAccountID,
+		leg.ToAccountID,
+		leg.Amount,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// preparedLegs returns legs of the transaction prepared in this store
+func preparedLegs(ctx context.Context, tx *sql.Tx, transactionId int64) ([]TransferLeg, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT transaction_id, account_id, timestamp, from_account_id, to_account_id, amount
+		FROM prepared_transfer WHERE transaction_id=?`,
+		transactionId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var legs []TransferLeg
+	for rows.Next() {
+		var (
+			leg TransferLeg
+			ts  string
+		)
+		err := rows.Scan(&leg.TransactionID, &leg.AccountID, &ts, &leg.FromAccountID, &leg.ToAccountID, &leg.Amount)
+		if err != nil {
+			return nil, err
+		}
+		leg.Timestamp, err = time.Parse(timestampLayout, ts)
+		if err != nil {
+			return nil, err
+		}
+		legs = append(legs, leg)
+	}
+	return legs, rows.Err()
+}
+
+// CommitPrepared applies prepared legs of the transaction: credits the recipient
+// and records the transaction in the history. Committing already resolved transaction is a no-op,
+// so the coordinator can safely repeat it after the crash
+func (s *Store) CommitPrepared(ctx context.Context, transactionId int64) error {
+	return s.resolvePrepared(ctx, transactionId, true)
+}
+
+// AbortPrepared gives debited money back and forgets prepared legs of the transaction;
+// aborting already resolved transaction is a no-op
+func (s *Store) AbortPrepared(ctx context.Context, transactionId int64) error {
+	return s.resolvePrepared(ctx, transactionId, false)
+}
+
+func (s *Store) resolvePrepared(ctx context.Context, transactionId int64, commit bool) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	legs, err := preparedLegs(ctx, tx, transactionId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, leg := range legs {
+		if err := resolveLeg(ctx, tx, leg, commit); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM prepared_transfer WHERE transaction_id=?", transactionId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func resolveLeg(ctx context.Context, tx *sql.Tx, leg TransferLeg, commit bool) error {
+	var delta int64
+	switch {
+	case commit && !leg.isDebit():
+		delta = leg.Amount
+	case !commit && leg.isDebit():
+		delta = leg.Amount
+	}
+	if delta != 0 {
+		res, err := tx.ExecContext(
+			ctx,
+			"UPDATE account SET balance = balance + ?, version = version + 1 WHERE account_id=?",
+			delta,
+			leg.AccountID,
+		)
+		if err != nil {
+			return err
+		}
+		// NOTE: accounts with prepared legs can't be deleted, so it never happens
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = accNotFoundErr
+			}
+			return err
+		}
+	}
+	if !commit {
+		return nil
+	}
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT OR IGNORE INTO transactions(transaction_id, timestamp, from_account_id, to_account_id, amount)
+		VALUES (?, ?, ?, ?, ?)`,
+		leg.TransactionID,
+		leg.Timestamp.UTC().Format(timestampLayout),
+		leg.FromAccountID,
+		leg.ToAccountID,
+		leg.Amount,
+	)
+	if err != nil || !leg.isDebit() {
+		return err
+	}
+	// the event is written once, by the store of the sender
+	return insertOutboxEvent(ctx, tx, models.TransferCompletedEvent, transferEventPayload{
+		TransactionID: leg.TransactionID,
+		FromAccountID: leg.FromAccountID,
+		ToAccountID:   leg.ToAccountID,
+		Amount:        leg.Amount,
+	})
+}
+
+// PreparedTransactions returns ids of the transactions which have prepared legs in this store
+func (s *Store) PreparedTransactions() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT transaction_id FROM prepared_transfer ORDER BY transaction_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
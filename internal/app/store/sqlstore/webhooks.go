@@ -0,0 +1,259 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// InsertWebhook registers new webhook url
+func (s *Store) InsertWebhook(url, secret string) (models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	var hook models.Webhook
+	res, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO webhook(url, secret) VALUES (?, ?)",
+		url,
+		secret,
+	)
+	if err != nil {
+		return hook, err
+	}
+	hookId, err := res.LastInsertId()
+	if err != nil {
+		return hook, err
+	}
+	return s.GetWebhook(hookId)
+}
+
+// DeleteWebhook removes webhook from the registry
+func (s *Store) DeleteWebhook(webhookId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM webhook WHERE webhook_id=?",
+		webhookId,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return webhookNotFoundErr
+	}
+	return nil
+}
+
+// GetWebhook returns webhook model
+func (s *Store) GetWebhook(webhookId int64) (models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	var hook models.Webhook
+	err := s.readDB.QueryRowContext(
+		ctx,
+		"SELECT webhook_id, created_at, url, secret FROM webhook WHERE webhook_id=?",
+		webhookId,
+	).Scan(
+		&hook.WebhookID,
+		&hook.CreatedAt,
+		&hook.URL,
+		&hook.Secret,
+	)
+	return hook, err
+}
+
+// ListWebhooks returns all registered webhooks
+func (s *Store) ListWebhooks() ([]models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		"SELECT webhook_id, created_at, url, secret FROM webhook ORDER BY webhook_id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []models.Webhook
+	for rows.Next() {
+		hook := models.Webhook{}
+		err := rows.Scan(
+			&hook.WebhookID,
+			&hook.CreatedAt,
+			&hook.URL,
+			&hook.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, hook)
+	}
+	return res, rows.Err()
+}
+
+// InsertDelivery writes new record into the deliveries log
+func (s *Store) InsertDelivery(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO webhook_delivery(webhook_id, event_type, payload, status, attempts, last_error, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		delivery.WebhookID,
+		delivery.EventType,
+		delivery.Payload,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.LastError,
+		nextAttemptValue(delivery.NextAttemptAt),
+	)
+	if err != nil {
+		return delivery, err
+	}
+	deliveryId, err := res.LastInsertId()
+	if err != nil {
+		return delivery, err
+	}
+	return s.GetDelivery(deliveryId)
+}
+
+// UpdateDelivery saves status of the delivery after an attempt
+func (s *Store) UpdateDelivery(delivery models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE webhook_delivery SET
+		status=?, attempts=?, last_error=?, next_attempt_at=?, updated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')
+		WHERE delivery_id=?`,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.LastError,
+		nextAttemptValue(delivery.NextAttemptAt),
+		delivery.DeliveryID,
+	)
+	return err
+}
+
+const deliveryColumns = `delivery_id, webhook_id, created_at, updated_at,
+	event_type, payload, status, attempts, last_error, next_attempt_at`
+
+// nextAttemptValue stores zero time as NULL, so the delivery is due right away
+func nextAttemptValue(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(timestampLayout)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDelivery(row scanner) (models.WebhookDelivery, error) {
+	var (
+		delivery    models.WebhookDelivery
+		nextAttempt sql.NullString
+	)
+	err := row.Scan(
+		&delivery.DeliveryID,
+		&delivery.WebhookID,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.LastError,
+		&nextAttempt,
+	)
+	if err != nil || !nextAttempt.Valid {
+		return delivery, err
+	}
+	delivery.NextAttemptAt, err = time.Parse(timestampLayout, nextAttempt.String)
+	return delivery, err
+}
+
+// GetDelivery returns delivery log record
+func (s *Store) GetDelivery(deliveryId int64) (models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	return scanDelivery(s.readDB.QueryRowContext(
+		ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_delivery WHERE delivery_id=?",
+		deliveryId,
+	))
+}
+
+// GetDeliveries returns deliveries with the requested status, oldest first
+func (s *Store) GetDeliveries(status string, limit int64) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_delivery WHERE status=? ORDER BY delivery_id LIMIT ?",
+		status,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, delivery)
+	}
+	return res, rows.Err()
+}
+
+// GetDueDeliveries returns deliveries with the requested status whose next attempt is due by now,
+// most overdue first
+func (s *Store) GetDueDeliveries(status string, now time.Time, limit int64) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.readDB.QueryContext(
+		ctx,
+		`SELECT `+deliveryColumns+` FROM webhook_delivery
+		WHERE status=? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)
+		ORDER BY next_attempt_at, delivery_id LIMIT ?`,
+		status,
+		now.UTC().Format(timestampLayout),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, delivery)
+	}
+	return res, rows.Err()
+}
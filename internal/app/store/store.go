@@ -1,14 +1,57 @@
 package store
 
 import (
+	"context"
+	"errors"
+
 	"github.com/gasparian/money-transfers-api/internal/app/models"
 )
 
+// AnyVersion skips the version check of the account
+const AnyVersion int64 = 0
+
+// VersionConflictErr is returned when the account has changed since the version expected by the caller
+var VersionConflictErr = errors.New("Account version doesn't match")
+
+// AccountNotFoundErr is returned when the account doesn't exist or it's removed
+var AccountNotFoundErr = errors.New("Account not found")
+
+// WebhookNotFoundErr is returned when the webhook doesn't exist or it's removed
+var WebhookNotFoundErr = errors.New("Webhook not found")
+
+// APIKeyNotFoundErr is returned when the api key doesn't exist or it's revoked
+var APIKeyNotFoundErr = errors.New("API key not found")
+
 // Store ...
+// Every method is bound to the context: cancelled or expired context aborts the operation
 type Store interface {
-	InsertAccount(balance int64) (models.Account, error)
-	DeleteAccount(accountId int64) error
-	GetAccount(accountId int64) (models.Account, error)
-	TransferMoney(accountToId, accountFromId, amount int64) error
-	GetTransactionsHistory(accountId, nLastDays, limit int64) ([]models.Transaction, error)
+	// Ping checks that the store is able to serve requests
+	Ping(ctx context.Context) error
+	InsertAccount(ctx context.Context, balance int64) (models.Account, error)
+	// DeleteAccount removes the account if its version is still the expected one
+	DeleteAccount(ctx context.Context, accountId, version int64) error
+	GetAccount(ctx context.Context, accountId int64) (models.Account, error)
+	TransferMoney(ctx context.Context, accountToId, accountFromId, amount int64) error
+	GetTransactionsHistory(ctx context.Context, accountId, nLastDays, limit int64) ([]models.Transaction, error)
+}
+
+// AuditInfo describes who makes the change; stores which keep the audit log
+// record changes made with the context holding it
+type AuditInfo struct {
+	Actor     string
+	SourceIP  string
+	RequestID string
+}
+
+type auditInfoKey struct{}
+
+// WithAuditInfo returns copy of ctx holding the audit info
+func WithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+// AuditInfoFrom returns the audit info held by ctx
+func AuditInfoFrom(ctx context.Context) (AuditInfo, bool) {
+	info, ok := ctx.Value(auditInfoKey{}).(AuditInfo)
+	return info, ok
 }
@@ -1,20 +1,26 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"testing"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+	"github.com/gasparian/money-transfers-api/internal/app/pubsub"
 )
 
 var (
 	invalidBalanceValueErr      = errors.New("Invalid balance value")
 	transactionCorruptedErr     = errors.New("Transaction corrupted")
 	accountDeletionCorruptedErr = errors.New("Account deletion corrupted")
+	eventsReorderedErr          = errors.New("Balance events are out of the commit order")
 )
 
 func TestStore(store Store, t *testing.T) {
+	ctx := context.Background()
 	t.Run("InsertAccount", func(t *testing.T) {
 		var balance int64 = 1005
-		acc, err := store.InsertAccount(balance)
+		acc, err := store.InsertAccount(ctx, balance)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -23,36 +29,43 @@ func TestStore(store Store, t *testing.T) {
 		}
 	})
 
+	t.Run("Ping", func(t *testing.T) {
+		if err := store.Ping(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
 	t.Run("DeleteAccount", func(t *testing.T) {
-		acc, err := store.InsertAccount(1005)
+		acc, err := store.InsertAccount(ctx, 1005)
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = store.DeleteAccount(acc.AccountID)
+		err = store.DeleteAccount(ctx, acc.AccountID, AnyVersion)
 		if err != nil {
 			t.Error(err)
 		}
-		_, err = store.GetAccount(acc.AccountID)
+		_, err = store.GetAccount(ctx, acc.AccountID)
 		if err == nil {
 			t.Error(invalidBalanceValueErr)
 		}
 
-		err = store.DeleteAccount(100)
+		err = store.DeleteAccount(ctx, 100, AnyVersion)
 		if err == nil {
 			t.Error(accountDeletionCorruptedErr)
 		}
 	})
 
 	t.Run("TransferGetAccount", func(t *testing.T) {
-		accFrom, err := store.InsertAccount(10000)
+		accFrom, err := store.InsertAccount(ctx, 10000)
 		if err != nil {
 			t.Fatal(err)
 		}
-		accTo, err := store.InsertAccount(1000)
+		accTo, err := store.InsertAccount(ctx, 1000)
 		if err != nil {
 			t.Fatal(err)
 		}
 		err = store.TransferMoney(
+			ctx,
 			accTo.AccountID,
 			accFrom.AccountID,
 			9000,
@@ -60,11 +73,11 @@ func TestStore(store Store, t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		accToNew, err := store.GetAccount(accTo.AccountID)
+		accToNew, err := store.GetAccount(ctx, accTo.AccountID)
 		if err != nil {
 			t.Fatal(err)
 		}
-		accFromNew, err := store.GetAccount(accFrom.AccountID)
+		accFromNew, err := store.GetAccount(ctx, accFrom.AccountID)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -74,15 +87,16 @@ func TestStore(store Store, t *testing.T) {
 	})
 
 	t.Run("TransferNegativeResult", func(t *testing.T) {
-		accFrom, err := store.InsertAccount(50)
+		accFrom, err := store.InsertAccount(ctx, 50)
 		if err != nil {
 			t.Fatal(err)
 		}
-		accTo, err := store.InsertAccount(1000)
+		accTo, err := store.InsertAccount(ctx, 1000)
 		if err != nil {
 			t.Fatal(err)
 		}
 		err = store.TransferMoney(
+			ctx,
 			accTo.AccountID,
 			accFrom.AccountID,
 			1150,
@@ -92,17 +106,76 @@ func TestStore(store Store, t *testing.T) {
 		}
 	})
 
+	t.Run("Versions", func(t *testing.T) {
+		accFrom, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accFrom.Version != 1 {
+			t.Errorf("expected initial version 1, got %v", accFrom.Version)
+		}
+		if err := store.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 10); err != nil {
+			t.Fatal(err)
+		}
+		for _, acc := range []models.Account{accFrom, accTo} {
+			current, err := store.GetAccount(ctx, acc.AccountID)
+			if err != nil || current.Version != acc.Version+1 {
+				t.Errorf("expected version %v after the transfer, got %v: %v", acc.Version+1, current.Version, err)
+			}
+		}
+		if err := store.DeleteAccount(ctx, accTo.AccountID, accTo.Version); !errors.Is(err, VersionConflictErr) {
+			t.Errorf("expected version conflict, got %v", err)
+		}
+		if err := store.DeleteAccount(ctx, accTo.AccountID, accTo.Version+1); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		accFrom, err := store.InsertAccount(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accTo, err := store.InsertAccount(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := store.InsertAccount(cancelled, 100); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled insert, got %v", err)
+		}
+		if err := store.TransferMoney(cancelled, accTo.AccountID, accFrom.AccountID, 100); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled transfer, got %v", err)
+		}
+		if _, err := store.GetAccount(cancelled, accFrom.AccountID); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled read, got %v", err)
+		}
+		if err := store.Ping(cancelled); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled ping, got %v", err)
+		}
+		accFromNew, err := store.GetAccount(ctx, accFrom.AccountID)
+		if err != nil || accFromNew.Balance != accFrom.Balance {
+			t.Error(transactionCorruptedErr)
+		}
+	})
+
 	t.Run("GetTransactions", func(t *testing.T) {
-		accFrom, err := store.InsertAccount(10000)
+		accFrom, err := store.InsertAccount(ctx, 10000)
 		if err != nil {
 			t.Fatal(err)
 		}
-		accTo, err := store.InsertAccount(0)
+		accTo, err := store.InsertAccount(ctx, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
 		for i := 0; i < 5; i++ {
 			err = store.TransferMoney(
+				ctx,
 				accTo.AccountID,
 				accFrom.AccountID,
 				2000,
@@ -113,6 +186,7 @@ func TestStore(store Store, t *testing.T) {
 		}
 
 		transactions, err := store.GetTransactionsHistory(
+			ctx,
 			accTo.AccountID, 1, 3,
 		)
 		if err != nil {
@@ -128,11 +202,11 @@ func TestStore(store Store, t *testing.T) {
 		if summ != 6000 {
 			t.Fatal(transactionCorruptedErr)
 		}
-		accToNew, err := store.GetAccount(accTo.AccountID)
+		accToNew, err := store.GetAccount(ctx, accTo.AccountID)
 		if err != nil {
 			t.Fatal(err)
 		}
-		accFromNew, _ := store.GetAccount(accFrom.AccountID)
+		accFromNew, _ := store.GetAccount(ctx, accFrom.AccountID)
 		if accFrom.Balance != accToNew.Balance || accTo.Balance != accFromNew.Balance {
 			t.Error(transactionCorruptedErr)
 		}
@@ -140,11 +214,12 @@ func TestStore(store Store, t *testing.T) {
 }
 
 func TestStoreConcurrentTransfer(store Store, t *testing.T) {
-	accFrom, err := store.InsertAccount(10000)
+	ctx := context.Background()
+	accFrom, err := store.InsertAccount(ctx, 10000)
 	if err != nil {
 		t.Fatal(err)
 	}
-	accTo, err := store.InsertAccount(0)
+	accTo, err := store.InsertAccount(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -154,6 +229,7 @@ func TestStoreConcurrentTransfer(store Store, t *testing.T) {
 	for i := 0; i < n; i++ {
 		go func(accToId, accFromId int64) {
 			err := store.TransferMoney(
+				ctx,
 				accToId,
 				accFromId,
 				100,
@@ -169,11 +245,11 @@ func TestStoreConcurrentTransfer(store Store, t *testing.T) {
 		}
 	}
 
-	accToNew, err := store.GetAccount(accTo.AccountID)
+	accToNew, err := store.GetAccount(ctx, accTo.AccountID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	accFromNew, err := store.GetAccount(accFrom.AccountID)
+	accFromNew, err := store.GetAccount(ctx, accFrom.AccountID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -181,3 +257,45 @@ func TestStoreConcurrentTransfer(store Store, t *testing.T) {
 		t.Fatal(invalidBalanceValueErr)
 	}
 }
+
+// TestStoreEventsOrder checks that `balance.changed` events of concurrent transfers
+// reach the subscriber in the commit order; broker must be already set to the store
+func TestStoreEventsOrder(store Store, broker *pubsub.Broker, t *testing.T) {
+	ctx := context.Background()
+	accFrom, err := store.InsertAccount(ctx, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accTo, err := store.InsertAccount(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := broker.Subscribe(accFrom.AccountID)
+	defer sub.Unsubscribe()
+
+	// NOTE: every transfer produces two events, so they fit into the subscription buffer
+	n := 30
+	errs := make(chan error)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- store.TransferMoney(ctx, accTo.AccountID, accFrom.AccountID, 100)
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	balance := accFrom.Balance
+	for i := 0; i < 2*n; i++ {
+		event := <-sub.C
+		if event.Type != pubsub.BalanceChanged {
+			continue
+		}
+		if event.Balance != balance-100 {
+			t.Fatalf("%v: expected balance %v, got %v", eventsReorderedErr, balance-100, event.Balance)
+		}
+		balance = event.Balance
+	}
+}
@@ -0,0 +1,273 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// instrumentationScope is the name of the instrumentation reported to the collector
+const instrumentationScope = "github.com/gasparian/money-transfers-api"
+
+var (
+	badResponseCodeErr = errors.New("Collector responded with non-2xx status code")
+	unknownExporterErr = errors.New("Unknown trace exporter")
+)
+
+// spanRecord is the json line written by the WriterExporter
+type spanRecord struct {
+	Service      string                 `json:"service"`
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"`
+	Start        time.Time              `json:"start"`
+	DurationUs   int64                  `json:"duration_us"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// WriterExporter writes spans as json lines, it's meant for the local testing
+type WriterExporter struct {
+	mx      sync.Mutex
+	w       io.Writer
+	service string
+}
+
+// NewWriterExporter creates exporter on top of any writer
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{w: w, service: service}
+}
+
+// NewStdoutExporter creates exporter which prints spans to stdout
+func NewStdoutExporter(service string) *WriterExporter {
+	return NewWriterExporter(os.Stdout, service)
+}
+
+// Export writes out the spans
+func (e *WriterExporter) Export(spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, span := range spans {
+		rec := spanRecord{
+			Service:    e.service,
+			TraceID:    span.SpanContext.TraceID.String(),
+			SpanID:     span.SpanContext.SpanID.String(),
+			Name:       span.Name,
+			Kind:       span.Kind,
+			Start:      span.Start,
+			DurationUs: span.End.Sub(span.Start).Microseconds(),
+			Error:      span.Error,
+		}
+		if span.ParentSpanID.IsValid() {
+			rec.ParentSpanID = span.ParentSpanID.String()
+		}
+		if len(span.Attributes) > 0 {
+			rec.Attributes = make(map[string]interface{}, len(span.Attributes))
+			for _, attr := range span.Attributes {
+				rec.Attributes[attr.Key] = attr.Value
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+// FileExporter appends spans to the file
+type FileExporter struct {
+	WriterExporter
+	f *os.File
+}
+
+// NewFileExporter opens file for appending
+func NewFileExporter(path, service string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{
+		WriterExporter: WriterExporter{w: f, service: service},
+		f:              f,
+	}, nil
+}
+
+// Close closes underlying file
+func (e *FileExporter) Close() error {
+	return e.f.Close()
+}
+
+// OTLPExporter posts spans to the collector using OTLP over http with json encoding
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// NewOTLPExporter creates exporter for the collector endpoint, e.g. `http://localhost:4318/v1/traces`
+func NewOTLPExporter(url, service string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpStatus codes: 0 is unset, 2 is error
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of the fields; 64-bit ints are encoded as strings in OTLP json
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOTLPValue(v interface{}) otlpValue {
+	str := func(s string) otlpValue { return otlpValue{StringValue: &s} }
+	integer := func(i int64) otlpValue {
+		s := strconv.FormatInt(i, 10)
+		return otlpValue{IntValue: &s}
+	}
+	switch v := v.(type) {
+	case string:
+		return str(v)
+	case int:
+		return integer(int64(v))
+	case int64:
+		return integer(v)
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	default:
+		return str(fmt.Sprint(v))
+	}
+}
+
+func newOTLPRequest(service string, spans []SpanData) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.SpanContext.TraceID.String(),
+			SpanID:            span.SpanContext.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID.IsValid() {
+			s.ParentSpanID = span.ParentSpanID.String()
+		}
+		for _, attr := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{Key: attr.Key, Value: newOTLPValue(attr.Value)})
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		out = append(out, s)
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: newOTLPValue(service)}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: instrumentationScope},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+// Export posts the spans to the collector
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	b, err := json.Marshal(newOTLPRequest(e.service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", badResponseCodeErr, resp.StatusCode)
+	}
+	return nil
+}
+
+// NewExporter creates exporter by its name: `stdout`, `file` or `otlp`;
+// target holds file path or collector url respectively
+func NewExporter(kind, target, service string, timeout time.Duration) (Exporter, error) {
+	switch kind {
+	case "stdout":
+		return NewStdoutExporter(service), nil
+	case "file":
+		return NewFileExporter(target, service)
+	case "otlp":
+		return NewOTLPExporter(target, service, timeout), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", unknownExporterErr, kind)
+	}
+}
@@ -0,0 +1,434 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of the request
+const TraceparentHeader = "traceparent"
+
+// Kinds of the spans, values match the OTLP ones
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+var (
+	invalidTraceparentErr = errors.New("Invalid traceparent header")
+)
+
+// TraceID identifies the whole trace
+type TraceID [16]byte
+
+// SpanID identifies the span within the trace
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid reports whether the id is not all zeroes
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid reports whether the id is not all zeroes
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of the span propagated across the process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as the value of the traceparent header
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses the traceparent header: `{version}-{trace-id}-{parent-id}-{flags}`;
+// fields appended by the future versions are ignored
+func ParseTraceparent(h string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[3]) != 2 {
+		return sc, invalidTraceparentErr
+	}
+	version, err := decodeHex(parts[0], 1)
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return sc, invalidTraceparentErr
+	}
+	traceID, err := decodeHex(parts[1], len(sc.TraceID))
+	if err != nil {
+		return sc, invalidTraceparentErr
+	}
+	spanID, err := decodeHex(parts[2], len(sc.SpanID))
+	if err != nil {
+		return sc, invalidTraceparentErr
+	}
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return sc, invalidTraceparentErr
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, invalidTraceparentErr
+	}
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hex string of n bytes
+func decodeHex(s string, n int) ([]byte, error) {
+	if len(s) != 2*n || strings.ToLower(s) != s {
+		return nil, invalidTraceparentErr
+	}
+	return hex.DecodeString(s)
+}
+
+// Attribute is the key-value pair describing the span; values are strings, ints, floats or bools
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is the finished span handed to the exporter
+type SpanData struct {
+	Name         string
+	Kind         int
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error is the message of the error the span has failed with
+	Error string
+}
+
+// Span is the timed operation of the trace; methods of the nil span do nothing,
+// so the code doesn't have to check whether the request is traced
+type Span struct {
+	tracer *Tracer
+	mx     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SpanContext returns ids of the span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttribute sets the attribute, the existing one with the same key is replaced
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i := range s.data.Attributes {
+		if s.data.Attributes[i].Key == key {
+			s.data.Attributes[i].Value = value
+			return
+		}
+	}
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: value})
+}
+
+// SetError marks the span as failed; nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and queues it for export; only the first call has effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mx.Lock()
+	if s.ended {
+		s.mx.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mx.Unlock()
+	s.tracer.enqueue(data)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns copy of ctx holding the span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span held by ctx, nil if the request is not traced
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts the internal span as a child of the span held by ctx;
+// nothing is recorded if ctx holds no span
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, SpanKindInternal)
+}
+
+// StartKind starts the child span of the given kind, e.g. client span of the db call
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.data.SpanContext.TraceID, parent.data.SpanContext.SpanID)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Exporter sends batches of the finished spans
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Options holds settings of the tracer
+type Options struct {
+	// SampleRatio is the share of the traces started by the tracer which are recorded;
+	// traces continued from the incoming request follow the decision of the caller
+	SampleRatio   float64
+	BatchSize     int
+	FlushInterval time.Duration
+	// QueueSize bounds number of spans waiting for the export, spans above it are dropped
+	QueueSize int
+}
+
+// Tracer starts the root spans and exports the finished ones in batches from the background
+type Tracer struct {
+	exporter    Exporter
+	opts        Options
+	queue       chan SpanData
+	flush       chan chan struct{}
+	quit        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+	dropped     uint64
+	mx          sync.Mutex
+	errCallback func(error)
+}
+
+// NewTracer creates tracer and starts the export loop
+func NewTracer(exporter Exporter, opts Options) *Tracer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.QueueSize < opts.BatchSize {
+		opts.QueueSize = 4 * opts.BatchSize
+	}
+	t := &Tracer{
+		exporter: exporter,
+		opts:     opts,
+		queue:    make(chan SpanData, opts.QueueSize),
+		flush:    make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// OnError sets callback which is called on every failed export
+func (t *Tracer) OnError(f func(error)) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.errCallback = f
+}
+
+// Dropped returns number of the spans dropped since the queue was full
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// StartRoot starts the server span of the incoming request; it continues the remote trace
+// if the parent is valid, otherwise it starts the new one; returns nil span if the trace
+// is not sampled
+func (t *Tracer) StartRoot(ctx context.Context, name string, kind int, remote SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var (
+		traceID TraceID
+		parent  SpanID
+		sampled bool
+	)
+	if remote.IsValid() {
+		traceID, parent, sampled = remote.TraceID, remote.SpanID, remote.Sampled
+	} else {
+		rand.Read(traceID[:])
+		sampled = t.sample(traceID)
+	}
+	if !sampled {
+		return ctx, nil
+	}
+	span := t.newSpan(name, kind, traceID, parent)
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample decides by the trace id, so the decision is the same for the same trace
+func (t *Tracer) sample(traceID TraceID) bool {
+	switch {
+	case t.opts.SampleRatio >= 1:
+		return true
+	case t.opts.SampleRatio <= 0:
+		return false
+	}
+	var v uint64
+	for _, b := range traceID[8:] {
+		v = v<<8 | uint64(b)
+	}
+	return v>>1 < uint64(t.opts.SampleRatio*float64(math.MaxUint64>>1))
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID TraceID, parent SpanID) *Span {
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			ParentSpanID: parent,
+			Start:        time.Now(),
+		},
+	}
+	span.data.SpanContext.TraceID = traceID
+	span.data.SpanContext.Sampled = true
+	rand.Read(span.data.SpanContext.SpanID[:])
+	return span
+}
+
+// enqueue hands the span to the export loop, the span is dropped if the queue is full
+// or the tracer is stopped, so tracing never blocks the request
+func (t *Tracer) enqueue(span SpanData) {
+	select {
+	case <-t.quit:
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case t.queue <- span:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, t.opts.BatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			t.mx.Lock()
+			f := t.errCallback
+			t.mx.Unlock()
+			if f != nil {
+				f(err)
+			}
+		}
+		batch = make([]SpanData, 0, t.opts.BatchSize)
+	}
+	// drain moves all the queued spans into the batches
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= t.opts.BatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.opts.BatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			drain()
+			close(flushed)
+		case <-t.quit:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush exports all the queued spans, used in tests
+func (t *Tracer) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+		<-flushed
+	case <-t.done:
+	}
+}
+
+// Shutdown exports the queued spans, stops the loop and closes the exporter if it's closable
+func (t *Tracer) Shutdown() {
+	t.stopOnce.Do(func() {
+		close(t.quit)
+		<-t.done
+		if c, ok := t.exporter.(io.Closer); ok {
+			c.Close()
+		}
+	})
+}
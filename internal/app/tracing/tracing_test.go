@@ -0,0 +1,228 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memExporter struct {
+	mx    sync.Mutex
+	spans []SpanData
+}
+
+func (m *memExporter) Export(spans []SpanData) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+func (m *memExporter) get() []SpanData {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return append([]SpanData(nil), m.spans...)
+}
+
+func TestTracing(t *testing.T) {
+	t.Run("Traceparent", func(t *testing.T) {
+		h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		sc, err := ParseTraceparent(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+			t.Errorf("unexpected span context: %+v", sc)
+		}
+		if sc.Traceparent() != h {
+			t.Errorf("expected %s, got %s", h, sc.Traceparent())
+		}
+		// NOTE: future versions may append fields
+		if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); err != nil {
+			t.Error(err)
+		}
+		invalid := []string{
+			"",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		}
+		for _, h := range invalid {
+			if _, err := ParseTraceparent(h); !errors.Is(err, invalidTraceparentErr) {
+				t.Errorf("expected %q to be rejected", h)
+			}
+		}
+	})
+
+	t.Run("Spans", func(t *testing.T) {
+		exp := &memExporter{}
+		tracer := NewTracer(exp, Options{SampleRatio: 1})
+		defer tracer.Shutdown()
+
+		remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		ctx, root := tracer.StartRoot(context.Background(), "GET /api/v1/accounts", SpanKindServer, remote)
+		_, child := Start(ctx, "store.GetAccount")
+		child.SetAttribute("account_id", int64(1))
+		child.SetError(errors.New("Account not found"))
+		child.End()
+		child.End()
+		root.End()
+		tracer.Flush()
+
+		spans := exp.get()
+		if len(spans) != 2 {
+			t.Fatalf("expected 2 spans, got %d", len(spans))
+		}
+		c, r := spans[0], spans[1]
+		if r.SpanContext.TraceID != remote.TraceID || r.ParentSpanID != remote.SpanID {
+			t.Error("root span must continue the remote trace")
+		}
+		if c.SpanContext.TraceID != remote.TraceID || c.ParentSpanID != r.SpanContext.SpanID {
+			t.Error("child span must be the child of the root one")
+		}
+		if c.Error != "Account not found" || len(c.Attributes) != 1 || c.Kind != SpanKindInternal {
+			t.Errorf("unexpected child span: %+v", c)
+		}
+
+		// NOTE: untraced context and unsampled traces record nothing
+		if _, span := Start(context.Background(), "noop"); span != nil {
+			t.Error("expected no span without the parent")
+		}
+		unsampled := remote
+		unsampled.Sampled = false
+		if _, span := tracer.StartRoot(context.Background(), "noop", SpanKindServer, unsampled); span != nil {
+			t.Error("expected no span of the unsampled trace")
+		}
+		var span *Span
+		span.SetAttribute("key", "value")
+		span.End()
+	})
+
+	t.Run("Sampling", func(t *testing.T) {
+		tracer := NewTracer(&memExporter{}, Options{SampleRatio: 0.5})
+		defer tracer.Shutdown()
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			if _, span := tracer.StartRoot(context.Background(), "root", SpanKindServer, SpanContext{}); span != nil {
+				sampled++
+			}
+		}
+		if sampled < 400 || sampled > 600 {
+			t.Errorf("expected about half of traces sampled, got %d", sampled)
+		}
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		exp := &memExporter{}
+		tracer := NewTracer(exp, Options{SampleRatio: 1, BatchSize: 2, FlushInterval: time.Hour})
+		for i := 0; i < 5; i++ {
+			_, span := tracer.StartRoot(context.Background(), "root", SpanKindServer, SpanContext{})
+			span.End()
+		}
+		deadline := time.Now().Add(time.Second)
+		for len(exp.get()) < 4 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := len(exp.get()); n != 4 {
+			t.Errorf("expected 2 full batches exported, got %d spans", n)
+		}
+		tracer.Shutdown()
+		if n := len(exp.get()); n != 5 {
+			t.Errorf("expected the rest exported on shutdown, got %d spans", n)
+		}
+		_, span := tracer.StartRoot(context.Background(), "root", SpanKindServer, SpanContext{})
+		span.End()
+		if tracer.Dropped() != 1 {
+			t.Errorf("expected span ended after shutdown to be dropped, got %d", tracer.Dropped())
+		}
+	})
+
+	t.Run("WriterExporter", func(t *testing.T) {
+		var buf bytes.Buffer
+		tracer := NewTracer(NewWriterExporter(&buf, "api"), Options{SampleRatio: 1})
+		ctx, root := tracer.StartRoot(context.Background(), "root", SpanKindServer, SpanContext{})
+		_, child := StartKind(ctx, "SELECT", SpanKindClient)
+		child.SetAttribute("db.system", "sqlite")
+		child.End()
+		root.End()
+		tracer.Shutdown()
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 lines, got %d", len(lines))
+		}
+		var rec spanRecord
+		if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Service != "api" || rec.Kind != SpanKindClient || rec.ParentSpanID != root.SpanContext().SpanID.String() ||
+			rec.Attributes["db.system"] != "sqlite" {
+			t.Errorf("unexpected record: %+v", rec)
+		}
+	})
+
+	t.Run("OTLPExporter", func(t *testing.T) {
+		received := make(chan otlpRequest, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req otlpRequest
+			if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			received <- req
+		}))
+		defer ts.Close()
+
+		exp, err := NewExporter("otlp", ts.URL+"/v1/traces", "api", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		span := SpanData{
+			Name:       "store.TransferMoney",
+			Kind:       SpanKindInternal,
+			Start:      start,
+			End:        start.Add(time.Millisecond),
+			Attributes: []Attribute{{Key: "amount", Value: int64(100)}},
+			Error:      "Insufficient funds",
+		}
+		span.SpanContext.TraceID[0] = 1
+		span.SpanContext.SpanID[0] = 2
+		if err := exp.Export([]SpanData{span}); err != nil {
+			t.Fatal(err)
+		}
+		req := <-received
+		if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("unexpected request: %+v", req)
+		}
+		if v := req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; v == nil || *v != "api" {
+			t.Error("expected service name in the resource")
+		}
+		got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if got.TraceID != span.SpanContext.TraceID.String() || got.ParentSpanID != "" || got.Status.Code != 2 {
+			t.Errorf("unexpected span: %+v", got)
+		}
+		if v := got.Attributes[0].Value.IntValue; v == nil || *v != "100" {
+			t.Error("expected int attribute encoded as string")
+		}
+
+		bad, _ := NewExporter("otlp", ts.URL+"/wrong", "api", time.Second)
+		if err := bad.Export([]SpanData{span}); !errors.Is(err, badResponseCodeErr) {
+			t.Errorf("expected %v, got %v", badResponseCodeErr, err)
+		}
+		if _, err := NewExporter("zipkin", "", "api", time.Second); !errors.Is(err, unknownExporterErr) {
+			t.Errorf("expected %v, got %v", unknownExporterErr, err)
+		}
+	})
+}
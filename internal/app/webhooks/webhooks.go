@@ -0,0 +1,354 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+// Event types emitted by the api server
+const (
+	AccountCreated    = models.AccountCreatedEvent
+	AccountDeleted    = models.AccountDeletedEvent
+	TransferCompleted = models.TransferCompletedEvent
+	TransferFailed    = models.TransferFailedEvent
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Headers sent along with every delivery
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// DeliveryNotFailedErr is returned on replay of the delivery which hasn't failed
+var DeliveryNotFailedErr = errors.New("Only failed deliveries can be replayed")
+
+var (
+	dispatcherStoppedErr = errors.New("Webhooks dispatcher is stopped")
+	badResponseCodeErr   = errors.New("Webhook responded with non-2xx status code")
+	queueFullErr         = errors.New("Webhooks delivery queue is full")
+)
+
+// Store holds registered webhooks and the log of deliveries
+type Store interface {
+	InsertWebhook(url, secret string) (models.Webhook, error)
+	DeleteWebhook(webhookId int64) error
+	GetWebhook(webhookId int64) (models.Webhook, error)
+	ListWebhooks() ([]models.Webhook, error)
+	InsertDelivery(delivery models.WebhookDelivery) (models.WebhookDelivery, error)
+	UpdateDelivery(delivery models.WebhookDelivery) error
+	GetDelivery(deliveryId int64) (models.WebhookDelivery, error)
+	GetDeliveries(status string, limit int64) ([]models.WebhookDelivery, error)
+	// GetDueDeliveries returns deliveries with the status whose next attempt is due by now
+	GetDueDeliveries(status string, now time.Time, limit int64) ([]models.WebhookDelivery, error)
+}
+
+// Config holds retry and timeout settings of the dispatcher;
+// due deliveries are read from the store every PollInterval
+type Config struct {
+	MaxRetries     uint32
+	InitialBackoff time.Duration
+	Timeout        time.Duration
+	Workers        int
+	QueueSize      int
+	PollInterval   time.Duration
+}
+
+// maxBackoff caps the delay between attempts, so the shift doesn't overflow
+const maxBackoff = time.Hour
+
+// Envelope is the body posted to the webhook url
+type Envelope struct {
+	DeliveryID int64           `json:"delivery_id"`
+	Type       string          `json:"type"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Dispatcher delivers events to the registered webhooks in background; the store is the source
+// of truth: the queue only holds due deliveries, retries wait in the store until they're due
+type Dispatcher struct {
+	store  Store
+	config Config
+	client *http.Client
+	queue  chan int64
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+	mx     sync.Mutex
+	// scheduled holds deliveries which are queued or being delivered, so they're not queued twice
+	scheduled map[int64]bool
+}
+
+// NewDispatcher creates new instance of Dispatcher
+func NewDispatcher(store Store, config Config) *Dispatcher {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	return &Dispatcher{
+		store:     store,
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout},
+		queue:     make(chan int64, config.QueueSize),
+		quit:      make(chan struct{}),
+		scheduled: make(map[int64]bool),
+	}
+}
+
+// Start runs delivery workers and the poller, which queues deliveries left pending
+// by the previous run, retries once they're due and events which didn't fit into the queue
+func (d *Dispatcher) Start() error {
+	for i := 0; i < d.config.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	if err := d.poll(); err != nil {
+		return err
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.quit:
+				return
+			case <-ticker.C:
+				// NOTE: failed poll is repeated on the next tick, deliveries stay in the store
+				d.poll()
+			}
+		}
+	}()
+	return nil
+}
+
+// poll queues due deliveries until the queue is full
+func (d *Dispatcher) poll() error {
+	due, err := d.store.GetDueDeliveries(StatusPending, time.Now(), int64(cap(d.queue)))
+	if err != nil {
+		return err
+	}
+	for _, delivery := range due {
+		if !d.enqueue(delivery.DeliveryID) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stop stops accepting new events and waits for the workers to exit
+func (d *Dispatcher) Stop() {
+	d.once.Do(func() {
+		close(d.quit)
+	})
+	d.wg.Wait()
+}
+
+// Health reports whether the dispatcher keeps up with the deliveries:
+// while the queue is full new deliveries wait in the store for the poller
+func (d *Dispatcher) Health() error {
+	select {
+	case <-d.quit:
+		return dispatcherStoppedErr
+	default:
+	}
+	if len(d.queue) == cap(d.queue) {
+		return queueFullErr
+	}
+	return nil
+}
+
+// Sign returns hex encoded HMAC-SHA256 of the payload
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Emit stores delivery for every registered webhook and queues it; it never blocks on the queue:
+// deliveries which don't fit into it are picked up from the store by the poller
+func (d *Dispatcher) Emit(eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	hooks, err := d.store.ListWebhooks()
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		delivery, err := d.store.InsertDelivery(models.WebhookDelivery{
+			WebhookID: hook.WebhookID,
+			EventType: eventType,
+			Payload:   payload,
+			Status:    StatusPending,
+		})
+		if err != nil {
+			return err
+		}
+		d.enqueue(delivery.DeliveryID)
+	}
+	return nil
+}
+
+// Replay resets failed delivery and schedules it again
+func (d *Dispatcher) Replay(deliveryId int64) error {
+	delivery, err := d.store.GetDelivery(deliveryId)
+	if err != nil {
+		return err
+	}
+	if delivery.Status != StatusFailed {
+		return fmt.Errorf("%w: delivery %d is %s", DeliveryNotFailedErr, deliveryId, delivery.Status)
+	}
+	delivery.Status = StatusPending
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.NextAttemptAt = time.Time{}
+	if err := d.store.UpdateDelivery(delivery); err != nil {
+		return err
+	}
+	d.enqueue(delivery.DeliveryID)
+	return nil
+}
+
+// enqueue queues the delivery unless it's already scheduled; returns false if the queue is full
+// or the dispatcher is stopped, the delivery is then left in the store for the poller
+func (d *Dispatcher) enqueue(deliveryId int64) bool {
+	select {
+	case <-d.quit:
+		return false
+	default:
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.scheduled[deliveryId] {
+		return true
+	}
+	select {
+	case d.queue <- deliveryId:
+		d.scheduled[deliveryId] = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *Dispatcher) unschedule(deliveryId int64) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	delete(d.scheduled, deliveryId)
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case deliveryId := <-d.queue:
+			d.deliver(deliveryId)
+		}
+	}
+}
+
+// backoff returns delay before the next attempt, it's doubled after every failed one
+func (d *Dispatcher) backoff(attempts int64) time.Duration {
+	backoff := d.config.InitialBackoff
+	for i := int64(1); i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// deliver makes a single attempt and persists its outcome; failed delivery is scheduled
+// for the next attempt with exponential backoff, so workers never wait for retries
+func (d *Dispatcher) deliver(deliveryId int64) {
+	defer d.unschedule(deliveryId)
+	delivery, err := d.store.GetDelivery(deliveryId)
+	if err != nil || delivery.Status != StatusPending {
+		return
+	}
+	hook, err := d.store.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		delivery.Status = StatusFailed
+		delivery.LastError = err.Error()
+		d.store.UpdateDelivery(delivery)
+		return
+	}
+	delivery.Attempts++
+	err = d.post(hook, delivery)
+	switch {
+	case err == nil:
+		delivery.Status = StatusSucceeded
+		delivery.LastError = ""
+	case delivery.Attempts > int64(d.config.MaxRetries):
+		delivery.Status = StatusFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(d.backoff(delivery.Attempts))
+	}
+	d.store.UpdateDelivery(delivery)
+}
+
+func (d *Dispatcher) post(hook models.Webhook, delivery models.WebhookDelivery) error {
+	body, err := json.Marshal(Envelope{
+		DeliveryID: delivery.DeliveryID,
+		Type:       delivery.EventType,
+		CreatedAt:  delivery.CreatedAt,
+		Data:       delivery.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.DeliveryID, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(hook.Secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", badResponseCodeErr, resp.StatusCode)
+	}
+	return nil
+}
+
+// Store returns underlying webhooks registry
+func (d *Dispatcher) Store() Store {
+	return d.store
+}
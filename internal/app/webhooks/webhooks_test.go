@@ -0,0 +1,272 @@
+package webhooks
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gasparian/money-transfers-api/internal/app/models"
+)
+
+var (
+	notFoundErr          = errors.New("Not found")
+	badSignatureErr      = errors.New("Bad signature")
+	deliveryCorruptedErr = errors.New("Delivery corrupted")
+)
+
+type memStore struct {
+	mx         sync.Mutex
+	hooks      map[int64]models.Webhook
+	deliveries map[int64]models.WebhookDelivery
+	incID      int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		hooks:      make(map[int64]models.Webhook),
+		deliveries: make(map[int64]models.WebhookDelivery),
+	}
+}
+
+func (m *memStore) InsertWebhook(url, secret string) (models.Webhook, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.incID++
+	hook := models.Webhook{WebhookID: m.incID, URL: url, Secret: secret}
+	m.hooks[hook.WebhookID] = hook
+	return hook, nil
+}
+
+func (m *memStore) DeleteWebhook(webhookId int64) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	delete(m.hooks, webhookId)
+	return nil
+}
+
+func (m *memStore) GetWebhook(webhookId int64) (models.Webhook, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	hook, ok := m.hooks[webhookId]
+	if !ok {
+		return hook, notFoundErr
+	}
+	return hook, nil
+}
+
+func (m *memStore) ListWebhooks() ([]models.Webhook, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	res := make([]models.Webhook, 0, len(m.hooks))
+	for _, hook := range m.hooks {
+		res = append(res, hook)
+	}
+	return res, nil
+}
+
+func (m *memStore) InsertDelivery(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.incID++
+	delivery.DeliveryID = m.incID
+	m.deliveries[delivery.DeliveryID] = delivery
+	return delivery, nil
+}
+
+func (m *memStore) UpdateDelivery(delivery models.WebhookDelivery) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.deliveries[delivery.DeliveryID] = delivery
+	return nil
+}
+
+func (m *memStore) GetDelivery(deliveryId int64) (models.WebhookDelivery, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	delivery, ok := m.deliveries[deliveryId]
+	if !ok {
+		return delivery, notFoundErr
+	}
+	return delivery, nil
+}
+
+func (m *memStore) GetDeliveries(status string, limit int64) ([]models.WebhookDelivery, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	res := make([]models.WebhookDelivery, 0)
+	for _, delivery := range m.deliveries {
+		if delivery.Status == status && int64(len(res)) < limit {
+			res = append(res, delivery)
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) GetDueDeliveries(status string, now time.Time, limit int64) ([]models.WebhookDelivery, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	res := make([]models.WebhookDelivery, 0)
+	for _, delivery := range m.deliveries {
+		if delivery.Status == status && !delivery.NextAttemptAt.After(now) && int64(len(res)) < limit {
+			res = append(res, delivery)
+		}
+	}
+	return res, nil
+}
+
+func waitForStatus(store *memStore, status string) (models.WebhookDelivery, bool) {
+	for i := 0; i < 200; i++ {
+		deliveries, _ := store.GetDeliveries(status, 1)
+		if len(deliveries) > 0 {
+			return deliveries[0], true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return models.WebhookDelivery{}, false
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Run("SignedDelivery", func(t *testing.T) {
+		secret := "secret"
+		signatures := make(chan bool, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			signatures <- r.Header.Get(SignatureHeader) == "sha256="+Sign(secret, body) &&
+				r.Header.Get(EventHeader) == AccountCreated
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		store := newMemStore()
+		store.InsertWebhook(srv.URL, secret)
+		d := NewDispatcher(store, Config{MaxRetries: 1, InitialBackoff: time.Millisecond})
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Stop()
+
+		if err := d.Emit(AccountCreated, map[string]int64{"account_id": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if !<-signatures {
+			t.Error(badSignatureErr)
+		}
+		if _, ok := waitForStatus(store, StatusSucceeded); !ok {
+			t.Error(deliveryCorruptedErr)
+		}
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		store := newMemStore()
+		store.InsertWebhook("http://localhost:1", "secret")
+		// NOTE: dispatcher is not started, so nothing is taken from the queue
+		d := NewDispatcher(store, Config{QueueSize: 1})
+		if err := d.Health(); err != nil {
+			t.Error(err)
+		}
+		if err := d.Emit(AccountCreated, map[string]int64{"account_id": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Health(); !errors.Is(err, queueFullErr) {
+			t.Errorf("expected full queue, got %v", err)
+		}
+		// NOTE: events which don't fit into the queue are kept in the store, the caller isn't blocked
+		emitted := make(chan error, 1)
+		go func() {
+			emitted <- d.Emit(AccountCreated, map[string]int64{"account_id": 2})
+		}()
+		select {
+		case err := <-emitted:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Emit is blocked by the full queue")
+		}
+		if pending, _ := store.GetDeliveries(StatusPending, 10); len(pending) != 2 {
+			t.Errorf("expected both deliveries to be pending, got %v", len(pending))
+		}
+		d.Stop()
+		if err := d.Health(); !errors.Is(err, dispatcherStoppedErr) {
+			t.Errorf("expected stopped dispatcher, got %v", err)
+		}
+	})
+
+	t.Run("RetryAndReplay", func(t *testing.T) {
+		var mx sync.Mutex
+		fail := true
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			defer mx.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		store := newMemStore()
+		store.InsertWebhook(srv.URL, "secret")
+		d := NewDispatcher(store, Config{MaxRetries: 2, InitialBackoff: time.Millisecond, PollInterval: 5 * time.Millisecond})
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Stop()
+
+		if err := d.Emit(TransferFailed, map[string]int64{"amount": 1}); err != nil {
+			t.Fatal(err)
+		}
+		delivery, ok := waitForStatus(store, StatusFailed)
+		if !ok || delivery.Attempts != 3 {
+			t.Fatal(deliveryCorruptedErr)
+		}
+
+		mx.Lock()
+		fail = false
+		mx.Unlock()
+		if err := d.Replay(delivery.DeliveryID); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := waitForStatus(store, StatusSucceeded); !ok {
+			t.Error(deliveryCorruptedErr)
+		}
+		if err := d.Replay(delivery.DeliveryID); !errors.Is(err, DeliveryNotFailedErr) {
+			t.Errorf("expected %v, got %v", DeliveryNotFailedErr, err)
+		}
+	})
+
+	t.Run("PollQueued", func(t *testing.T) {
+		delivered := make(chan struct{}, 3)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delivered <- struct{}{}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		store := newMemStore()
+		store.InsertWebhook(srv.URL, "secret")
+		d := NewDispatcher(store, Config{QueueSize: 1, PollInterval: 5 * time.Millisecond})
+		// NOTE: events emitted before the start overflow the queue and wait in the store
+		for i := 0; i < 3; i++ {
+			if err := d.Emit(AccountCreated, map[string]int64{"account_id": int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Stop()
+		for i := 0; i < 3; i++ {
+			select {
+			case <-delivered:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected all deliveries to be polled from the store, got %v", i)
+			}
+		}
+	})
+}